@@ -4,21 +4,23 @@ go 1.19
 
 require (
 	github.com/elodina/go-avro v0.0.0-20160406082632-0c8185d9a3ba
+	github.com/klauspost/compress v1.15.7
 	github.com/panjf2000/ants v1.3.0
+	github.com/pierrec/lz4/v4 v4.1.15
 	github.com/segmentio/kafka-go v0.4.35
 	github.com/sirupsen/logrus v1.9.0
+	golang.org/x/net v0.0.0-20220706163947-c90051bbdb60
 	golang.org/x/time v0.1.0
+	gopkg.in/avro.v0 v0.0.0-20171217001914-a730b5802183
 )
 
 require (
 	github.com/fsnotify/fsnotify v1.5.4 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
-	github.com/klauspost/compress v1.15.7 // indirect
 	github.com/magiconair/properties v1.8.6 // indirect
 	github.com/mitchellh/mapstructure v1.5.0 // indirect
 	github.com/pelletier/go-toml v1.9.5 // indirect
 	github.com/pelletier/go-toml/v2 v2.0.5 // indirect
-	github.com/pierrec/lz4/v4 v4.1.15 // indirect
 	github.com/spf13/afero v1.8.2 // indirect
 	github.com/spf13/cast v1.5.0 // indirect
 	github.com/spf13/jwalterweatherman v1.1.0 // indirect
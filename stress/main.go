@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"flag"
 	"fmt"
 	"io"
@@ -15,6 +14,15 @@ import (
 var conf *utils.Config
 var logLevel int
 
+// commands run instead of the stress test with the same config file,
+// e.g. "stress serve-mock -cfg mock.toml"
+var commands = map[string]func(conf *utils.Config){
+	"serve-mock":  utils.ServeMock,
+	"serve-kafka": utils.ServeKafkaMock,
+	"chaos-proxy": utils.ServeChaosProxy,
+}
+var command string
+
 func init() {
 	parserOpts()
 	dateStr := time.Now().Format("2006-01-02-15-04-05")
@@ -47,6 +55,12 @@ func init() {
 }
 
 func parserOpts() {
+	if len(os.Args) > 1 {
+		if _, ok := commands[os.Args[1]]; ok {
+			command = os.Args[1]
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
 	var cfgPath string
 	flag.StringVar(&cfgPath,
 		"cfg",
@@ -56,10 +70,17 @@ func parserOpts() {
 	flag.Parse()
 
 	conf = utils.NewConfByFile(cfgPath)
-	conf.Validate()
+	// commands check the sections they use
+	if command == "" {
+		conf.Validate()
+	}
 }
 
 func main() {
+	if run, ok := commands[command]; ok {
+		run(conf)
+		return
+	}
 	//// Code for anysiszied CPU usage
 	// fd, err := os.Create("cpu.prof")
 
@@ -73,43 +94,6 @@ func main() {
 	// }
 	// defer pprof.StopCPUProfile()
 
-	log.Println(fmt.Sprintf("PoolSize: %v", conf.Threads))
-	consumerPoolSize := conf.Threads
-	producerPoolSize := consumerPoolSize * 2
-	capStatisChan := conf.Threads
-
-	// make chan to recive statis records
-	chanStatis := make(chan *utils.Statistician, capStatisChan)
-
-	// make to save report for each topic
-	reports := make(map[string]*utils.Report)
-
-	//map to keep channel ptr for each topic
-	chanPipes := make(map[string]*chan *bytes.Buffer)
-
-	//make a channel to send timeout signal
-	consumerCtlMap := make(map[string]*<-chan time.Time)
-	timeout := conf.RunTimeout * float64(time.Minute)
-	produceCtl := time.After(time.Duration(timeout))
-	if conf.RunTimeout > 0 {
-		log.Infof("Process will exit after %v Minute", conf.RunTimeout)
-	}
-
-	for _, topic := range conf.Topics {
-		ctlChan := time.After(time.Duration(timeout))
-		pipe := make(chan *bytes.Buffer, producerPoolSize+1)
-		chanPipes[topic] = &pipe
-		report := utils.NewReport(topic, conf, &chanStatis)
-		reports[topic] = report
-		consumerCtlMap[topic] = &ctlChan
-	}
-	//Start go routine to consume elements in channel chanStatis
-	//to avoid process blocked after chanStatis is full
-	go utils.Calc(&reports, &chanStatis)
-
-	go utils.DataProducer(conf, &chanPipes, &produceCtl, producerPoolSize)
-	// collect statis records, calculate and print summary
-	utils.Consumer4Topics(conf, &chanStatis, &chanPipes, &reports, &consumerCtlMap, consumerPoolSize)
-	utils.PrintSummary4Topics(&reports)
+	utils.PrintSummary4Sinks(utils.RunSinks(conf))
 
 }
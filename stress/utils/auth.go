@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	authLock       sync.Mutex
+	authenticators = make(map[string]*Authenticator)
+)
+
+// Credential is a user of the credential pool, Password is the hmac secret
+// in hmac mode.
+type Credential struct {
+	User     string
+	Password string
+}
+
+// Authenticator signs the requests of a http sink with auth.mode, users of
+// the pool are handed out round robin so that the load spreads over tenants.
+type Authenticator struct {
+	Mode  string
+	Pool  []Credential
+	next  uint64
+	token *tokenSource
+}
+
+// tokenSource keeps the bearer token, a token file is read again once its
+// modification time changes.
+type tokenSource struct {
+	sync.Mutex
+	path    string
+	token   string
+	modTime time.Time
+	checked time.Time
+}
+
+func (t *tokenSource) Token() (string, error) {
+	t.Lock()
+	defer t.Unlock()
+	if t.path == "" || time.Since(t.checked) < time.Second {
+		return t.token, nil
+	}
+	t.checked = time.Now()
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return t.token, err
+	}
+	if info.ModTime().Equal(t.modTime) {
+		return t.token, nil
+	}
+	content, err := os.ReadFile(t.path)
+	if err != nil {
+		return t.token, err
+	}
+	t.token = strings.TrimSpace(string(content))
+	t.modTime = info.ModTime()
+	log.Debugf("Reload bearer token from %s", t.path)
+	return t.token, nil
+}
+
+// ParseCredentials parses users given as "user:password".
+func ParseCredentials(users []string) ([]Credential, error) {
+	var pool []Credential
+	for _, item := range users {
+		user, password, ok := strings.Cut(item, ":")
+		if !ok || user == "" {
+			return nil, fmt.Errorf("invalid user %q, expect user:password", item)
+		}
+		pool = append(pool, Credential{User: user, Password: password})
+	}
+	return pool, nil
+}
+
+// SharedAuthenticator returns the authenticator of sink, defaultMode is used
+// when auth.mode is not set. Every sink of test.usemethods has its own
+// authenticator and credential rotation.
+func SharedAuthenticator(sink string, defaultMode string, conf *Config) *Authenticator {
+	authLock.Lock()
+	defer authLock.Unlock()
+	auth, ok := authenticators[sink]
+	if ok {
+		return auth
+	}
+	auth = &Authenticator{Mode: conf.AuthMode}
+	if auth.Mode == "" {
+		auth.Mode = defaultMode
+	}
+	// users are checked by Validate
+	auth.Pool, _ = ParseCredentials(conf.AuthUsers)
+	if len(auth.Pool) == 0 {
+		auth.Pool = []Credential{{User: conf.DpUser, Password: conf.DpPasswd}}
+	}
+	auth.token = &tokenSource{path: conf.AuthTokenFile, token: conf.AuthToken}
+	authenticators[sink] = auth
+	return auth
+}
+
+// Next returns the credential of the next message.
+func (a *Authenticator) Next() Credential {
+	i := atomic.AddUint64(&a.next, 1) - 1
+	return a.Pool[i%uint64(len(a.Pool))]
+}
+
+// Apply adds the credential headers of mode to request, body is the payload
+// sent on the wire and only used by hmac signing.
+func (a *Authenticator) Apply(request *http.Request, body []byte, cred Credential) error {
+	switch a.Mode {
+	case "header":
+		request.Header.Set("User", cred.User)
+		request.Header.Set("Password", cred.Password)
+	case "basic":
+		request.SetBasicAuth(cred.User, cred.Password)
+	case "bearer":
+		token, err := a.token.Token()
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+	case "hmac":
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set("X-Auth-User", cred.User)
+		request.Header.Set("X-Auth-Timestamp", timestamp)
+		request.Header.Set("X-Auth-Signature", SignRequest(cred.Password, request.Method, request.URL.RequestURI(), timestamp, body))
+	}
+	return nil
+}
+
+// SignRequest returns the hex hmac-sha256 of secret over the method, uri,
+// timestamp and the sha256 of body, each on its own line.
+func SignRequest(secret string, method string, uri string, timestamp string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	var canonical bytes.Buffer
+	canonical.WriteString(method + "\n")
+	canonical.WriteString(uri + "\n")
+	canonical.WriteString(timestamp + "\n")
+	canonical.WriteString(hex.EncodeToString(bodyHash[:]))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(canonical.Bytes())
+	return hex.EncodeToString(mac.Sum(nil))
+}
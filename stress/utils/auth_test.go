@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+// the expected signatures are computed with python's hmac and hashlib
+func TestSignRequest(t *testing.T) {
+	tests := []struct {
+		secret, method, uri, timestamp string
+		body                           []byte
+		signature                      string
+	}{
+		{"secret", "POST", "/dataload?topic=t1", "1700000000", []byte("a,b,c\n"),
+			"f8d16f1b9373e275fb4422030b8f221fbef7d5771af0ba461e354c61b0bb0cc1"},
+		{"", "GET", "/", "0", nil,
+			"f564b06be0316dc69d825c5d225faea826049a3182121c257e2e2e8f6ffc5362"},
+	}
+	for _, test := range tests {
+		if signature := SignRequest(test.secret, test.method, test.uri, test.timestamp, test.body); signature != test.signature {
+			t.Errorf("SignRequest(%q, %q, %q, %q) = %s, expect %s", test.secret, test.method, test.uri, test.timestamp, signature, test.signature)
+		}
+	}
+}
+
+func TestParseCredentials(t *testing.T) {
+	pool, err := ParseCredentials([]string{"a:1", "b:", "c:x:y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []Credential{{"a", "1"}, {"b", ""}, {"c", "x:y"}}
+	if len(pool) != len(expect) {
+		t.Fatalf("ParseCredentials = %v", pool)
+	}
+	for i := range expect {
+		if pool[i] != expect[i] {
+			t.Errorf("credential %d = %v, expect %v", i, pool[i], expect[i])
+		}
+	}
+	for _, user := range []string{"a", ":1"} {
+		if _, err := ParseCredentials([]string{user}); err == nil {
+			t.Errorf("ParseCredentials(%q) is accepted", user)
+		}
+	}
+}
+
+func TestAuthenticatorApply(t *testing.T) {
+	cred := Credential{User: "u", Password: "p"}
+	body := []byte("a,b,c\n")
+	for _, mode := range []string{"none", "header", "basic", "bearer", "hmac"} {
+		auth := &Authenticator{Mode: mode, Pool: []Credential{cred}, token: &tokenSource{token: "tok"}}
+		request, _ := http.NewRequest("POST", "http://sink/dataload?topic=t1", bytes.NewReader(body))
+		if err := auth.Apply(request, body, auth.Next()); err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		header := request.Header
+		switch mode {
+		case "none":
+			if len(header) != 0 {
+				t.Errorf("none sets %v", header)
+			}
+		case "header":
+			if header.Get("User") != "u" || header.Get("Password") != "p" {
+				t.Errorf("header sets %v", header)
+			}
+		case "basic":
+			if user, password, ok := request.BasicAuth(); !ok || user != "u" || password != "p" {
+				t.Errorf("basic sets %v", header)
+			}
+		case "bearer":
+			if header.Get("Authorization") != "Bearer tok" {
+				t.Errorf("bearer sets %v", header)
+			}
+		case "hmac":
+			signature := SignRequest("p", "POST", "/dataload?topic=t1", header.Get("X-Auth-Timestamp"), body)
+			if header.Get("X-Auth-User") != "u" || header.Get("X-Auth-Signature") != signature {
+				t.Errorf("hmac sets %v", header)
+			}
+		}
+	}
+}
+
+func TestAuthenticatorNext(t *testing.T) {
+	auth := &Authenticator{Pool: []Credential{{User: "a"}, {User: "b"}}}
+	var users string
+	for i := 0; i < 5; i++ {
+		users += auth.Next().User
+	}
+	if users != "ababa" {
+		t.Errorf("Next rotates %s", users)
+	}
+}
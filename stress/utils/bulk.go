@@ -0,0 +1,157 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// bulkResponse is the part of the _bulk response used to count the rows,
+// each item has a single key named after the action.
+type bulkResponse struct {
+	Errors bool                        `json:"errors"`
+	Items  []map[string]bulkItemResult `json:"items"`
+}
+
+type bulkItemResult struct {
+	Status int `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// parseBulkIndex parses the index name template of the [bulk] section.
+func parseBulkIndex(conf *Config) (*template.Template, error) {
+	return template.New("index").Option("missingkey=error").Parse(conf.BulkIndex)
+}
+
+// NewBulkHandler returns a http handler of the Elasticsearch/OpenSearch
+// _bulk api, every row of the message becomes a document.
+func NewBulkHandler(topic string, conf *Config) *HttpHandler {
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-ndjson")
+	// the template is checked by Validate
+	indexTmpl, _ := parseBulkIndex(conf)
+	return &HttpHandler{
+		Topic:  topic,
+		Cli:    &http.Client{Transport: SharedTransport("bulk", conf)},
+		Url:    strings.TrimRight(conf.BulkUrl, "/") + "/_bulk",
+		Conf:   conf,
+		Method: "POST",
+		Header: header,
+		Success: func(code int) bool {
+			return code == http.StatusOK
+		},
+		Auth: SharedAuthenticator("bulk", "none", conf),
+		Encode: func(data []byte, vars *TemplateVars) ([]byte, error) {
+			index, err := vars.Render(indexTmpl)
+			if err != nil {
+				return nil, err
+			}
+			rows, err := DecodeRows(conf.DataFmt, data)
+			if err != nil {
+				return nil, err
+			}
+			return EncodeBulk(rows, index, conf.BulkAction, conf.BulkIdStrategy, vars)
+		},
+		Inspect: InspectBulk,
+	}
+}
+
+// EncodeBulk writes rows as NDJSON _bulk body, an action line followed by
+// the document of each row.
+func EncodeBulk(rows []*DataRow, index string, action string, idStrategy string, vars *TemplateVars) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	for i, row := range rows {
+		doc, err := encodeDocument(*row)
+		if err != nil {
+			return nil, err
+		}
+		meta := map[string]string{"_index": index}
+		switch idStrategy {
+		case "flowid":
+			meta["_id"] = row.C_flowid
+		case "seq":
+			// same ids for every run of a message, retries overwrite the
+			// documents instead of adding new ones
+			meta["_id"] = fmt.Sprintf("%s-%s-%d-%d", vars.RunId, vars.Topic, vars.Seq, i)
+		case "hash":
+			sum := sha1.Sum(doc)
+			meta["_id"] = hex.EncodeToString(sum[:])
+		}
+		line, err := json.Marshal(map[string]map[string]string{action: meta})
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(line)
+		buffer.WriteByte('\n')
+		buffer.Write(doc)
+		buffer.WriteByte('\n')
+	}
+	return buffer.Bytes(), nil
+}
+
+// encodeDocument returns the json document of row, fields keep the schema order.
+func encodeDocument(row DataRow) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	buffer.WriteByte('{')
+	for i, field := range RowFields(row) {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		value, err := json.Marshal(field.Value)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(buffer, "%q:", field.Name)
+		buffer.Write(value)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+// InspectBulk counts the items of a _bulk response, the request succeeds as a
+// whole while the rejected items are failed rows grouped by error type.
+func InspectBulk(content []byte, statis *Statistician) {
+	response := &bulkResponse{}
+	if err := json.Unmarshal(content, response); err != nil {
+		log.Errorf("Parse bulk response with error, %v", err)
+		statis.State = false
+		statis.Reason = "bulk_bad_response"
+		statis.Error = err.Error()
+		return
+	}
+	statis.Rows = int64(len(response.Items))
+	if !response.Errors {
+		return
+	}
+	statis.RowReasons = make(map[string]*ReasonCount)
+	for _, item := range response.Items {
+		for _, result := range item {
+			if result.Status < 300 {
+				continue
+			}
+			name, sample := StatusReason(result.Status), ""
+			if result.Error != nil {
+				name = "bulk_" + result.Error.Type
+				sample = result.Error.Reason
+			}
+			reason, ok := statis.RowReasons[name]
+			if !ok {
+				reason = &ReasonCount{Sample: sample}
+				statis.RowReasons[name] = reason
+			}
+			reason.Count += 1
+			statis.FailedRows += 1
+		}
+	}
+	log.Debugf("Bulk request of topic %s has %d failed rows", statis.Topic, statis.FailedRows)
+}
@@ -0,0 +1,319 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ChaosPhase is an entry of [[chaos.phases]], the fault is applied to all
+// connections of the proxy for Duration seconds.
+type ChaosPhase struct {
+	Fault       string  // none, latency, bandwidth, reset, hang or blackhole
+	Duration    int     // Seconds
+	Latency     int     // Milliseconds added to each chunk
+	Jitter      int     // random Milliseconds added to Latency
+	Rate        int     // Bytes per second of each direction
+	Probability float64 // chance of each chunk to reset the connection
+}
+
+// ChaosCounter counts the traffic of a phase, all rounds of chaos.loop
+// are added up.
+type ChaosCounter struct {
+	Rounds      int64
+	Connections int64
+	BytesUp     int64 // client to upstream
+	BytesDown   int64 // upstream to client
+	Dropped     int64 // bytes swallowed by blackhole
+	Resets      int64
+}
+
+// ChaosProxy forwards the connections of chaos.listen to chaos.upstream
+// and injects the fault of the current phase.
+type ChaosProxy struct {
+	Conf      *Config
+	StartTime time.Time
+	listener  net.Listener
+	dialer    *net.Dialer
+	lock      sync.Mutex
+	phase     int
+	changed   chan struct{} // closed when the phase ends
+	counters  []ChaosCounter
+	// the bandwidth is shared by all connections, the time the next
+	// chunk of each direction may be sent
+	nextUp   time.Time
+	nextDown time.Time
+}
+
+func NewChaosProxy(conf *Config) *ChaosProxy {
+	proxy := &ChaosProxy{
+		Conf:      conf,
+		StartTime: time.Now(),
+		dialer:    NewDialer(conf, "tcp"),
+		changed:   make(chan struct{}),
+		counters:  make([]ChaosCounter, len(conf.ChaosPhases)),
+	}
+	proxy.counters[0].Rounds = 1
+	return proxy
+}
+
+func (p *ChaosProxy) Listen() error {
+	listener, err := net.Listen("tcp", p.Conf.ChaosListen)
+	if err != nil {
+		return err
+	}
+	p.listener = listener
+	return nil
+}
+
+// Serve accepts connections until Close.
+func (p *ChaosProxy) Serve() error {
+	go p.schedule()
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go p.serveConn(conn)
+	}
+}
+
+func (p *ChaosProxy) Close() error {
+	return p.listener.Close()
+}
+
+// current returns the phase and the channel closed when it ends.
+func (p *ChaosProxy) current() (int, ChaosPhase, chan struct{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.phase, p.Conf.ChaosPhases[p.phase], p.changed
+}
+
+// count updates the counter of phase under the lock.
+func (p *ChaosProxy) count(phase int, update func(counter *ChaosCounter)) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	update(&p.counters[phase])
+}
+
+// schedule moves to the next phase after the duration of the current one.
+// Without chaos.loop the last phase lasts until exit.
+func (p *ChaosProxy) schedule() {
+	phases := p.Conf.ChaosPhases
+	for i := 0; ; {
+		log.Infof("Chaos phase %d %s for %d s", i, phases[i].Fault, phases[i].Duration)
+		next := i + 1
+		if next == len(phases) {
+			if !p.Conf.ChaosLoop {
+				return
+			}
+			next = 0
+		}
+		time.Sleep(time.Duration(phases[i].Duration) * time.Second)
+		p.lock.Lock()
+		p.phase = next
+		p.counters[next].Rounds += 1
+		close(p.changed)
+		p.changed = make(chan struct{})
+		p.lock.Unlock()
+		i = next
+	}
+}
+
+// waitHang blocks while the current phase is hang and returns the phase
+// after it. Data read before the hang is held, the peers see a half-open
+// connection that neither answers nor closes.
+func (p *ChaosProxy) waitHang() (int, ChaosPhase) {
+	index, phase, changed := p.current()
+	for phase.Fault == "hang" {
+		<-changed
+		index, phase, changed = p.current()
+	}
+	return index, phase
+}
+
+// abort closes conn with a RST instead of a FIN.
+func abort(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
+
+func (p *ChaosProxy) serveConn(client net.Conn) {
+	index, _, _ := p.current()
+	p.count(index, func(counter *ChaosCounter) { counter.Connections += 1 })
+	// the handshake is done by the kernel, a hanging proxy does not
+	// connect the upstream until the hang ends
+	index, phase := p.waitHang()
+	if phase.Fault == "reset" && rand.Float64() < phase.Probability {
+		p.count(index, func(counter *ChaosCounter) { counter.Resets += 1 })
+		abort(client)
+		return
+	}
+	upstream, err := p.dialer.Dial("tcp", p.Conf.ChaosUpstream)
+	if err != nil {
+		log.Debugf("Connect upstream %s with error %v", p.Conf.ChaosUpstream, err)
+		abort(client)
+		return
+	}
+	var once sync.Once
+	reset := func() {
+		once.Do(func() {
+			abort(client)
+			abort(upstream)
+		})
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		p.pipe(client, upstream, true, reset)
+	}()
+	go func() {
+		defer wg.Done()
+		p.pipe(upstream, client, false, reset)
+	}()
+	wg.Wait()
+	client.Close()
+	upstream.Close()
+}
+
+// pipe copies src to dst with the fault of the current phase applied to
+// each chunk read.
+func (p *ChaosProxy) pipe(src, dst net.Conn, up bool, reset func()) {
+	buf := make([]byte, 32*1024)
+	for {
+		// a hanging proxy stops reading, the sender blocks once the
+		// socket buffers are full
+		p.waitHang()
+		n, err := src.Read(buf)
+		if n > 0 {
+			index, phase := p.waitHang()
+			switch phase.Fault {
+			case "blackhole":
+				p.count(index, func(counter *ChaosCounter) { counter.Dropped += int64(n) })
+				if err == nil {
+					continue
+				}
+			case "reset":
+				if rand.Float64() < phase.Probability {
+					p.count(index, func(counter *ChaosCounter) { counter.Resets += 1 })
+					reset()
+					return
+				}
+			case "latency":
+				latency := phase.Latency
+				if phase.Jitter > 0 {
+					latency += rand.Intn(phase.Jitter + 1)
+				}
+				time.Sleep(time.Duration(latency) * time.Millisecond)
+			case "bandwidth":
+				p.throttle(up, n, phase.Rate)
+			}
+			if phase.Fault != "blackhole" {
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					reset()
+					return
+				}
+				p.count(index, func(counter *ChaosCounter) {
+					if up {
+						counter.BytesUp += int64(n)
+					} else {
+						counter.BytesDown += int64(n)
+					}
+				})
+			}
+		}
+		if err != nil {
+			// only this direction is closed, the other one may still
+			// carry the response
+			if tcp, ok := dst.(*net.TCPConn); ok {
+				tcp.CloseWrite()
+			} else {
+				dst.Close()
+			}
+			return
+		}
+	}
+}
+
+// throttle waits until n bytes fit into rate bytes per second of the
+// direction.
+func (p *ChaosProxy) throttle(up bool, n int, rate int) {
+	p.lock.Lock()
+	next := &p.nextDown
+	if up {
+		next = &p.nextUp
+	}
+	start := time.Now()
+	if next.After(start) {
+		start = *next
+	}
+	*next = start.Add(time.Duration(n) * time.Second / time.Duration(rate))
+	wait := time.Until(*next)
+	p.lock.Unlock()
+	time.Sleep(wait)
+}
+
+// Print prints the counters per phase, the phases are compared with the
+// errors and Retry Attempts of the client report.
+func (p *ChaosProxy) Print() {
+	p.lock.Lock()
+	phase := p.phase
+	counters := make([]ChaosCounter, len(p.counters))
+	copy(counters, p.counters)
+	p.lock.Unlock()
+	lines := []string{
+		fmt.Sprintf("==============Chaos proxy %s -> %s, up %.3f s, phase %d======================", p.Conf.ChaosListen, p.Conf.ChaosUpstream, time.Since(p.StartTime).Seconds(), phase),
+		fmt.Sprintf("%-6s %-10s %10s %8s %12s %16s %16s %14s %10s", "Phase", "Fault", "Duration", "Rounds", "Connections", "BytesUp", "BytesDown", "Dropped", "Resets"),
+	}
+	for i, c := range counters {
+		fault := p.Conf.ChaosPhases[i].Fault
+		lines = append(lines, fmt.Sprintf("%-6d %-10s %10d %8d %12d %16d %16d %14d %10d", i, fault, p.Conf.ChaosPhases[i].Duration, c.Rounds, c.Connections, c.BytesUp, c.BytesDown, c.Dropped, c.Resets))
+	}
+	for _, line := range lines {
+		log.Infoln(line)
+	}
+	fmt.Println(strings.Join(lines, "\n"))
+}
+
+// ServeChaosProxy runs the fault injecting proxy of the [chaos] section
+// until the process is interrupted, the counters are printed at exit.
+func ServeChaosProxy(conf *Config) {
+	conf.ValidateChaos()
+	proxy := NewChaosProxy(conf)
+	if err := proxy.Listen(); err != nil {
+		log.Fatalf("Listen chaos proxy on %s with error %v", conf.ChaosListen, err)
+	}
+	if conf.ChaosStatsInterval > 0 {
+		go func() {
+			for range time.Tick(time.Duration(conf.ChaosStatsInterval) * time.Second) {
+				proxy.Print()
+			}
+		}()
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		proxy.Close()
+	}()
+	log.Infof("Chaos proxy listening on %s, upstream %s", conf.ChaosListen, conf.ChaosUpstream)
+	if err := proxy.Serve(); err != nil {
+		log.Fatalf("Serve chaos proxy on %s with error %v", conf.ChaosListen, err)
+	}
+	proxy.Print()
+}
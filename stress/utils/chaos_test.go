@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// startChaosProxy runs a proxy with phases in front of an echo server.
+func startChaosProxy(t *testing.T, phases []ChaosPhase) (*ChaosProxy, string) {
+	t.Helper()
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { upstream.Close() })
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	proxy := NewChaosProxy(&Config{
+		ChaosListen:   "127.0.0.1:0",
+		ChaosUpstream: upstream.Addr().String(),
+		ChaosPhases:   phases,
+	})
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go proxy.Serve()
+	t.Cleanup(func() { proxy.Close() })
+	return proxy, proxy.listener.Addr().String()
+}
+
+func chaosCounter(p *ChaosProxy, phase int) ChaosCounter {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.counters[phase]
+}
+
+// TestChaosProxyPhases passes the bytes through in the none phase and drops
+// them once the schedule moved to the blackhole phase.
+func TestChaosProxyPhases(t *testing.T) {
+	proxy, addr := startChaosProxy(t, []ChaosPhase{{Fault: "none", Duration: 1}, {Fault: "blackhole"}})
+	_, _, changed := proxy.current()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("ping"))
+	echo := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, echo); err != nil || string(echo) != "ping" {
+		t.Fatalf("none phase echoed %q, %v", echo, err)
+	}
+	if counter := chaosCounter(proxy, 0); counter.Connections != 1 || counter.BytesUp != 4 || counter.BytesDown != 4 {
+		t.Errorf("none phase counted %+v", counter)
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("phase did not change after its duration")
+	}
+	if index, phase, _ := proxy.current(); index != 1 || phase.Fault != "blackhole" {
+		t.Fatalf("phase %d %s after the first one", index, phase.Fault)
+	}
+	conn.Write([]byte("lost"))
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if n, err := conn.Read(echo); n > 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("blackhole forwarded %q, %v", echo[:n], err)
+	}
+	if counter := chaosCounter(proxy, 1); counter.Rounds != 1 || counter.Dropped != 4 || counter.BytesUp != 0 {
+		t.Errorf("blackhole phase counted %+v", counter)
+	}
+}
+
+// TestChaosProxyReset aborts the client connection, either at the dial or
+// at the first read depending on how fast the proxy reset it.
+func TestChaosProxyReset(t *testing.T) {
+	proxy, addr := startChaosProxy(t, []ChaosPhase{{Fault: "reset", Probability: 1}})
+	conn, err := net.Dial("tcp", addr)
+	if err == nil {
+		defer conn.Close()
+		conn.Write([]byte("ping"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var n int
+		n, err = conn.Read(make([]byte, 4))
+		if n > 0 || errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("reset phase read %d bytes, %v", n, err)
+		}
+	}
+	if err == nil {
+		t.Fatal("reset phase kept the connection open")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for chaosCounter(proxy, 0).Resets == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if counter := chaosCounter(proxy, 0); counter.Resets != 1 || counter.BytesUp != 0 {
+		t.Errorf("reset phase counted %+v", counter)
+	}
+}
+
+// TestChaosThrottle checks that the chunks of a direction are spread at
+// rate bytes per second.
+func TestChaosThrottle(t *testing.T) {
+	proxy := NewChaosProxy(&Config{ChaosPhases: []ChaosPhase{{Fault: "bandwidth", Rate: 1000}}})
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		proxy.throttle(true, 100, 1000)
+	}
+	// 300 bytes at 1000 bytes per second
+	if elapsed := time.Since(start); elapsed < 290*time.Millisecond || elapsed > time.Second {
+		t.Errorf("3 chunks of 100 bytes took %v", elapsed)
+	}
+	if d := proxy.nextUp.Sub(start); d < 300*time.Millisecond || d > time.Second {
+		t.Errorf("next chunk up at %v", d)
+	}
+	// the directions are throttled apart
+	downStart := time.Now()
+	proxy.throttle(false, 100, 1000)
+	if elapsed := time.Since(downStart); elapsed > 200*time.Millisecond {
+		t.Errorf("first chunk down took %v", elapsed)
+	}
+}
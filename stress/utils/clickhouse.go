@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// parseClickHouseTable parses the table name template of the [clickhouse] section.
+func parseClickHouseTable(conf *Config) (*template.Template, error) {
+	return template.New("table").Option("missingkey=error").Parse(conf.ClickHouseTable)
+}
+
+// ClickHouseTable returns the table receiving the rows of topic, a table
+// given in clickhouse.tables wins over the clickhouse.table template.
+func ClickHouseTable(topic string, conf *Config) (string, error) {
+	tmpl, err := parseClickHouseTable(conf)
+	if err != nil {
+		return "", err
+	}
+	return TopicName(topic, conf, conf.ClickHouseTables, tmpl)
+}
+
+// NewClickHouseHandler returns a http handler inserting the messages of
+// topic through the http interface of ClickHouse.
+func NewClickHouseHandler(topic string, conf *Config) *HttpHandler {
+	header := http.Header{}
+	format := "CSV"
+	if conf.DataFmt == "avro" {
+		format = "Avro"
+		header.Set("Content-Type", "application/avro")
+	} else {
+		header.Set("Content-Type", "text/csv")
+	}
+	// the template is checked by Validate
+	table, _ := ClickHouseTable(topic, conf)
+	query := url.Values{}
+	query.Set("query", fmt.Sprintf("INSERT INTO %s FORMAT %s", table, format))
+	if conf.ClickHouseDatabase != "" {
+		query.Set("database", conf.ClickHouseDatabase)
+	}
+	handler := &HttpHandler{
+		Topic:  topic,
+		Cli:    &http.Client{Transport: SharedTransport("clickhouse", conf)},
+		Url:    strings.TrimRight(conf.ClickHouseUrl, "/") + "/?" + query.Encode(),
+		Conf:   conf,
+		Method: "POST",
+		Header: header,
+		Success: func(code int) bool {
+			return code == http.StatusOK
+		},
+		Auth: SharedAuthenticator("clickhouse", "basic", conf),
+	}
+	if conf.DataFmt == "avro" {
+		// FORMAT Avro reads object container files, not bare datums
+		handler.Encode = func(data []byte, vars *TemplateVars) ([]byte, error) {
+			return AvroContainer(int64(conf.MessageSize), data), nil
+		}
+	}
+	return handler
+}
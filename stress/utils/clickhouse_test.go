@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gopkg.in/avro.v0"
+)
+
+func TestClickHouseHandler(t *testing.T) {
+	var query, database, contentType string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("query")
+		database = r.URL.Query().Get("database")
+		contentType = r.Header.Get("Content-Type")
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		datafmt     string
+		query       string
+		contentType string
+	}{
+		{"csv", "INSERT INTO db_t1 FORMAT CSV", "text/csv"},
+		{"avro", "INSERT INTO db_t1 FORMAT Avro", "application/avro"},
+	}
+	for _, tt := range tests {
+		conf := testConf(t, fmt.Sprintf(`
+[required]
+topics=["t1"]
+recordnum=20
+datafmt=%q
+usemethod=5
+[clickhouse]
+url=%q
+database="stress"
+table="db_{{.Topic}}"
+`, tt.datafmt, server.URL))
+		var data *bytes.Buffer
+		if tt.datafmt == "avro" {
+			data = Write2Avro(20)
+		} else {
+			data = Write2Csv(20)
+		}
+		raw := append([]byte(nil), data.Bytes()...)
+		out := make(chan *Statistician, 1)
+		NewClickHouseHandler("t1", conf).Do(conf, data, &out)
+		if statis := <-out; !statis.State {
+			t.Fatalf("%s: %+v", tt.datafmt, statis)
+		}
+		if query != tt.query || database != "stress" || contentType != tt.contentType {
+			t.Errorf("%s: query %q, database %q, Content-Type %q", tt.datafmt, query, database, contentType)
+		}
+		if tt.datafmt == "csv" {
+			if !bytes.Equal(body, raw) {
+				t.Errorf("csv: server got %d bytes of %d", len(body), len(raw))
+			}
+			continue
+		}
+		// the avro body is an object container file holding the datums
+		if !bytes.Contains(body, raw) {
+			t.Errorf("avro: datums missing from the %d bytes body", len(body))
+		}
+		path := filepath.Join(t.TempDir(), "body.avro")
+		if err := os.WriteFile(path, body, 0644); err != nil {
+			t.Fatal(err)
+		}
+		schema := avro.MustParseSchema(DataSchema)
+		reader, err := avro.NewDataFileReader(path, avro.NewGenericDatumReader())
+		if err != nil {
+			t.Fatalf("avro: %v", err)
+		}
+		rows := 0
+		for {
+			record := avro.NewGenericRecord(schema)
+			ok, err := reader.Next(record)
+			if err != nil {
+				t.Fatalf("avro: row %d: %v", rows, err)
+			}
+			if !ok {
+				break
+			}
+			rows++
+		}
+		if rows != 20 {
+			t.Errorf("avro: container holds %d rows", rows)
+		}
+	}
+}
@@ -1,11 +1,18 @@
 package utils
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	kafka "github.com/segmentio/kafka-go"
@@ -17,68 +24,395 @@ type Handler interface {
 }
 
 type HttpHandler struct {
-	Cli   *http.Client
-	Url   string
-	Topic string
-	Conf  *Config
+	Cli     *http.Client
+	Url     string
+	Topic   string
+	Conf    *Config
+	Method  string
+	Header  http.Header // sink specific headers sent with each request
+	Success func(code int) bool
+	Auth    *Authenticator
+	// sinks with per message url or headers render them from templates
+	UrlTmpl    *template.Template
+	HeaderTmpl map[string]*template.Template
+	// Encode turns the message into the body of sinks with their own
+	// payload format, Inspect reads the rows rejected by a successful response
+	Encode  func(data []byte, vars *TemplateVars) ([]byte, error)
+	Inspect func(content []byte, statis *Statistician)
+	// requests go to an endpoint of the pool, Url is the path then
+	Pool *EndpointPool
 }
 
 func NewHttpHandler(topic string, conf *Config) *HttpHandler {
-	return &HttpHandler{
-		Topic: topic,
-		Cli:   &http.Client{},
-		Url:   fmt.Sprintf("http://%s/dataload?topic=%s", conf.Eip, topic),
-		Conf:  conf,
+	header := http.Header{}
+	if conf.DataFmt == "avro" {
+		header.Add("Context-Type", "avro")
+		header.Add("Content-Type", "application/avro")
+	} else {
+		header.Add("Context-Type", "csv")
+		header.Add("Content-Type", "text/csv")
+	}
+	host := conf.Eip
+	if strings.HasPrefix(host, "unix://") {
+		// the transport dials the socket, the host is only sent in the Host header
+		host = "localhost"
+	}
+	handler := &HttpHandler{
+		Topic:  topic,
+		Cli:    &http.Client{Transport: SharedTransport("dataproxy", conf)},
+		Url:    fmt.Sprintf("%s://%s/dataload?topic=%s", conf.HttpScheme, host, topic),
+		Conf:   conf,
+		Method: "POST",
+		Header: header,
+		Success: func(code int) bool {
+			return code == http.StatusOK
+		},
+		Auth: SharedAuthenticator("dataproxy", "header", conf),
+		Pool: SharedEndpointPool(conf),
+	}
+	if handler.Pool != nil {
+		handler.Url = fmt.Sprintf("/dataload?topic=%s", topic)
 	}
+	return handler
+}
+
+// render returns the url and headers of a message, templates get the
+// topic, run id and sequence of the message.
+func (h *HttpHandler) render() (string, http.Header, *TemplateVars, error) {
+	url := h.Url
+	header := h.Header.Clone()
+	vars := &TemplateVars{
+		Topic: h.Topic,
+		RunId: h.Conf.RunId,
+		Seq:   NextSeq(h.Conf, h.Topic),
+	}
+	if h.UrlTmpl != nil {
+		out, err := vars.Render(h.UrlTmpl)
+		if err != nil {
+			return url, header, vars, err
+		}
+		url = out
+	}
+	for name, tmpl := range h.HeaderTmpl {
+		out, err := vars.Render(tmpl)
+		if err != nil {
+			return url, header, vars, err
+		}
+		header.Set(name, out)
+	}
+	return url, header, vars, nil
 }
 
 func (h *HttpHandler) Do(conf *Config, data *bytes.Buffer, chanOut *chan *Statistician) error {
 
-	reader := bytes.NewReader(data.Bytes())
-	request, p_err := http.NewRequest("POST", h.Url, reader)
+	statis := NewStatistician(h.Topic)
+	url, header, vars, r_err := h.render()
+	if r_err != nil {
+		log.Errorf("Render http request with error, %v", r_err)
+		return h.fail(statis, "render", r_err, chanOut)
+	}
+	body := data.Bytes()
+	if h.Encode != nil {
+		encoded, e_err := h.Encode(body, vars)
+		if e_err != nil {
+			log.Errorf("Encode message for topic %s with error, %v", h.Topic, e_err)
+			return h.fail(statis, "encode", e_err, chanOut)
+		}
+		body = encoded
+	}
+	rawBytes := int64(len(body))
+	if !h.Conf.HttpStreaming && h.Conf.HttpCompression != "none" {
+		compressStart := time.Now()
+		encoded, c_err := Compress(h.Conf.HttpCompression, body)
+		if c_err != nil {
+			log.Errorf("Compress data with error, %v", c_err)
+			return h.fail(statis, "compress", c_err, chanOut)
+		}
+		statis.CompressTime = time.Since(compressStart).Microseconds()
+		body = encoded
+	}
+	// the same key is sent with every attempt of a message so that the
+	// server is able to drop the duplicates of a retried request
+	if h.Conf.RetryIdempotencyHeader != "" {
+		header.Set(h.Conf.RetryIdempotencyHeader, RandStr(16))
+	}
+	cred := h.Auth.Next()
+
+	for attempt := 1; ; attempt++ {
+		statis.Attempts = attempt
+		target := url
+		var endpoint *Endpoint
+		if h.Pool != nil {
+			// every attempt picks an endpoint, a retry may go to another node
+			endpoint = h.Pool.Acquire()
+			target = endpoint.Base + url
+		}
+		sentTime := statis.SentTime
+		result, s_err := h.send(target, header, body, cred, statis)
+		if !h.Conf.HttpStreaming {
+			// body is compressed already
+			result.RawBytes = rawBytes
+		}
+		if endpoint != nil {
+			// 4xx are caused by the request, not by the node
+			h.Pool.Release(endpoint, s_err != nil || result.StatusCode >= 500)
+			statis.EndpointAttempts = append(statis.EndpointAttempts, EndpointAttempt{
+				Endpoint: endpoint.Addr,
+				Failed:   s_err != nil || !h.Success(result.StatusCode),
+				Time:     statis.SentTime - sentTime,
+			})
+		}
+		statis.Proto = result.Proto
+		if s_err != nil {
+			log.Errorf("Sent http request with error, %v", s_err)
+			statis.Reason = ClassifyError(s_err)
+			statis.Error = s_err.Error()
+		} else if !h.Success(result.StatusCode) {
+			log.Errorf("Response code: %v, %s", result.StatusCode, string(result.Content))
+			statis.Reason = StatusReason(result.StatusCode)
+			statis.Error = fmt.Sprintf("%d %s", result.StatusCode, result.Content)
+		} else {
+			statis.Reason = StatusReason(result.StatusCode)
+			statis.Error = ""
+			statis.State = true
+			statis.SentBytes = result.RawBytes
+			statis.WireBytes = result.WireBytes
+			log.Debugf("Response code: %v, %s", result.StatusCode, string(result.Content))
+			if h.Inspect != nil {
+				h.Inspect(result.Content, statis)
+			}
+			break
+		}
+		if attempt >= h.Conf.RetryMaxAttempts || !ShouldRetry(h.Conf, result, s_err) {
+			statis.State = false
+			break
+		}
+		if result.Wrote {
+			// the server got the whole body, it may have loaded the rows
+			statis.AmbiguousAttempts += 1
+		}
+		delay := RetryDelay(h.Conf, attempt, result)
+		log.Debugf("Retry request for topic %s after %v, attempt %d", h.Topic, delay, attempt+1)
+		time.Sleep(delay)
+	}
+	*chanOut <- statis
+	return nil
+}
+
+// fail reports a message which could not be sent at all, it is counted
+// as failed with reason like the failed requests.
+func (h *HttpHandler) fail(statis *Statistician, reason string, err error, chanOut *chan *Statistician) error {
+	statis.State = false
+	statis.Reason = reason
+	statis.Error = err.Error()
+	*chanOut <- statis
+	return err
+}
+
+// attemptResult is the outcome of a single request sent by HttpHandler.
+type attemptResult struct {
+	StatusCode int
+	Header     http.Header
+	Content    []byte
+	RawBytes   int64
+	WireBytes  int64
+	Wrote      bool // request is completely written to the server
+	Proto      string
+}
+
+// send posts body once and reads the whole response, the time spent
+// is added to statis.
+func (h *HttpHandler) send(url string, header http.Header, body []byte, cred Credential, statis *Statistician) (*attemptResult, error) {
+	result := &attemptResult{
+		RawBytes:  int64(len(body)),
+		WireBytes: int64(len(body)),
+	}
+	var reader io.Reader
+	var streamDone chan *streamResult
+	if h.Conf.HttpStreaming {
+		reader, streamDone = h.streamBody()
+	} else {
+		reader = bytes.NewReader(body)
+	}
+	request, p_err := http.NewRequest(h.Method, url, reader)
 	if p_err != nil {
 		log.Errorf("Packet http request with error, %v", p_err)
-		return p_err
+		return result, p_err
 	}
-	statis := NewStatistician(h.Topic)
+	var tlsStart time.Time
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			statis.ConnReused = info.Reused
+			statis.ConnOpened = !info.Reused
+		},
+		TLSHandshakeStart: func() {
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			statis.TlsTime += time.Since(tlsStart).Microseconds()
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			result.Wrote = info.Err == nil
+		},
+	}
+	ctx := httptrace.WithClientTrace(request.Context(), trace)
+	if h.Conf.HttpRequestTimeout > 0 {
+		// the response body is read before the deadline as well
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(h.Conf.HttpRequestTimeout)*time.Second)
+		defer cancel()
+	}
+	request = request.WithContext(ctx)
 	defer request.Body.Close()
-	if conf.DataFmt == "avro" {
-		request.Header.Add("Context-Type", "avro")
-		request.Header.Add("Content-Type", "application/avro")
-	} else {
-		request.Header.Add("Context-Type", "csv")
-		request.Header.Add("Content-Type", "text/csv")
+	request.Header = header.Clone()
+	if encoding := Codecs[h.Conf.HttpCompression]; encoding != "" {
+		request.Header.Add("Content-Encoding", encoding)
+	}
+	if h.Conf.HttpKeepAlive {
+		request.Header.Add("Connection", "keep-alive")
+	}
+	if a_err := h.Auth.Apply(request, body, cred); a_err != nil {
+		log.Errorf("Authenticate http request with error, %v", a_err)
+		return result, a_err
 	}
 
-	request.Header.Add("Connection", "keep-alive")
-	request.Header.Add("User", h.Conf.DpUser)
-	request.Header.Add("Password", h.Conf.DpPasswd)
-
-	request.Header.Add("Transfer-Encoding", "chunked")
+	// a streamed body has no length, net/http sends it chunked
 	startTime := time.Now()
 	response, s_err := h.Cli.Do(request)
+	statis.SentTime += time.Since(startTime).Milliseconds()
+	if streamDone != nil {
+		stream := <-streamDone
+		if stream.Err != nil && s_err == nil {
+			log.Errorf("Stream rows to http request with error, %v", stream.Err)
+		}
+		result.RawBytes = stream.RawBytes
+		result.WireBytes = stream.WireBytes
+		statis.CompressTime += stream.CompressTime
+	}
 	if s_err != nil {
-		log.Errorf("Sent http request with error, %v", s_err)
-		return s_err
+		return result, s_err
 	}
-	statis.SentTime = time.Since(startTime).Milliseconds()
-	msgBytes := int64(len(data.Bytes()))
-	h.Cli.CloseIdleConnections()
 	defer response.Body.Close()
 	content, err := ioutil.ReadAll(response.Body)
-	if response.StatusCode != http.StatusOK {
-		statis.State = false
-		if err != nil {
-			log.Errorln(err)
-		}
-		log.Errorf("Response code: %v, %s", response.StatusCode, string(content))
-	} else {
-		statis.State = true
-		statis.SentBytes = msgBytes
-		log.Debugf("Response code: %v, %s", response.StatusCode, string(content))
+	if err != nil {
+		log.Errorln(err)
 	}
-	*chanOut <- statis
-	return nil
+	result.StatusCode = response.StatusCode
+	result.Proto = response.Proto
+	result.Header = response.Header
+	result.Content = content
+	return result, nil
+}
+
+type streamResult struct {
+	RawBytes     int64
+	WireBytes    int64
+	CompressTime int64 // Microseconds spent in the encoder
+	Err          error
+}
+
+// countWriter counts the bytes written through it
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// timedEncoder compresses into a buffer and moves the output to w after
+// each call, the time spent in the encoder does not include writes to w
+// blocked by a slow server.
+type timedEncoder struct {
+	encoder io.WriteCloser
+	out     *bytes.Buffer
+	w       io.Writer
+	elapsed time.Duration
+}
+
+func newTimedEncoder(codec string, w io.Writer) (*timedEncoder, error) {
+	out := &bytes.Buffer{}
+	encoder, err := NewCompressWriter(codec, out)
+	if err != nil {
+		return nil, err
+	}
+	return &timedEncoder{encoder: encoder, out: out, w: w}, nil
+}
+
+func (t *timedEncoder) do(fn func() error) error {
+	start := time.Now()
+	err := fn()
+	t.elapsed += time.Since(start)
+	if err != nil {
+		return err
+	}
+	_, err = t.out.WriteTo(t.w)
+	return err
+}
+
+func (t *timedEncoder) Write(p []byte) (n int, err error) {
+	err = t.do(func() error {
+		n, err = t.encoder.Write(p)
+		return err
+	})
+	return n, err
+}
+
+func (t *timedEncoder) Flush() error {
+	return t.do(t.encoder.(flusher).Flush)
+}
+
+func (t *timedEncoder) Close() error {
+	return t.do(t.encoder.Close)
+}
+
+// streamBody generates the rows of one message into a pipe while the request
+// is in flight, chunks of http.chunksize bytes are handed to the transport.
+// The result is sent to the returned channel once the body is complete.
+func (h *HttpHandler) streamBody() (io.Reader, chan *streamResult) {
+	reader, pipe := io.Pipe()
+	done := make(chan *streamResult, 1)
+	go func() {
+		wire := &countWriter{w: pipe}
+		chunks := bufio.NewWriterSize(wire, h.Conf.HttpChunkSize)
+		raw := &countWriter{w: chunks}
+		flush := chunks.Flush
+		var encoder *timedEncoder
+		if h.Conf.HttpCompression != "none" {
+			var err error
+			encoder, err = newTimedEncoder(h.Conf.HttpCompression, chunks)
+			if err != nil {
+				pipe.CloseWithError(err)
+				done <- &streamResult{Err: err}
+				return
+			}
+			raw.w = encoder
+			flush = func() error {
+				if err := encoder.Flush(); err != nil {
+					return err
+				}
+				return chunks.Flush()
+			}
+		}
+		err := StreamRows(raw, h.Conf.DataFmt, h.Conf.MessageSize, h.Conf.HttpRowsPerFlush, flush)
+		result := &streamResult{}
+		if encoder != nil {
+			if c_err := encoder.Close(); err == nil {
+				err = c_err
+			}
+			if err == nil {
+				err = chunks.Flush()
+			}
+			result.CompressTime = encoder.elapsed.Microseconds()
+		}
+		pipe.CloseWithError(err)
+		result.RawBytes, result.WireBytes, result.Err = raw.n, wire.n, err
+		done <- result
+	}()
+	return reader, done
 }
 
 type KafkaHandler struct {
@@ -89,26 +423,55 @@ type KafkaHandler struct {
 	Conf    *Config
 }
 
-func NewKafkaHandler(topic string, conf *Config) *KafkaHandler {
+var (
+	kafkaLock    sync.Mutex
+	kafkaWriters = make(map[string]*kafka.Writer)
+)
+
+// SharedKafkaWriter returns the writer of topic, all workers of the kafka
+// sink write through it. Every message is sent as a batch of its own and
+// WriteMessages returns once the broker answered, so the error returned
+// belongs to the message.
+func SharedKafkaWriter(conf *Config, topic string) *kafka.Writer {
+	key := fmt.Sprintf("%d/%s", conf.MethodId, topic)
+	kafkaLock.Lock()
+	defer kafkaLock.Unlock()
+	if writer, ok := kafkaWriters[key]; ok {
+		return writer
+	}
+	var dialer *kafka.Dialer
+	if localAddr := LocalAddr(conf, "tcp"); localAddr != nil {
+		// the defaults of kafka.DefaultDialer with the next source address
+		dialer = &kafka.Dialer{
+			Timeout:   10 * time.Second,
+			DualStack: true,
+			LocalAddr: localAddr,
+		}
+	}
 	writer := kafka.NewWriter(kafka.WriterConfig{
 		Brokers:    conf.Brokers,
 		Topic:      topic,
+		Dialer:     dialer,
 		Balancer:   &kafka.RoundRobin{},
+		BatchSize:  1,
 		BatchBytes: 30 * 1024 * 1024,
-		Async:      true,
 	})
+	kafkaWriters[key] = writer
+	return writer
+}
+
+func NewKafkaHandler(topic string, conf *Config) *KafkaHandler {
 	handler := KafkaHandler{
 		Brokers: conf.Brokers,
 		Topic:   topic,
-		IsAsync: true,
-		Writer:  writer,
+		IsAsync: false,
+		Writer:  SharedKafkaWriter(conf, topic),
 		Conf:    conf,
 	}
 	return &handler
 }
 
 func (k *KafkaHandler) Do(conf *Config, data *bytes.Buffer, chanOut *chan *Statistician) {
-	defer k.Close()
 	dataBytes := data.Bytes()
 	msg := kafka.Message{
 		Key:   []byte("1"),
@@ -117,17 +480,32 @@ func (k *KafkaHandler) Do(conf *Config, data *bytes.Buffer, chanOut *chan *Stati
 	statis := NewStatistician(k.Topic)
 	startTime := time.Now()
 	err := k.Writer.WriteMessages(context.Background(), msg)
-	statis.SentTime = time.Since(startTime).Microseconds()
+	// the time is in Milliseconds like the other sinks
+	statis.SentTime = time.Since(startTime).Milliseconds()
 	if err != nil {
 		log.Errorf("Sent messgae to kafka with errr, %v", err)
 		statis.State = false
+		statis.Reason = ClassifyError(err)
+		statis.Error = err.Error()
 	} else {
 		statis.State = true
+		statis.Reason = "ok"
 		statis.SentBytes = int64(len(dataBytes))
+		statis.WireBytes = statis.SentBytes
 	}
 	*chanOut <- statis
 }
 
-func (k *KafkaHandler) Close() {
-	k.Writer.Close()
+// CloseKafkaWriter closes the writer of topic shared by the workers of the
+// kafka sink once they are done, the next SharedKafkaWriter opens a new one.
+func CloseKafkaWriter(conf *Config, topic string) error {
+	key := fmt.Sprintf("%d/%s", conf.MethodId, topic)
+	kafkaLock.Lock()
+	writer, ok := kafkaWriters[key]
+	delete(kafkaWriters, key)
+	kafkaLock.Unlock()
+	if !ok {
+		return nil
+	}
+	return writer.Close()
 }
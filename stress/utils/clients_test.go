@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// testConf loads a config file with the given sections, the defaults are
+// the ones of a real run.
+func testConf(t *testing.T, toml string) *Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "stress.toml")
+	if err := os.WriteFile(path, []byte(toml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return NewConfByFile(path)
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err    error
+		reason string
+	}{
+		{&SinkError{Reason: "redis_oom", Message: "OOM"}, "redis_oom"},
+		{fmt.Errorf("xadd: %w", &SinkError{Reason: "s3_nosuchbucket"}), "s3_nosuchbucket"},
+		{kafka.UnknownTopicOrPartition, "kafka_3_Unknown_Topic_Or_Partition"},
+		{kafka.WriteErrors{nil, kafka.RequestTimedOut}, "kafka_7_Request_Timed_Out"},
+		{&net.DNSError{Err: "no such host", Name: "sink"}, "dns"},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "refused"},
+		{&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, "reset"},
+		{os.NewSyscallError("write", syscall.EPIPE), "reset"},
+		{errors.New("remote error: tls: bad certificate"), "tls"},
+		{context.DeadlineExceeded, "timeout"},
+		{fmt.Errorf("read response: %w", io.ErrUnexpectedEOF), "eof"},
+		{errors.New("something else"), "other"},
+	}
+	for _, test := range tests {
+		if reason := ClassifyError(test.err); reason != test.reason {
+			t.Errorf("ClassifyError(%v) = %s, expect %s", test.err, reason, test.reason)
+		}
+	}
+}
+
+// TestHttpHandlerMockServer sends messages of the dataproxy sink to the
+// mock dataproxy.
+func TestHttpHandlerMockServer(t *testing.T) {
+	mockConf := &Config{DataFmt: "csv"}
+	mock := NewMockServer(mockConf)
+	server := httptest.NewServer(mock)
+	defer server.Close()
+
+	conf := testConf(t, fmt.Sprintf(`
+[required]
+eip=%q
+topics=["t1"]
+recordnum=10
+datafmt="csv"
+`, strings.TrimPrefix(server.URL, "http://")))
+	out := make(chan *Statistician, 1)
+	handler := NewHttpHandler("t1", conf)
+	for i := 0; i < 3; i++ {
+		data := Write2Csv(10)
+		size := int64(data.Len())
+		if err := handler.Do(conf, data, &out); err != nil {
+			t.Fatal(err)
+		}
+		statis := <-out
+		if !statis.State || statis.Reason != "http_200" || statis.SentBytes != size {
+			t.Fatalf("message %d: %+v", i, statis)
+		}
+	}
+	if counter := mock.snapshot()["t1"]; counter.Requests != 3 || counter.Rows != 30 {
+		t.Errorf("mock counted %+v", counter)
+	}
+
+	// rows the mock can not parse are rejected with 400
+	if err := handler.Do(conf, bytes.NewBufferString("not,a,row\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	if statis := <-out; statis.State || statis.Reason != "http_400" {
+		t.Errorf("bad message: %+v", statis)
+	}
+
+	mockConf.MockErrorRate = 1
+	mockConf.MockErrorStatus = []int{503}
+	if err := handler.Do(conf, Write2Csv(10), &out); err != nil {
+		t.Fatal(err)
+	}
+	if statis := <-out; statis.State || statis.Reason != "http_503" {
+		t.Errorf("injected error: %+v", statis)
+	}
+}
+
+// TestKafkaHandlerKafkaMock sends messages of the kafka sink to the mock
+// broker and reads them back with a kafka-go reader.
+func TestKafkaHandlerKafkaMock(t *testing.T) {
+	mock, addr := startKafkaMock(t)
+	conf := testConf(t, fmt.Sprintf(`
+[required]
+brokerips=[%q]
+topics=["t1"]
+recordnum=10
+datafmt="csv"
+[test]
+usemethod=2
+`, addr))
+	out := make(chan *Statistician, 1)
+	var sent [][]byte
+	for i := 0; i < 4; i++ {
+		data := Write2Csv(10)
+		sent = append(sent, append([]byte(nil), data.Bytes()...))
+		NewKafkaHandler("t1", conf).Do(conf, data, &out)
+		if statis := <-out; !statis.State || statis.Reason != "ok" {
+			t.Fatalf("message %d: %+v", i, statis)
+		}
+	}
+	mock.lock.Lock()
+	counter := *mock.counters["t1"]
+	mock.lock.Unlock()
+	if counter.Messages != 4 || counter.Rows != 40 || counter.Invalid != 0 {
+		t.Errorf("mock counted %+v", counter)
+	}
+
+	// the round robin balancer spreads the messages over both partitions
+	var received int
+	for partition := 0; partition < 2; partition++ {
+		reader := kafka.NewReader(kafka.ReaderConfig{Brokers: []string{addr}, Topic: "t1", Partition: partition, MaxWait: 100 * time.Millisecond})
+		for i := 0; i < 2; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			message, err := reader.ReadMessage(ctx)
+			cancel()
+			if err != nil {
+				t.Fatalf("read partition %d: %v", partition, err)
+			}
+			found := false
+			for _, value := range sent {
+				found = found || bytes.Equal(value, message.Value)
+			}
+			if !found {
+				t.Errorf("partition %d offset %d is not a sent message", partition, message.Offset)
+			}
+			received++
+		}
+		reader.Close()
+	}
+	if received != len(sent) {
+		t.Errorf("received %d messages, sent %d", received, len(sent))
+	}
+
+	writer := SharedKafkaWriter(conf, "t1")
+	if err := CloseKafkaWriter(conf, "t1"); err != nil {
+		t.Errorf("close writer: %v", err)
+	}
+	if SharedKafkaWriter(conf, "t1") == writer {
+		t.Error("closed writer is shared again")
+	}
+	CloseKafkaWriter(conf, "t1")
+}
+
+// TestHttpHandlerStreaming decodes the streamed body of the dataproxy sink
+// and counts its rows.
+func TestHttpHandlerStreaming(t *testing.T) {
+	type received struct {
+		chunked bool
+		wire    int
+		raw     int
+		rows    int
+		err     error
+	}
+	requests := make(chan received, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := received{chunked: r.ContentLength == -1 && len(r.TransferEncoding) == 1 && r.TransferEncoding[0] == "chunked"}
+		wire, _ := io.ReadAll(r.Body)
+		got.wire = len(wire)
+		var raw []byte
+		reader, err := NewDecompressReader(r.Header.Get("Content-Encoding"), bytes.NewReader(wire))
+		if err == nil {
+			raw, err = io.ReadAll(reader)
+		}
+		got.raw = len(raw)
+		if err == nil {
+			var rows [][]byte
+			rows, err = SplitRows(r.Header.Get("Context-Type"), raw)
+			got.rows = len(rows)
+		}
+		got.err = err
+		requests <- got
+	}))
+	defer server.Close()
+
+	for _, dataFmt := range []string{"csv", "avro"} {
+		for _, codec := range []string{"none", "gzip", "zstd"} {
+			conf := testConf(t, fmt.Sprintf(`
+[required]
+eip=%q
+topics=["t1"]
+recordnum=1000
+datafmt=%q
+[http]
+streaming=true
+chunksize=4096
+rowsperflush=100
+compression=%q
+`, strings.TrimPrefix(server.URL, "http://"), dataFmt, codec))
+			out := make(chan *Statistician, 1)
+			NewHttpHandler("t1", conf).Do(conf, &bytes.Buffer{}, &out)
+			statis := <-out
+			got := <-requests
+			if !statis.State || got.err != nil {
+				t.Fatalf("%s %s: %+v, %v", dataFmt, codec, statis, got.err)
+			}
+			if !got.chunked || got.rows != 1000 {
+				t.Errorf("%s %s: server got chunked %v, %d rows", dataFmt, codec, got.chunked, got.rows)
+			}
+			if statis.SentBytes != int64(got.raw) || statis.WireBytes != int64(got.wire) {
+				t.Errorf("%s %s: raw %d wire %d bytes, server got %d and %d", dataFmt, codec, statis.SentBytes, statis.WireBytes, got.raw, got.wire)
+			}
+			if codec != "none" && (statis.WireBytes >= statis.SentBytes || statis.CompressTime <= 0) {
+				t.Errorf("%s %s: raw %d wire %d bytes in %d us", dataFmt, codec, statis.SentBytes, statis.WireBytes, statis.CompressTime)
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Codecs supported by http.compression, value is the Content-Encoding sent
+var Codecs = map[string]string{
+	"none":   "",
+	"gzip":   "gzip",
+	"zstd":   "zstd",
+	"snappy": "x-snappy-framed",
+	"lz4":    "lz4",
+}
+
+var zstdEncoders = sync.Pool{
+	New: func() interface{} {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return enc
+	},
+}
+
+// flusher is implemented by all writers returned from NewCompressWriter
+type flusher interface {
+	Flush() error
+}
+
+type zstdWriter struct {
+	*zstd.Encoder
+}
+
+func (z *zstdWriter) Close() error {
+	err := z.Encoder.Close()
+	z.Encoder.Reset(nil)
+	zstdEncoders.Put(z.Encoder)
+	return err
+}
+
+// NewCompressWriter wraps w with the encoder of codec, data is flushed to w
+// once the returned writer is closed.
+func NewCompressWriter(codec string, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		enc := zstdEncoders.Get().(*zstd.Encoder)
+		enc.Reset(w)
+		return &zstdWriter{enc}, nil
+	case "snappy":
+		return snappy.NewBufferedWriter(w), nil
+	case "lz4":
+		writer := lz4.NewWriter(w)
+		if err := writer.Apply(lz4.ConcurrencyOption(1)); err != nil {
+			return nil, err
+		}
+		return writer, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %s", codec)
+	}
+}
+
+// Compress encodes data with codec and returns the encoded bytes.
+func Compress(codec string, data []byte) ([]byte, error) {
+	buffer := bytes.NewBuffer(make([]byte, 0, len(data)/2))
+	writer, err := NewCompressWriter(codec, buffer)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// NewDecompressReader wraps r with the decoder of a Content-Encoding sent
+// for one of Codecs, an empty encoding returns r itself.
+func NewDecompressReader(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case "":
+		return io.NopCloser(r), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case "x-snappy-framed":
+		return io.NopCloser(snappy.NewReader(r)), nil
+	case "lz4":
+		return io.NopCloser(lz4.NewReader(r)), nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %s", encoding)
+	}
+}
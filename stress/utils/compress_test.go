@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	data := Write2Csv(100).Bytes()
+	for codec, encoding := range Codecs {
+		if codec == "none" {
+			continue
+		}
+		encoded, err := Compress(codec, data)
+		if err != nil {
+			t.Fatalf("%s: %v", codec, err)
+		}
+		if len(encoded) >= len(data) {
+			t.Errorf("%s: %d bytes compressed to %d", codec, len(data), len(encoded))
+		}
+		reader, err := NewDecompressReader(encoding, bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("%s: %v", codec, err)
+		}
+		decoded, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil || !bytes.Equal(decoded, data) {
+			t.Errorf("%s: decoded %d bytes of %d, %v", codec, len(decoded), len(data), err)
+		}
+	}
+	if _, err := Compress("brotli", data); err == nil {
+		t.Error("unknown codec is accepted")
+	}
+	if _, err := NewDecompressReader("br", bytes.NewReader(nil)); err == nil {
+		t.Error("unknown encoding is accepted")
+	}
+}
+
+// TestHttpHandlerCompression checks the Content-Encoding and the body of
+// compressed requests and the raw and wire bytes reported.
+func TestHttpHandlerCompression(t *testing.T) {
+	var body []byte
+	var encoding string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		reader, err := NewDecompressReader(encoding, r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		body, _ = io.ReadAll(reader)
+	}))
+	defer server.Close()
+
+	for _, codec := range []string{"gzip", "zstd", "snappy", "lz4"} {
+		conf := testConf(t, fmt.Sprintf(`
+[required]
+eip=%q
+topics=["t1"]
+recordnum=50
+datafmt="csv"
+[http]
+compression=%q
+`, strings.TrimPrefix(server.URL, "http://"), codec))
+		out := make(chan *Statistician, 1)
+		data := Write2Csv(50)
+		raw := append([]byte(nil), data.Bytes()...)
+		NewHttpHandler("t1", conf).Do(conf, data, &out)
+		statis := <-out
+		if !statis.State {
+			t.Fatalf("%s: %+v", codec, statis)
+		}
+		if encoding != Codecs[codec] || !bytes.Equal(body, raw) {
+			t.Errorf("%s: server got Content-Encoding %q and %d bytes of %d", codec, encoding, len(body), len(raw))
+		}
+		if statis.SentBytes != int64(len(raw)) || statis.WireBytes >= statis.SentBytes || statis.WireBytes == 0 {
+			t.Errorf("%s: raw %d bytes, wire %d bytes", codec, statis.SentBytes, statis.WireBytes)
+		}
+	}
+}
@@ -1,10 +1,54 @@
 package utils
 
 import (
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+// sinks selected by test.usemethod
+const (
+	MethodDataproxy   = 1
+	MethodKafka       = 2
+	MethodIngest      = 3
+	MethodBulk        = 4
+	MethodClickHouse  = 5
+	MethodNats        = 6
+	MethodRedis       = 7
+	MethodMqtt        = 8
+	MethodTcp         = 9
+	MethodUdp         = 10
+	MethodSyslog      = 11
+	MethodS3          = 12
+	MethodRemoteWrite = 13
+	MethodOtlp        = 14
+	MethodWebSocket   = 15
+)
+
+// MethodNames names the sinks in the reports of test.usemethods.
+var MethodNames = map[int]string{
+	MethodDataproxy:   "dataproxy",
+	MethodKafka:       "kafka",
+	MethodIngest:      "ingest",
+	MethodBulk:        "bulk",
+	MethodClickHouse:  "clickhouse",
+	MethodNats:        "nats",
+	MethodRedis:       "redis",
+	MethodMqtt:        "mqtt",
+	MethodTcp:         "tcp",
+	MethodUdp:         "udp",
+	MethodSyslog:      "syslog",
+	MethodS3:          "s3",
+	MethodRemoteWrite: "remotewrite",
+	MethodOtlp:        "otlp",
+	MethodWebSocket:   "websocket",
+}
+
 type Config struct {
 	TotalMessageSize int
 	Topics           []string
@@ -15,12 +59,176 @@ type Config struct {
 	SchemaId         int
 	Brokers          []string
 	MethodId         int
+	MethodIds        []int // test.usemethods, sinks receiving the same messages
 	Eip              string
 	MessageNum       int
 	RunTimeout       float64
 	DpUser           string
 	DpPasswd         string
 	DataFmt          string
+	RunId            string
+
+	HttpMaxConnsPerHost     int
+	HttpMaxIdleConnsPerHost int
+	HttpIdleTimeout         int
+	HttpDialTimeout         int
+	HttpRequestTimeout      int
+	HttpKeepAlive           bool
+	HttpScheme              string
+	HttpCompression         string
+	HttpStreaming           bool
+	HttpChunkSize           int
+	HttpRowsPerFlush        int
+	HttpProtocol            string
+	HttpConnections         int
+	HttpStreamsPerConn      int
+	HttpUnixSocket          string
+	HttpLocalAddrs          []string
+	TlsCaFile               string
+	TlsCertFile             string
+	TlsKeyFile              string
+	TlsServerName           string
+	TlsMinVersion           string
+	TlsInsecureSkipVerify   bool
+
+	RetryMaxAttempts       int
+	RetryInitialBackoff    int
+	RetryMaxBackoff        int
+	RetryMultiplier        float64
+	RetryJitter            float64
+	RetryHonorRetryAfter   bool
+	RetryStatusCodes       []int
+	RetryNetworkErrors     []string
+	RetryIdempotencyHeader string
+
+	IngestUrl           string
+	IngestMethod        string
+	IngestHeaders       map[string]string
+	IngestSuccessStatus string
+
+	AuthMode      string
+	AuthUsers     []string
+	AuthToken     string
+	AuthTokenFile string
+
+	BulkUrl        string
+	BulkIndex      string
+	BulkAction     string
+	BulkIdStrategy string
+
+	ClickHouseUrl      string
+	ClickHouseDatabase string
+	ClickHouseTable    string
+	ClickHouseTables   map[string]string
+
+	NatsUrl         string
+	NatsSubject     string
+	NatsSubjects    map[string]string
+	NatsHeaders     map[string]string
+	NatsJetStream   bool
+	NatsConnections int
+	NatsMaxInflight int
+	NatsAckTimeout  int
+
+	RedisUrl         string
+	RedisStream      string
+	RedisStreams     map[string]string
+	RedisMode        string
+	RedisField       string
+	RedisMaxLen      int
+	RedisApproximate bool
+	RedisPipeline    int
+	RedisConnections int
+
+	MqttUrl         string
+	MqttVersion     string
+	MqttTopic       string
+	MqttTopics      map[string]string
+	MqttQos         int
+	MqttRetain      bool
+	MqttClientId    string
+	MqttKeepAlive   int
+	MqttConnections int
+	MqttMaxInflight int
+	MqttAckTimeout  int
+
+	SocketAddr        string
+	SocketFraming     string
+	SocketConnections int
+	SocketTls         bool
+	SocketTimeout     int
+	SyslogNetwork     string
+	SyslogFacility    int
+	SyslogSeverity    int
+	SyslogAppName     string
+	SyslogHostname    string
+
+	S3Endpoint  string
+	S3Bucket    string
+	S3Region    string
+	S3AccessKey string
+	S3SecretKey string
+	S3Key       string
+	S3PartSize  int
+	S3PathStyle bool
+
+	RemoteWriteUrl          string
+	RemoteWriteMetricPrefix string
+	RemoteWriteMetrics      []string
+	RemoteWriteLabels       []string
+
+	OtlpUrl         string
+	OtlpEncoding    string
+	OtlpBodyField   string
+	OtlpBatchSize   int
+	OtlpServiceName string
+
+	WebSocketUrl          string
+	WebSocketHeaders      map[string]string
+	WebSocketSubprotocol  string
+	WebSocketFrameType    string
+	WebSocketMaxFrameSize int
+	WebSocketConnections  int
+	WebSocketAckMode      string
+	WebSocketNackPattern  string
+	WebSocketMaxInflight  int
+	WebSocketAckTimeout   int
+	WebSocketMaxReadSize  int
+
+	DataproxyEndpoints      []string
+	DataproxyWeights        []int
+	DataproxyBalancer       string
+	DataproxyEjectFailures  int
+	DataproxyEjectTime      int
+	DataproxyHealthPath     string
+	DataproxyHealthInterval int
+	DataproxyHealthTimeout  int
+
+	MockListen        string
+	MockLatency       int
+	MockLatencyJitter int
+	MockErrorRate     float64
+	MockErrorStatus   []int
+	MockRetryAfter    int
+	MockStatsInterval int
+	MockCertFile      string
+	MockKeyFile       string
+
+	KafkaMockListen         string
+	KafkaMockAdvertisedHost string
+	KafkaMockAdvertisedPort int
+	KafkaMockPartitions     int
+	KafkaMockLatency        int
+	KafkaMockLatencyJitter  int
+	KafkaMockMaxBytes       int64
+	KafkaMockAutoCreate     bool
+	KafkaMockStatsInterval  int
+
+	ChaosListen        string
+	ChaosUpstream      string
+	ChaosLoop          bool
+	ChaosStatsInterval int
+	ChaosPhases        []ChaosPhase
 }
 
 func NewConfByFile(path string) *Config {
@@ -28,6 +236,93 @@ func NewConfByFile(path string) *Config {
 	if err := viper.ReadInConfig(); err != nil {
 		log.Fatalf("Read conf file %s with error %v", path, err)
 	}
+	viper.SetDefault("http.keepalive", true)
+	viper.SetDefault("http.idletimeout", 90)
+	viper.SetDefault("http.dialtimeout", 30)
+	viper.SetDefault("http.scheme", "http")
+	viper.SetDefault("http.compression", "none")
+	viper.SetDefault("http.chunksize", 32*1024)
+	viper.SetDefault("http.protocol", "http1")
+	viper.SetDefault("http.connections", 1)
+	viper.SetDefault("http.streamsperconn", 100)
+	viper.SetDefault("tls.minversion", "1.2")
+	viper.SetDefault("ingest.method", "POST")
+	viper.SetDefault("ingest.successstatus", "200-299")
+	viper.SetDefault("bulk.index", "{{.Topic}}")
+	viper.SetDefault("bulk.action", "index")
+	viper.SetDefault("bulk.idstrategy", "auto")
+	viper.SetDefault("clickhouse.table", "{{.Topic}}")
+	viper.SetDefault("nats.url", "nats://127.0.0.1:4222")
+	viper.SetDefault("nats.subject", "{{.Topic}}")
+	viper.SetDefault("nats.connections", 1)
+	viper.SetDefault("nats.maxinflight", 1024)
+	viper.SetDefault("nats.acktimeout", 5000)
+	viper.SetDefault("redis.url", "redis://127.0.0.1:6379/0")
+	viper.SetDefault("redis.stream", "{{.Topic}}")
+	viper.SetDefault("redis.mode", "message")
+	viper.SetDefault("redis.field", "data")
+	viper.SetDefault("redis.approximate", true)
+	viper.SetDefault("redis.pipeline", 100)
+	viper.SetDefault("redis.connections", 1)
+	viper.SetDefault("mqtt.url", "mqtt://127.0.0.1:1883")
+	viper.SetDefault("mqtt.version", "3.1.1")
+	viper.SetDefault("mqtt.topic", "{{.Topic}}")
+	viper.SetDefault("mqtt.qos", 1)
+	viper.SetDefault("mqtt.clientid", "stress")
+	viper.SetDefault("mqtt.keepalive", 60)
+	viper.SetDefault("mqtt.connections", 1)
+	viper.SetDefault("mqtt.maxinflight", 100)
+	viper.SetDefault("mqtt.acktimeout", 5000)
+	viper.SetDefault("socket.addr", "127.0.0.1:5140")
+	viper.SetDefault("socket.framing", "newline")
+	viper.SetDefault("socket.connections", 1)
+	viper.SetDefault("socket.timeout", 10)
+	viper.SetDefault("syslog.network", "udp")
+	viper.SetDefault("syslog.facility", 16)
+	viper.SetDefault("syslog.severity", 6)
+	viper.SetDefault("syslog.appname", "stress")
+	viper.SetDefault("s3.endpoint", "http://127.0.0.1:9000")
+	viper.SetDefault("s3.region", "us-east-1")
+	viper.SetDefault("s3.key", "{{.Topic}}/{{.Date}}/{{.RunId}}/{{.Seq}}."+viper.GetString("required.datafmt"))
+	viper.SetDefault("s3.partsize", 8*1024*1024)
+	viper.SetDefault("s3.pathstyle", true)
+	viper.SetDefault("remotewrite.metricprefix", "stress_")
+	viper.SetDefault("otlp.url", "http://127.0.0.1:4318/v1/logs")
+	viper.SetDefault("otlp.encoding", "protobuf")
+	viper.SetDefault("otlp.servicename", "stress")
+	viper.SetDefault("websocket.url", "ws://127.0.0.1:8080/ws")
+	viper.SetDefault("websocket.connections", 1)
+	viper.SetDefault("websocket.ackmode", "none")
+	viper.SetDefault("websocket.maxinflight", 100)
+	viper.SetDefault("websocket.acktimeout", 5000)
+	viper.SetDefault("websocket.maxreadsize", 4194304)
+	if viper.GetString("required.datafmt") == "avro" {
+		viper.SetDefault("websocket.frametype", "binary")
+	} else {
+		viper.SetDefault("websocket.frametype", "text")
+	}
+	viper.SetDefault("dataproxy.balancer", "roundrobin")
+	viper.SetDefault("dataproxy.ejectfailures", 5)
+	viper.SetDefault("dataproxy.ejecttime", 30000)
+	viper.SetDefault("dataproxy.healthinterval", 5000)
+	viper.SetDefault("dataproxy.healthtimeout", 2000)
+	viper.SetDefault("mock.listen", "127.0.0.1:8080")
+	viper.SetDefault("mock.errorstatus", []int{500})
+	viper.SetDefault("kafkamock.listen", "127.0.0.1:9094")
+	viper.SetDefault("kafkamock.partitions", 3)
+	viper.SetDefault("kafkamock.maxbytes", 256*1024*1024)
+	viper.SetDefault("kafkamock.autocreate", true)
+	viper.SetDefault("chaos.listen", "127.0.0.1:18080")
+	viper.SetDefault("chaos.upstream", "127.0.0.1:8080")
+	viper.SetDefault("chaos.loop", true)
+	viper.SetDefault("retry.maxattempts", 1)
+	viper.SetDefault("retry.initialbackoff", 100)
+	viper.SetDefault("retry.maxbackoff", 5000)
+	viper.SetDefault("retry.multiplier", 2)
+	viper.SetDefault("retry.jitter", 0.2)
+	viper.SetDefault("retry.honorretryafter", true)
+	viper.SetDefault("retry.statuscodes", []int{429, 502, 503, 504})
+	viper.SetDefault("retry.networkerrors", []string{"refused", "reset", "timeout", "eof"})
 	msgSize := viper.GetInt("required.recordnum") // RowNumPerFile
 	msgNum := viper.GetInt("required.sndnum")
 
@@ -42,16 +337,220 @@ func NewConfByFile(path string) *Config {
 		SchemaId:         viper.GetInt("required.schemaname"),
 		Brokers:          viper.GetStringSlice("required.brokerips"),
 		MethodId:         viper.GetInt("test.usemethod"),
+		MethodIds:        viper.GetIntSlice("test.usemethods"),
 		Eip:              viper.GetString("required.eip"),
 		TotalMessageSize: msgNum * msgSize,
 		DpUser:           viper.GetString("dpconf.user"),
 		DpPasswd:         viper.GetString("dpconf.pwd"),
 		DataFmt:          viper.GetString("required.datafmt"),
+		RunId:            time.Now().Format("20060102150405"),
+
+		HttpMaxConnsPerHost:     viper.GetInt("http.maxconnsperhost"),
+		HttpMaxIdleConnsPerHost: viper.GetInt("http.maxidleconnsperhost"),
+		HttpIdleTimeout:         viper.GetInt("http.idletimeout"),
+		HttpDialTimeout:         viper.GetInt("http.dialtimeout"),
+		HttpRequestTimeout:      viper.GetInt("http.requesttimeout"),
+		HttpKeepAlive:           viper.GetBool("http.keepalive"),
+		HttpScheme:              viper.GetString("http.scheme"),
+		HttpCompression:         viper.GetString("http.compression"),
+		HttpStreaming:           viper.GetBool("http.streaming"),
+		HttpChunkSize:           viper.GetInt("http.chunksize"),
+		HttpRowsPerFlush:        viper.GetInt("http.rowsperflush"),
+		HttpProtocol:            viper.GetString("http.protocol"),
+		HttpConnections:         viper.GetInt("http.connections"),
+		HttpStreamsPerConn:      viper.GetInt("http.streamsperconn"),
+		HttpUnixSocket:          viper.GetString("http.unixsocket"),
+		HttpLocalAddrs:          viper.GetStringSlice("http.local_addrs"),
+		TlsCaFile:               viper.GetString("tls.cafile"),
+		TlsCertFile:             viper.GetString("tls.certfile"),
+		TlsKeyFile:              viper.GetString("tls.keyfile"),
+		TlsServerName:           viper.GetString("tls.servername"),
+		TlsMinVersion:           viper.GetString("tls.minversion"),
+		TlsInsecureSkipVerify:   viper.GetBool("tls.insecureskipverify"),
+
+		RetryMaxAttempts:       viper.GetInt("retry.maxattempts"),
+		RetryInitialBackoff:    viper.GetInt("retry.initialbackoff"),
+		RetryMaxBackoff:        viper.GetInt("retry.maxbackoff"),
+		RetryMultiplier:        viper.GetFloat64("retry.multiplier"),
+		RetryJitter:            viper.GetFloat64("retry.jitter"),
+		RetryHonorRetryAfter:   viper.GetBool("retry.honorretryafter"),
+		RetryStatusCodes:       viper.GetIntSlice("retry.statuscodes"),
+		RetryNetworkErrors:     viper.GetStringSlice("retry.networkerrors"),
+		RetryIdempotencyHeader: viper.GetString("retry.idempotencyheader"),
+
+		IngestUrl:           viper.GetString("ingest.url"),
+		IngestMethod:        viper.GetString("ingest.method"),
+		IngestHeaders:       viper.GetStringMapString("ingest.headers"),
+		IngestSuccessStatus: viper.GetString("ingest.successstatus"),
+
+		AuthMode:      viper.GetString("auth.mode"),
+		AuthUsers:     viper.GetStringSlice("auth.users"),
+		AuthToken:     viper.GetString("auth.token"),
+		AuthTokenFile: viper.GetString("auth.tokenfile"),
+
+		BulkUrl:        viper.GetString("bulk.url"),
+		BulkIndex:      viper.GetString("bulk.index"),
+		BulkAction:     viper.GetString("bulk.action"),
+		BulkIdStrategy: viper.GetString("bulk.idstrategy"),
+
+		ClickHouseUrl:      viper.GetString("clickhouse.url"),
+		ClickHouseDatabase: viper.GetString("clickhouse.database"),
+		ClickHouseTable:    viper.GetString("clickhouse.table"),
+		ClickHouseTables:   viper.GetStringMapString("clickhouse.tables"),
+
+		NatsUrl:         viper.GetString("nats.url"),
+		NatsSubject:     viper.GetString("nats.subject"),
+		NatsSubjects:    viper.GetStringMapString("nats.subjects"),
+		NatsHeaders:     viper.GetStringMapString("nats.headers"),
+		NatsJetStream:   viper.GetBool("nats.jetstream"),
+		NatsConnections: viper.GetInt("nats.connections"),
+		NatsMaxInflight: viper.GetInt("nats.maxinflight"),
+		NatsAckTimeout:  viper.GetInt("nats.acktimeout"),
+
+		RedisUrl:         viper.GetString("redis.url"),
+		RedisStream:      viper.GetString("redis.stream"),
+		RedisStreams:     viper.GetStringMapString("redis.streams"),
+		RedisMode:        viper.GetString("redis.mode"),
+		RedisField:       viper.GetString("redis.field"),
+		RedisMaxLen:      viper.GetInt("redis.maxlen"),
+		RedisApproximate: viper.GetBool("redis.approximate"),
+		RedisPipeline:    viper.GetInt("redis.pipeline"),
+		RedisConnections: viper.GetInt("redis.connections"),
+
+		MqttUrl:         viper.GetString("mqtt.url"),
+		MqttVersion:     viper.GetString("mqtt.version"),
+		MqttTopic:       viper.GetString("mqtt.topic"),
+		MqttTopics:      viper.GetStringMapString("mqtt.topics"),
+		MqttQos:         viper.GetInt("mqtt.qos"),
+		MqttRetain:      viper.GetBool("mqtt.retain"),
+		MqttClientId:    viper.GetString("mqtt.clientid"),
+		MqttKeepAlive:   viper.GetInt("mqtt.keepalive"),
+		MqttConnections: viper.GetInt("mqtt.connections"),
+		MqttMaxInflight: viper.GetInt("mqtt.maxinflight"),
+		MqttAckTimeout:  viper.GetInt("mqtt.acktimeout"),
+
+		SocketAddr:        viper.GetString("socket.addr"),
+		SocketFraming:     viper.GetString("socket.framing"),
+		SocketConnections: viper.GetInt("socket.connections"),
+		SocketTls:         viper.GetBool("socket.tls"),
+		SocketTimeout:     viper.GetInt("socket.timeout"),
+		SyslogNetwork:     viper.GetString("syslog.network"),
+		SyslogFacility:    viper.GetInt("syslog.facility"),
+		SyslogSeverity:    viper.GetInt("syslog.severity"),
+		SyslogAppName:     viper.GetString("syslog.appname"),
+		SyslogHostname:    viper.GetString("syslog.hostname"),
+
+		S3Endpoint:  viper.GetString("s3.endpoint"),
+		S3Bucket:    viper.GetString("s3.bucket"),
+		S3Region:    viper.GetString("s3.region"),
+		S3AccessKey: viper.GetString("s3.accesskey"),
+		S3SecretKey: viper.GetString("s3.secretkey"),
+		S3Key:       viper.GetString("s3.key"),
+		S3PartSize:  viper.GetInt("s3.partsize"),
+		S3PathStyle: viper.GetBool("s3.pathstyle"),
+
+		RemoteWriteUrl:          viper.GetString("remotewrite.url"),
+		RemoteWriteMetricPrefix: viper.GetString("remotewrite.metricprefix"),
+		RemoteWriteMetrics:      viper.GetStringSlice("remotewrite.metrics"),
+		RemoteWriteLabels:       viper.GetStringSlice("remotewrite.labels"),
+
+		OtlpUrl:         viper.GetString("otlp.url"),
+		OtlpEncoding:    viper.GetString("otlp.encoding"),
+		OtlpBodyField:   viper.GetString("otlp.bodyfield"),
+		OtlpBatchSize:   viper.GetInt("otlp.batchsize"),
+		OtlpServiceName: viper.GetString("otlp.servicename"),
+
+		WebSocketUrl:          viper.GetString("websocket.url"),
+		WebSocketHeaders:      viper.GetStringMapString("websocket.headers"),
+		WebSocketSubprotocol:  viper.GetString("websocket.subprotocol"),
+		WebSocketFrameType:    viper.GetString("websocket.frametype"),
+		WebSocketMaxFrameSize: viper.GetInt("websocket.maxframesize"),
+		WebSocketConnections:  viper.GetInt("websocket.connections"),
+		WebSocketAckMode:      viper.GetString("websocket.ackmode"),
+		WebSocketNackPattern:  viper.GetString("websocket.nackpattern"),
+		WebSocketMaxInflight:  viper.GetInt("websocket.maxinflight"),
+		WebSocketAckTimeout:   viper.GetInt("websocket.acktimeout"),
+		WebSocketMaxReadSize:  viper.GetInt("websocket.maxreadsize"),
+
+		DataproxyEndpoints:      viper.GetStringSlice("dataproxy.endpoints"),
+		DataproxyWeights:        viper.GetIntSlice("dataproxy.weights"),
+		DataproxyBalancer:       viper.GetString("dataproxy.balancer"),
+		DataproxyEjectFailures:  viper.GetInt("dataproxy.ejectfailures"),
+		DataproxyEjectTime:      viper.GetInt("dataproxy.ejecttime"),
+		DataproxyHealthPath:     viper.GetString("dataproxy.healthpath"),
+		DataproxyHealthInterval: viper.GetInt("dataproxy.healthinterval"),
+		DataproxyHealthTimeout:  viper.GetInt("dataproxy.healthtimeout"),
+
+		MockListen:        viper.GetString("mock.listen"),
+		MockLatency:       viper.GetInt("mock.latency"),
+		MockLatencyJitter: viper.GetInt("mock.latencyjitter"),
+		MockErrorRate:     viper.GetFloat64("mock.errorrate"),
+		MockErrorStatus:   viper.GetIntSlice("mock.errorstatus"),
+		MockRetryAfter:    viper.GetInt("mock.retryafter"),
+		MockStatsInterval: viper.GetInt("mock.statsinterval"),
+		MockCertFile:      viper.GetString("mock.certfile"),
+		MockKeyFile:       viper.GetString("mock.keyfile"),
+
+		KafkaMockListen:         viper.GetString("kafkamock.listen"),
+		KafkaMockAdvertisedHost: viper.GetString("kafkamock.advertisedhost"),
+		KafkaMockAdvertisedPort: viper.GetInt("kafkamock.advertisedport"),
+		KafkaMockPartitions:     viper.GetInt("kafkamock.partitions"),
+		KafkaMockLatency:        viper.GetInt("kafkamock.latency"),
+		KafkaMockLatencyJitter:  viper.GetInt("kafkamock.latencyjitter"),
+		KafkaMockMaxBytes:       viper.GetInt64("kafkamock.maxbytes"),
+		KafkaMockAutoCreate:     viper.GetBool("kafkamock.autocreate"),
+		KafkaMockStatsInterval:  viper.GetInt("kafkamock.statsinterval"),
+
+		ChaosListen:        viper.GetString("chaos.listen"),
+		ChaosUpstream:      viper.GetString("chaos.upstream"),
+		ChaosLoop:          viper.GetBool("chaos.loop"),
+		ChaosStatsInterval: viper.GetInt("chaos.statsinterval"),
+	}
+	// [[chaos.phases]] is a list of tables
+	if err := viper.UnmarshalKey("chaos.phases", &config.ChaosPhases); err != nil {
+		log.Fatalf("Read chaos.phases with error %v", err)
+	}
+	// eip="unix:///path" sends the dataproxy requests to a unix socket
+	if strings.HasPrefix(config.Eip, "unix://") && config.HttpUnixSocket == "" {
+		config.HttpUnixSocket = strings.TrimPrefix(config.Eip, "unix://")
 	}
 	return config
 }
 
+// SinkConfs returns the config of each sink of test.usemethods, a copy
+// with MethodId set to the sink. Without usemethods it is the config itself.
+func (c *Config) SinkConfs() []*Config {
+	if len(c.MethodIds) == 0 {
+		return []*Config{c}
+	}
+	confs := make([]*Config, 0, len(c.MethodIds))
+	for _, method := range c.MethodIds {
+		sink := *c
+		sink.MethodId = method
+		sink.MethodIds = nil
+		confs = append(confs, &sink)
+	}
+	return confs
+}
+
 func (c *Config) Validate() {
+	if len(c.MethodIds) > 0 {
+		seen := make(map[int]bool)
+		for _, method := range c.MethodIds {
+			if _, ok := MethodNames[method]; !ok {
+				log.Fatalf("不支持的发送方式%v, 请选择1到15", method)
+			}
+			if seen[method] {
+				log.Fatalf("test.usemethods中的发送方式%v重复,请修改config", method)
+			}
+			seen[method] = true
+		}
+		// every sink is checked as if it was the only one
+		for _, sink := range c.SinkConfs() {
+			sink.Validate()
+		}
+		return
+	}
 
 	if len(c.Topics) < 1 {
 		log.Fatalln("缺少必填项：topic, 请修改config")
@@ -65,4 +564,396 @@ func (c *Config) Validate() {
 		default:
 		   log.Fatalf("不支持的数据格式%v, 请选择csv或avro", c.DataFmt)
 	}
+	if c.HttpMaxConnsPerHost < 0 || c.HttpMaxIdleConnsPerHost < 0 {
+		log.Fatalln("maxconnsperhost和maxidleconnsperhost不能小于0,请修改config")
+	}
+	switch c.HttpScheme {
+	case "http":
+	case "https":
+	default:
+		log.Fatalf("不支持的协议%v, 请选择http或https", c.HttpScheme)
+	}
+	switch c.HttpProtocol {
+	case "http1":
+	case "h2":
+		if c.HttpScheme != "https" {
+			log.Fatalln("h2需要scheme=https,明文http/2请使用h2c,请修改config")
+		}
+	case "h2c":
+		if c.HttpScheme != "http" {
+			log.Fatalln("h2c需要scheme=http,请修改config")
+		}
+	default:
+		log.Fatalf("不支持的http协议%v, 请选择http1, h2或h2c", c.HttpProtocol)
+	}
+	for _, addr := range c.HttpLocalAddrs {
+		if net.ParseIP(addr) == nil {
+			log.Fatalf("http.local_addrs中的地址%v格式错误, 请使用ip地址", addr)
+		}
+	}
+	if c.HttpConnections < 1 || c.HttpStreamsPerConn < 1 {
+		log.Fatalln("connections和streamsperconn必须大于0,请修改config")
+	}
+	if _, ok := Codecs[c.HttpCompression]; !ok {
+		log.Fatalf("不支持的压缩方式%v, 请选择none, gzip, zstd, snappy或lz4", c.HttpCompression)
+	}
+	if c.HttpStreaming && c.MethodId != MethodDataproxy && c.MethodId != MethodIngest {
+		log.Fatalln("streaming仅支持usemethod=1或3,请修改config")
+	}
+	if c.MethodId == MethodIngest {
+		if c.IngestUrl == "" {
+			log.Fatalln("缺少必填项：ingest.url, 请修改config")
+		}
+		if _, _, err := parseTemplates(c); err != nil {
+			log.Fatalf("ingest.url或ingest.headers模板错误%v, 请修改config", err)
+		}
+		if _, err := ParseStatusSet(c.IngestSuccessStatus); err != nil {
+			log.Fatalf("ingest.successstatus格式错误%v, 请修改config", err)
+		}
+	}
+	if c.MethodId == MethodBulk {
+		if c.BulkUrl == "" {
+			log.Fatalln("缺少必填项：bulk.url, 请修改config")
+		}
+		if _, err := parseBulkIndex(c); err != nil {
+			log.Fatalf("bulk.index模板错误%v, 请修改config", err)
+		}
+		switch c.BulkAction {
+		case "index", "create":
+		default:
+			log.Fatalf("不支持的bulk操作%v, 请选择index或create", c.BulkAction)
+		}
+		switch c.BulkIdStrategy {
+		case "auto", "flowid", "seq", "hash":
+		default:
+			log.Fatalf("不支持的文档id策略%v, 请选择auto, flowid, seq或hash", c.BulkIdStrategy)
+		}
+	}
+	if c.MethodId == MethodClickHouse {
+		if c.ClickHouseUrl == "" {
+			log.Fatalln("缺少必填项：clickhouse.url, 请修改config")
+		}
+		if _, err := parseClickHouseTable(c); err != nil {
+			log.Fatalf("clickhouse.table模板错误%v, 请修改config", err)
+		}
+		if c.HttpCompression == "snappy" {
+			log.Fatalln("ClickHouse不支持snappy压缩,请修改config")
+		}
+	}
+	if c.MethodId == MethodNats {
+		u, err := url.Parse(c.NatsUrl)
+		if err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Host == "" {
+			log.Fatalf("nats.url格式错误%v, 请使用nats://host:port或tls://host:port", c.NatsUrl)
+		}
+		if _, err := parseNatsSubject(c); err != nil {
+			log.Fatalf("nats.subject模板错误%v, 请修改config", err)
+		}
+		if _, err := natsHeader(c, &TemplateVars{}); err != nil {
+			log.Fatalf("nats.headers模板错误%v, 请修改config", err)
+		}
+		if c.NatsConnections < 1 || c.NatsMaxInflight < 1 || c.NatsAckTimeout < 1 {
+			log.Fatalln("nats.connections, maxinflight和acktimeout必须大于0,请修改config")
+		}
+	}
+	if c.MethodId == MethodRedis {
+		u, err := url.Parse(c.RedisUrl)
+		if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+			log.Fatalf("redis.url格式错误%v, 请使用redis://host:port/db或rediss://host:port/db", c.RedisUrl)
+		}
+		if _, err := parseRedisStream(c); err != nil {
+			log.Fatalf("redis.stream模板错误%v, 请修改config", err)
+		}
+		switch c.RedisMode {
+		case "message", "row":
+		default:
+			log.Fatalf("不支持的redis写入模式%v, 请选择message或row", c.RedisMode)
+		}
+		if c.RedisMaxLen < 0 {
+			log.Fatalln("redis.maxlen不能小于0,请修改config")
+		}
+		if c.RedisPipeline < 1 || c.RedisConnections < 1 {
+			log.Fatalln("redis.pipeline和connections必须大于0,请修改config")
+		}
+	}
+	if c.MethodId == MethodMqtt {
+		u, err := url.Parse(c.MqttUrl)
+		if err != nil || (u.Scheme != "mqtt" && u.Scheme != "mqtts") || u.Host == "" {
+			log.Fatalf("mqtt.url格式错误%v, 请使用mqtt://host:port或mqtts://host:port", c.MqttUrl)
+		}
+		if c.MqttVersion != "3.1.1" && c.MqttVersion != "5" {
+			log.Fatalf("不支持的mqtt版本%v, 请选择3.1.1或5", c.MqttVersion)
+		}
+		if _, err := parseMqttTopic(c); err != nil {
+			log.Fatalf("mqtt.topic模板错误%v, 请修改config", err)
+		}
+		if c.MqttQos < 0 || c.MqttQos > 2 {
+			log.Fatalf("不支持的qos%v, 请选择0, 1或2", c.MqttQos)
+		}
+		if c.MqttKeepAlive < 0 || c.MqttKeepAlive > 65535 {
+			log.Fatalln("mqtt.keepalive必须在0到65535之间,请修改config")
+		}
+		if c.MqttConnections < 1 || c.MqttMaxInflight < 1 || c.MqttAckTimeout < 1 {
+			log.Fatalln("mqtt.connections, maxinflight和acktimeout必须大于0,请修改config")
+		}
+		if c.MqttMaxInflight > 65535 {
+			log.Fatalln("mqtt.maxinflight不能大于65535,请修改config")
+		}
+	}
+	if c.MethodId == MethodTcp || c.MethodId == MethodUdp || c.MethodId == MethodSyslog {
+		if _, _, err := net.SplitHostPort(c.SocketAddr); err != nil {
+			log.Fatalf("socket.addr格式错误%v, 请使用host:port", c.SocketAddr)
+		}
+		switch c.SocketFraming {
+		case "newline", "length", "octet":
+		default:
+			log.Fatalf("不支持的分帧方式%v, 请选择newline, length或octet", c.SocketFraming)
+		}
+		if c.SocketConnections < 1 {
+			log.Fatalln("socket.connections必须大于0,请修改config")
+		}
+		if c.SocketTimeout < 1 {
+			log.Fatalln("socket.timeout必须大于0,请修改config")
+		}
+		if c.SocketFraming == "newline" && c.DataFmt == "avro" && c.MethodId != MethodUdp {
+			log.Fatalln("avro数据不能使用newline分帧,请使用length或octet")
+		}
+	}
+	if c.MethodId == MethodSyslog {
+		if c.DataFmt != "csv" {
+			log.Fatalln("syslog仅支持datafmt=csv,请修改config")
+		}
+		if c.SyslogNetwork != "udp" && c.SyslogNetwork != "tcp" {
+			log.Fatalf("不支持的syslog传输方式%v, 请选择udp或tcp", c.SyslogNetwork)
+		}
+		if c.SyslogFacility < 0 || c.SyslogFacility > 23 || c.SyslogSeverity < 0 || c.SyslogSeverity > 7 {
+			log.Fatalln("syslog.facility必须在0到23之间,severity必须在0到7之间,请修改config")
+		}
+	}
+	if c.SocketTls && (c.MethodId == MethodUdp || (c.MethodId == MethodSyslog && c.SyslogNetwork == "udp")) {
+		log.Fatalln("udp不支持tls,请修改config")
+	}
+	if c.MethodId == MethodS3 {
+		u, err := url.Parse(c.S3Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			log.Fatalf("s3.endpoint格式错误%v, 请使用http://host:port或https://host:port", c.S3Endpoint)
+		}
+		if c.S3Bucket == "" {
+			log.Fatalln("缺少必填项：s3.bucket, 请修改config")
+		}
+		if accessKey, secretKey := S3Credentials(c); accessKey == "" || secretKey == "" {
+			log.Fatalln("缺少必填项：s3.accesskey和s3.secretkey, 请修改config或设置AWS_ACCESS_KEY_ID和AWS_SECRET_ACCESS_KEY")
+		}
+		if _, err := parseS3Key(c); err != nil {
+			log.Fatalf("s3.key模板错误%v, 请修改config", err)
+		}
+		if c.S3PartSize < s3MinPartSize {
+			log.Fatalf("s3.partsize不能小于%d(5 MiB),请修改config", s3MinPartSize)
+		}
+	}
+	if c.MethodId == MethodRemoteWrite {
+		if c.RemoteWriteUrl == "" {
+			log.Fatalln("缺少必填项：remotewrite.url, 请修改config")
+		}
+		if _, _, err := RemoteWriteColumns(c); err != nil {
+			log.Fatalf("remotewrite.metrics或remotewrite.labels错误%v, 请修改config", err)
+		}
+		if c.HttpCompression != "none" {
+			log.Fatalln("remote_write固定使用snappy压缩,http.compression必须为none,请修改config")
+		}
+	}
+	if c.MethodId == MethodOtlp {
+		if c.OtlpUrl == "" {
+			log.Fatalln("缺少必填项：otlp.url, 请修改config")
+		}
+		if c.OtlpEncoding != "protobuf" && c.OtlpEncoding != "json" {
+			log.Fatalf("不支持的otlp编码%v, 请选择protobuf或json", c.OtlpEncoding)
+		}
+		if err := OtlpBodyField(c); err != nil {
+			log.Fatalf("otlp.bodyfield错误%v, 请修改config", err)
+		}
+		if c.OtlpBatchSize < 0 {
+			log.Fatalln("otlp.batchsize不能小于0,请修改config")
+		}
+	}
+	if c.MethodId == MethodWebSocket {
+		u, err := url.Parse(c.WebSocketUrl)
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			log.Fatalf("websocket.url格式错误%v, 请使用ws://host:port/path或wss://host:port/path", c.WebSocketUrl)
+		}
+		if _, err := parseWebSocketUrl(c); err != nil {
+			log.Fatalf("websocket.url模板错误%v, 请修改config", err)
+		}
+		switch c.WebSocketFrameType {
+		case "binary":
+		case "text":
+			if c.DataFmt == "avro" {
+				log.Fatalln("avro数据不能使用text帧,请使用binary")
+			}
+		default:
+			log.Fatalf("不支持的帧类型%v, 请选择text或binary", c.WebSocketFrameType)
+		}
+		if c.WebSocketAckMode != "none" && c.WebSocketAckMode != "echo" {
+			log.Fatalf("不支持的ack方式%v, 请选择none或echo", c.WebSocketAckMode)
+		}
+		if _, err := regexp.Compile(c.WebSocketNackPattern); err != nil {
+			log.Fatalf("websocket.nackpattern错误%v, 请修改config", err)
+		}
+		if c.WebSocketMaxFrameSize < 0 {
+			log.Fatalln("websocket.maxframesize不能小于0,请修改config")
+		}
+		if c.WebSocketConnections < 1 || c.WebSocketMaxInflight < 1 || c.WebSocketAckTimeout < 1 || c.WebSocketMaxReadSize < 1 {
+			log.Fatalln("websocket.connections, maxinflight, acktimeout和maxreadsize必须大于0,请修改config")
+		}
+	}
+	if len(c.DataproxyEndpoints) > 0 {
+		if c.HttpUnixSocket != "" {
+			log.Fatalln("dataproxy.endpoints不能与unix socket同时使用,请修改config")
+		}
+		if len(c.DataproxyWeights) > 0 && len(c.DataproxyWeights) != len(c.DataproxyEndpoints) {
+			log.Fatalln("dataproxy.weights的个数必须与endpoints相同,请修改config")
+		}
+		for _, weight := range c.DataproxyWeights {
+			if weight < 1 {
+				log.Fatalln("dataproxy.weights必须大于0,请修改config")
+			}
+		}
+		switch c.DataproxyBalancer {
+		case "roundrobin":
+		case "leastinflight":
+		case "weighted":
+		default:
+			log.Fatalf("不支持的负载均衡方式%v, 请选择roundrobin, leastinflight或weighted", c.DataproxyBalancer)
+		}
+		if c.DataproxyEjectFailures < 0 {
+			log.Fatalln("dataproxy.ejectfailures不能小于0,请修改config")
+		}
+		if c.DataproxyEjectTime < 1 || c.DataproxyHealthInterval < 1 || c.DataproxyHealthTimeout < 1 {
+			log.Fatalln("dataproxy.ejecttime, healthinterval和healthtimeout必须大于0,请修改config")
+		}
+		if c.DataproxyHealthPath != "" && !strings.HasPrefix(c.DataproxyHealthPath, "/") {
+			log.Fatalln("dataproxy.healthpath必须以/开头,请修改config")
+		}
+	}
+	if c.HttpChunkSize < 1 {
+		log.Fatalln("chunksize必须大于0,请修改config")
+	}
+	if c.RetryMaxAttempts < 1 {
+		log.Fatalln("retry.maxattempts不能小于1,请修改config")
+	}
+	if c.RetryJitter < 0 || c.RetryJitter > 1 {
+		log.Fatalln("retry.jitter必须在0到1之间,请修改config")
+	}
+	for _, kind := range c.RetryNetworkErrors {
+		switch kind {
+		case "dns", "refused", "tls", "reset", "timeout", "eof", "other", "all":
+		default:
+			log.Fatalf("不支持的网络错误类型%v, 请选择dns, refused, tls, reset, timeout, eof, other或all", kind)
+		}
+	}
+	switch c.AuthMode {
+	case "", "none", "header", "basic":
+	case "bearer":
+		if c.AuthToken == "" && c.AuthTokenFile == "" {
+			log.Fatalln("bearer认证需要设置token或tokenfile,请修改config")
+		}
+	case "hmac":
+		if c.HttpStreaming {
+			log.Fatalln("hmac签名需要完整的请求体,不支持streaming,请修改config")
+		}
+	default:
+		log.Fatalf("不支持的认证方式%v, 请选择none, header, basic, bearer或hmac", c.AuthMode)
+	}
+	if _, err := ParseCredentials(c.AuthUsers); err != nil {
+		log.Fatalf("auth.users格式错误%v, 请修改config", err)
+	}
+	if (c.TlsCertFile == "") != (c.TlsKeyFile == "") {
+		log.Fatalln("certfile和keyfile必须同时设置,请修改config")
+	}
+	if _, ok := tlsVersions[c.TlsMinVersion]; !ok {
+		log.Fatalf("不支持的TLS版本%v, 请选择1.0, 1.1, 1.2或1.3", c.TlsMinVersion)
+	}
+	if _, err := loadTlsConfig(c); err != nil {
+		log.Fatalf("tls证书错误%v, 请修改config", err)
+	}
+}
+
+// ValidateMock checks the [mock] section used by the serve-mock command.
+func (c *Config) ValidateMock() {
+	if c.MockListen == "" {
+		log.Fatalln("缺少必填项：mock.listen, 请修改config")
+	}
+	if c.MockLatency < 0 || c.MockLatencyJitter < 0 || c.MockRetryAfter < 0 || c.MockStatsInterval < 0 {
+		log.Fatalln("mock.latency, latencyjitter, retryafter和statsinterval不能小于0,请修改config")
+	}
+	if c.MockErrorRate < 0 || c.MockErrorRate > 1 {
+		log.Fatalln("mock.errorrate必须在0到1之间,请修改config")
+	}
+	if c.MockErrorRate > 0 && len(c.MockErrorStatus) == 0 {
+		log.Fatalln("mock.errorrate大于0时需要设置errorstatus,请修改config")
+	}
+	for _, code := range c.MockErrorStatus {
+		if code < 400 || code > 599 {
+			log.Fatalf("mock.errorstatus中的响应码%v必须在400到599之间,请修改config", code)
+		}
+	}
+	if (c.MockCertFile == "") != (c.MockKeyFile == "") {
+		log.Fatalln("mock.certfile和keyfile必须同时设置,请修改config")
+	}
+}
+
+// ValidateKafkaMock checks the [kafkamock] section used by the serve-kafka command.
+func (c *Config) ValidateKafkaMock() {
+	if c.KafkaMockListen == "" {
+		log.Fatalln("缺少必填项：kafkamock.listen, 请修改config")
+	}
+	if c.KafkaMockPartitions < 1 || c.KafkaMockMaxBytes < 1 {
+		log.Fatalln("kafkamock.partitions和maxbytes必须大于0,请修改config")
+	}
+	if c.KafkaMockLatency < 0 || c.KafkaMockLatencyJitter < 0 || c.KafkaMockStatsInterval < 0 {
+		log.Fatalln("kafkamock.latency, latencyjitter和statsinterval不能小于0,请修改config")
+	}
+	if c.KafkaMockAdvertisedPort < 0 || c.KafkaMockAdvertisedPort > 65535 {
+		log.Fatalf("kafkamock.advertisedport %v必须在0到65535之间,请修改config", c.KafkaMockAdvertisedPort)
+	}
+	switch c.DataFmt {
+	case "csv", "avro":
+	default:
+		log.Fatalf("不支持的数据格式%v, 请选择csv或avro", c.DataFmt)
+	}
+}
+
+// ValidateChaos checks the [chaos] section used by the chaos-proxy command.
+func (c *Config) ValidateChaos() {
+	if c.ChaosListen == "" || c.ChaosUpstream == "" {
+		log.Fatalln("缺少必填项：chaos.listen和upstream, 请修改config")
+	}
+	if len(c.ChaosPhases) == 0 {
+		log.Fatalln("缺少必填项：chaos.phases, 请修改config")
+	}
+	if c.ChaosStatsInterval < 0 {
+		log.Fatalln("chaos.statsinterval不能小于0,请修改config")
+	}
+	for i, phase := range c.ChaosPhases {
+		// without loop the last phase lasts until exit
+		if phase.Duration < 1 && (c.ChaosLoop || i < len(c.ChaosPhases)-1) {
+			log.Fatalf("chaos.phases第%d个阶段的duration必须大于0,请修改config", i)
+		}
+		switch phase.Fault {
+		case "none", "hang", "blackhole":
+		case "latency":
+			if phase.Latency < 0 || phase.Jitter < 0 || phase.Latency+phase.Jitter < 1 {
+				log.Fatalf("chaos.phases第%d个阶段的latency和jitter不能小于0且至少一个大于0,请修改config", i)
+			}
+		case "bandwidth":
+			if phase.Rate < 1 {
+				log.Fatalf("chaos.phases第%d个阶段的rate必须大于0,请修改config", i)
+			}
+		case "reset":
+			if phase.Probability <= 0 || phase.Probability > 1 {
+				log.Fatalf("chaos.phases第%d个阶段的probability必须大于0且不大于1,请修改config", i)
+			}
+		default:
+			log.Fatalf("不支持的故障类型%v, 请选择none,latency,bandwidth,reset,hang或blackhole", phase.Fault)
+		}
+	}
 }
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// validateFatal runs conf.Validate and returns the message it exits with,
+// empty if conf is valid.
+func validateFatal(t *testing.T, conf *Config) (message string) {
+	t.Helper()
+	logger := log.StandardLogger()
+	out, exit := logger.Out, logger.ExitFunc
+	buffer := &bytes.Buffer{}
+	logger.SetOutput(buffer)
+	logger.ExitFunc = func(int) { panic(buffer) }
+	defer func() {
+		logger.SetOutput(out)
+		logger.ExitFunc = exit
+		if r := recover(); r != nil {
+			if r != buffer {
+				panic(r)
+			}
+			message = buffer.String()
+		}
+	}()
+	conf.Validate()
+	return ""
+}
+
+const sinksToml = `
+[required]
+eip="127.0.0.1:8080"
+brokerips=["127.0.0.1:9092"]
+topics=["t1"]
+datafmt="csv"
+[test]
+`
+
+func TestSinkConfs(t *testing.T) {
+	conf := testConf(t, sinksToml+"usemethods=[1,2]\n")
+	sinks := conf.SinkConfs()
+	if len(sinks) != 2 || sinks[0].MethodId != MethodDataproxy || sinks[1].MethodId != MethodKafka {
+		t.Fatalf("sinks %+v", sinks)
+	}
+	for _, sink := range sinks {
+		if sink == conf || sink.MethodIds != nil || sink.Eip != conf.Eip {
+			t.Errorf("sink %d is not a copy of the config", sink.MethodId)
+		}
+	}
+	sinks[0].Eip = "127.0.0.1:9090"
+	if conf.Eip != "127.0.0.1:8080" || sinks[1].Eip != "127.0.0.1:8080" {
+		t.Error("sinks share the config")
+	}
+
+	single := testConf(t, sinksToml+"usemethod=2\n")
+	if sinks := single.SinkConfs(); len(sinks) != 1 || sinks[0] != single {
+		t.Errorf("config without usemethods has sinks %+v", sinks)
+	}
+}
+
+func TestValidateUsemethods(t *testing.T) {
+	tests := []struct {
+		methods string
+		fatal   string
+	}{
+		{"[1,2]", ""},
+		{"[1,2,1]", "test.usemethods中的发送方式1重复"},
+		{"[1,16]", "不支持的发送方式16"},
+		{"[0]", "不支持的发送方式0"},
+	}
+	for _, test := range tests {
+		message := validateFatal(t, testConf(t, sinksToml+"usemethods="+test.methods+"\n"))
+		if test.fatal == "" && message != "" || !strings.Contains(message, test.fatal) {
+			t.Errorf("usemethods=%s exits with %q, expect %q", test.methods, message, test.fatal)
+		}
+	}
+}
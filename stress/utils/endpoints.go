@@ -0,0 +1,225 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	endpointLock sync.Mutex
+	endpointPool *EndpointPool
+)
+
+// Endpoint is a dataproxy node of dataproxy.endpoints.
+type Endpoint struct {
+	Addr     string
+	Base     string // scheme and host the request path is appended to
+	Weight   int
+	inflight int
+	// consecutive failed requests and the end of the passive ejection
+	failures   int
+	ejectUntil time.Time
+	// the last active health check failed
+	unhealthy bool
+	// state of the smooth weighted round robin
+	current       int
+	Ejections     int64
+	ProbeFailures int64
+}
+
+// available tells if requests are sent to the endpoint.
+func (e *Endpoint) available(now time.Time) bool {
+	return !e.unhealthy && !now.Before(e.ejectUntil)
+}
+
+// EndpointPool balances the dataproxy requests over dataproxy.endpoints,
+// endpoints are ejected after consecutive failures or failed health checks.
+type EndpointPool struct {
+	Conf      *Config
+	Endpoints []*Endpoint
+	lock      sync.Mutex
+	next      int
+}
+
+// SharedEndpointPool returns the pool of dataproxy.endpoints shared by
+// all workers of the dataproxy sink, nil if no endpoints are configured.
+// The first health check is done before the pool is used.
+func SharedEndpointPool(conf *Config) *EndpointPool {
+	if len(conf.DataproxyEndpoints) == 0 {
+		return nil
+	}
+	endpointLock.Lock()
+	defer endpointLock.Unlock()
+	if endpointPool == nil {
+		endpointPool = NewEndpointPool(conf)
+		if conf.DataproxyHealthPath != "" {
+			cli := &http.Client{
+				Transport: NewHttpTransport(conf, ""),
+				Timeout:   time.Duration(conf.DataproxyHealthTimeout) * time.Millisecond,
+			}
+			endpointPool.probe(cli)
+			go endpointPool.healthCheck(cli)
+		}
+	}
+	return endpointPool
+}
+
+func NewEndpointPool(conf *Config) *EndpointPool {
+	pool := &EndpointPool{Conf: conf}
+	for i, addr := range conf.DataproxyEndpoints {
+		weight := 1
+		if i < len(conf.DataproxyWeights) {
+			weight = conf.DataproxyWeights[i]
+		}
+		pool.Endpoints = append(pool.Endpoints, &Endpoint{
+			Addr:   addr,
+			Base:   fmt.Sprintf("%s://%s", conf.HttpScheme, addr),
+			Weight: weight,
+		})
+	}
+	return pool
+}
+
+// Acquire picks the endpoint of the next request with dataproxy.balancer,
+// the request counts as inflight until Release. All endpoints are used
+// when none is available, failing requests are better than no load.
+func (p *EndpointPool) Acquire() *Endpoint {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	candidates := make([]*Endpoint, 0, len(p.Endpoints))
+	for _, endpoint := range p.Endpoints {
+		if endpoint.available(now) {
+			candidates = append(candidates, endpoint)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.Endpoints
+	}
+	var picked *Endpoint
+	switch p.Conf.DataproxyBalancer {
+	case "leastinflight":
+		// ties are broken round robin, otherwise the first endpoint
+		// gets all requests of an idle pool
+		start := p.next
+		p.next++
+		for i := range candidates {
+			endpoint := candidates[(start+i)%len(candidates)]
+			if picked == nil || endpoint.inflight < picked.inflight {
+				picked = endpoint
+			}
+		}
+	case "weighted":
+		// smooth weighted round robin, the weights spread evenly
+		total := 0
+		for _, endpoint := range candidates {
+			endpoint.current += endpoint.Weight
+			total += endpoint.Weight
+			if picked == nil || endpoint.current > picked.current {
+				picked = endpoint
+			}
+		}
+		picked.current -= total
+	default:
+		picked = candidates[p.next%len(candidates)]
+		p.next++
+	}
+	picked.inflight += 1
+	return picked
+}
+
+// Release ends a request of endpoint, failed requests in a row eject the
+// endpoint for dataproxy.ejecttime.
+func (p *EndpointPool) Release(endpoint *Endpoint, failed bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	endpoint.inflight -= 1
+	if !failed {
+		endpoint.failures = 0
+		return
+	}
+	endpoint.failures += 1
+	if p.Conf.DataproxyEjectFailures > 0 && endpoint.failures >= p.Conf.DataproxyEjectFailures {
+		endpoint.failures = 0
+		endpoint.ejectUntil = time.Now().Add(time.Duration(p.Conf.DataproxyEjectTime) * time.Millisecond)
+		endpoint.Ejections += 1
+		log.Warnf("Eject endpoint %s for %d ms after %d failed requests", endpoint.Addr, p.Conf.DataproxyEjectTime, p.Conf.DataproxyEjectFailures)
+	}
+}
+
+// healthCheck probes every endpoint each dataproxy.healthinterval, an
+// endpoint answering dataproxy.healthpath with other than 2xx gets no
+// requests until a probe succeeds again.
+func (p *EndpointPool) healthCheck(cli *http.Client) {
+	ticker := time.NewTicker(time.Duration(p.Conf.DataproxyHealthInterval) * time.Millisecond)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.probe(cli)
+	}
+}
+
+// probe checks the health of all endpoints once.
+func (p *EndpointPool) probe(cli *http.Client) {
+	for _, endpoint := range p.Endpoints {
+		err := probeEndpoint(cli, endpoint.Base+p.Conf.DataproxyHealthPath)
+		p.lock.Lock()
+		if err != nil {
+			endpoint.ProbeFailures += 1
+			if !endpoint.unhealthy {
+				log.Warnf("Health check of endpoint %s failed, %v", endpoint.Addr, err)
+			}
+		} else if endpoint.unhealthy {
+			log.Infof("Health check of endpoint %s succeeded again", endpoint.Addr)
+		}
+		endpoint.unhealthy = err != nil
+		p.lock.Unlock()
+	}
+}
+
+func probeEndpoint(cli *http.Client, url string) error {
+	response, err := cli.Get(url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("response code %d", response.StatusCode)
+	}
+	return nil
+}
+
+// Print prints the ejections and health of the endpoints, they are shared
+// by all topics.
+func (p *EndpointPool) Print() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	lines := []string{fmt.Sprintf("%-30s %8s %10s %14s  %s", "Endpoint", "Weight", "Ejections", "ProbeFailures", "State")}
+	for _, endpoint := range p.Endpoints {
+		state := "up"
+		if endpoint.unhealthy {
+			state = "unhealthy"
+		} else if now.Before(endpoint.ejectUntil) {
+			state = "ejected"
+		}
+		lines = append(lines, fmt.Sprintf("%-30s %8d %10d %14d  %s", endpoint.Addr, endpoint.Weight, endpoint.Ejections, endpoint.ProbeFailures, state))
+	}
+	for _, line := range lines {
+		log.Infoln(line)
+	}
+	fmt.Println(strings.Join(lines, "\n"))
+}
+
+// EndpointAttempt is a request of a message sent to an endpoint of the pool.
+type EndpointAttempt struct {
+	Endpoint string
+	Failed   bool
+	Time     int64 // Milliseconds
+}
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEndpointPool(balancer string, weights []int) *EndpointPool {
+	return NewEndpointPool(&Config{
+		HttpScheme:             "http",
+		DataproxyEndpoints:     []string{"a:80", "b:80", "c:80"},
+		DataproxyWeights:       weights,
+		DataproxyBalancer:      balancer,
+		DataproxyEjectFailures: 2,
+		DataproxyEjectTime:     60000,
+	})
+}
+
+// acquireAll picks n endpoints releasing each one right away.
+func acquireAll(pool *EndpointPool, n int) string {
+	var picked []string
+	for i := 0; i < n; i++ {
+		endpoint := pool.Acquire()
+		picked = append(picked, strings.TrimSuffix(endpoint.Addr, ":80"))
+		pool.Release(endpoint, false)
+	}
+	return strings.Join(picked, "")
+}
+
+func TestEndpointPoolBalancer(t *testing.T) {
+	tests := []struct {
+		balancer string
+		weights  []int
+		picked   string
+	}{
+		{"roundrobin", nil, "abcabca"},
+		{"leastinflight", nil, "abcabca"},
+		{"weighted", []int{1, 1, 1}, "abcabca"},
+		// the smooth weighted round robin sequence of nginx
+		{"weighted", []int{5, 1, 1}, "aabacaa" + "aabacaa"},
+		{"weighted", []int{2, 1, 1}, "abcaabca"},
+	}
+	for _, test := range tests {
+		pool := testEndpointPool(test.balancer, test.weights)
+		if picked := acquireAll(pool, len(test.picked)); picked != test.picked {
+			t.Errorf("%s %v picked %s, expect %s", test.balancer, test.weights, picked, test.picked)
+		}
+	}
+	if base := testEndpointPool("roundrobin", nil).Endpoints[1].Base; base != "http://b:80" {
+		t.Errorf("base is %s", base)
+	}
+}
+
+func TestEndpointPoolLeastInflight(t *testing.T) {
+	pool := testEndpointPool("leastinflight", nil)
+	a, b := pool.Acquire(), pool.Acquire()
+	pool.Acquire()
+	pool.Release(b, false)
+	// b has no request left, a and c one each
+	if picked := pool.Acquire(); picked != b {
+		t.Errorf("picked %s, expect b:80", picked.Addr)
+	}
+	pool.Release(a, false)
+	if picked := pool.Acquire(); picked != a {
+		t.Errorf("picked %s, expect a:80", picked.Addr)
+	}
+}
+
+func TestEndpointPoolEject(t *testing.T) {
+	pool := testEndpointPool("roundrobin", nil)
+	a := pool.Endpoints[0]
+	// a success resets the failures in a row
+	for _, failed := range []bool{true, false, true} {
+		a.inflight++
+		pool.Release(a, failed)
+	}
+	if a.Ejections != 0 {
+		t.Fatalf("a is ejected after failures not in a row")
+	}
+	a.inflight++
+	pool.Release(a, true)
+	if a.Ejections != 1 || a.available(time.Now()) {
+		t.Fatalf("a is not ejected after 2 failures in a row")
+	}
+	if picked := acquireAll(pool, 4); strings.Contains(picked, "a") {
+		t.Errorf("ejected endpoint is picked: %s", picked)
+	}
+
+	// all endpoints are used when none is available
+	for _, endpoint := range pool.Endpoints {
+		endpoint.ejectUntil = time.Now().Add(time.Minute)
+	}
+	if picked := acquireAll(pool, 3); len(picked) != 3 {
+		t.Errorf("picked %s", picked)
+	}
+	a.ejectUntil = time.Time{}
+	if picked := acquireAll(pool, 2); picked != "aa" {
+		t.Errorf("picked %s after the ejection ended", picked)
+	}
+
+	pool.Conf.DataproxyEjectFailures = 0
+	for i := 0; i < 5; i++ {
+		pool.Endpoints[1].inflight++
+		pool.Release(pool.Endpoints[1], true)
+	}
+	if pool.Endpoints[1].Ejections != 0 {
+		t.Error("endpoint is ejected with ejectfailures 0")
+	}
+}
+
+func TestEndpointPoolProbe(t *testing.T) {
+	healthy := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy || r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	pool := NewEndpointPool(&Config{
+		HttpScheme:          "http",
+		DataproxyEndpoints:  []string{strings.TrimPrefix(server.URL, "http://"), "127.0.0.1:1"},
+		DataproxyBalancer:   "roundrobin",
+		DataproxyHealthPath: "/health",
+	})
+	pool.probe(server.Client())
+	up, down := pool.Endpoints[0], pool.Endpoints[1]
+	if !up.available(time.Now()) || down.available(time.Now()) || down.ProbeFailures != 1 {
+		t.Fatalf("probe: up %+v, down %+v", up, down)
+	}
+	for i := 0; i < 3; i++ {
+		if picked := pool.Acquire(); picked != up {
+			t.Errorf("unhealthy endpoint %s is picked", picked.Addr)
+		}
+	}
+	healthy = false
+	pool.probe(server.Client())
+	if up.available(time.Now()) || up.ProbeFailures != 1 {
+		t.Errorf("503 is healthy: %+v", up)
+	}
+}
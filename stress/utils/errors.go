@@ -0,0 +1,87 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// SinkError is an error answered by the server of a sink, Reason is the
+// name reported in the error table.
+type SinkError struct {
+	Reason  string
+	Message string
+}
+
+func (e *SinkError) Error() string {
+	return e.Message
+}
+
+// IsSinkError reports whether err is answered by the server of a sink.
+func IsSinkError(err error) bool {
+	var sinkErr *SinkError
+	return errors.As(err, &sinkErr)
+}
+
+// ClassifyError returns the reason of a failed request reported in the
+// error table, network errors use the names of retry.networkerrors.
+func ClassifyError(err error) string {
+	var kafkaErr kafka.Error
+	var writeErrs kafka.WriteErrors
+	var sinkErr *SinkError
+	if errors.As(err, &sinkErr) {
+		return sinkErr.Reason
+	}
+	if errors.As(err, &writeErrs) {
+		for _, e := range writeErrs {
+			if e != nil {
+				return ClassifyError(e)
+			}
+		}
+	}
+	if errors.As(err, &kafkaErr) {
+		return fmt.Sprintf("kafka_%d_%s", int(kafkaErr), strings.ReplaceAll(kafkaErr.Title(), " ", "_"))
+	}
+	return netErrorKind(err)
+}
+
+// StatusReason returns the reason of a http response with code.
+func StatusReason(code int) string {
+	return fmt.Sprintf("http_%d", code)
+}
+
+// netErrorKind maps a transport error to the names used by retry.networkerrors.
+func netErrorKind(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.As(err, &recordErr), errors.As(err, &authorityErr),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidErr),
+		strings.Contains(err.Error(), "tls: "):
+		return "tls"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "reset"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	default:
+		return "other"
+	}
+}
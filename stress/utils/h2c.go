@@ -0,0 +1,28 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// enableH2c makes transport speak http/2 without tls to http:// urls,
+// the connections are dialed like the http/1 ones of transport.
+func enableH2c(transport *http.Transport) {
+	transport.RegisterProtocol("http", &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return transport.DialContext(context.Background(), network, addr)
+		},
+		DisableCompression: transport.DisableCompression,
+	})
+}
+
+// enableServerH2c makes server accept http/2 without tls besides http/1.
+func enableServerH2c(server *http.Server) {
+	server.Handler = h2c.NewHandler(server.Handler, &http2.Server{})
+}
@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+var (
+	seqLock   sync.Mutex
+	sequences = make(map[string]int64)
+)
+
+// NextSeq returns the sequence of the next message of topic, starts from 1.
+// Every sink of test.usemethods counts its own messages.
+func NextSeq(conf *Config, topic string) int64 {
+	key := fmt.Sprintf("%d/%s", conf.MethodId, topic)
+	seqLock.Lock()
+	defer seqLock.Unlock()
+	sequences[key] += 1
+	return sequences[key]
+}
+
+// TemplateVars are the fields available in url and header templates,
+// e.g. "http://gateway/{{.Topic}}?run={{.RunId}}&seq={{.Seq}}".
+type TemplateVars struct {
+	Topic string
+	RunId string
+	Seq   int64
+}
+
+func (v *TemplateVars) Render(tmpl *template.Template) (string, error) {
+	buffer := &bytes.Buffer{}
+	if err := tmpl.Execute(buffer, v); err != nil {
+		return "", err
+	}
+	return buffer.String(), nil
+}
+
+// Date returns the current date like 2006-01-02, e.g. for the key of an object.
+func (v *TemplateVars) Date() string {
+	return time.Now().Format("2006-01-02")
+}
+
+// TopicName returns the name of topic in a sink, e.g. a table or subject,
+// names given per topic win over the template rendered with the topic and run id.
+func TopicName(topic string, conf *Config, names map[string]string, tmpl *template.Template) (string, error) {
+	// keys of a toml table are lower cased by viper
+	if name, ok := names[strings.ToLower(topic)]; ok {
+		return name, nil
+	}
+	vars := &TemplateVars{Topic: topic, RunId: conf.RunId}
+	return vars.Render(tmpl)
+}
+
+// ParseStatusSet parses a list of status codes and ranges like "200-299,409"
+// into a predicate of ingest.successstatus.
+func ParseStatusSet(spec string) (func(code int) bool, error) {
+	type codeRange struct{ low, high int }
+	var ranges []codeRange
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		low, high, isRange := strings.Cut(item, "-")
+		from, err := strconv.Atoi(strings.TrimSpace(low))
+		if err != nil {
+			return nil, fmt.Errorf("invalid status %q", item)
+		}
+		to := from
+		if isRange {
+			if to, err = strconv.Atoi(strings.TrimSpace(high)); err != nil || to < from {
+				return nil, fmt.Errorf("invalid status range %q", item)
+			}
+		}
+		ranges = append(ranges, codeRange{from, to})
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("empty status set %q", spec)
+	}
+	return func(code int) bool {
+		for _, r := range ranges {
+			if code >= r.low && code <= r.high {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// parseTemplates parses the url and header templates of the [ingest] section.
+func parseTemplates(conf *Config) (*template.Template, map[string]*template.Template, error) {
+	urlTmpl, err := template.New("url").Option("missingkey=error").Parse(conf.IngestUrl)
+	if err != nil {
+		return nil, nil, err
+	}
+	headerTmpl := make(map[string]*template.Template)
+	for name, value := range conf.IngestHeaders {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(value)
+		if err != nil {
+			return nil, nil, err
+		}
+		headerTmpl[http.CanonicalHeaderKey(name)] = tmpl
+	}
+	return urlTmpl, headerTmpl, nil
+}
+
+// NewIngestHandler returns a http handler of the generic ingest sink, the
+// request is built from the [ingest] section instead of the dataproxy contract.
+func NewIngestHandler(topic string, conf *Config) *HttpHandler {
+	header := http.Header{}
+	if conf.DataFmt == "avro" {
+		header.Set("Content-Type", "application/avro")
+	} else {
+		header.Set("Content-Type", "text/csv")
+	}
+	// templates and status set are checked by Validate
+	urlTmpl, headerTmpl, _ := parseTemplates(conf)
+	success, _ := ParseStatusSet(conf.IngestSuccessStatus)
+	return &HttpHandler{
+		Topic:      topic,
+		Cli:        &http.Client{Transport: SharedTransport("ingest", conf)},
+		Url:        conf.IngestUrl,
+		Conf:       conf,
+		Method:     conf.IngestMethod,
+		Header:     header,
+		Success:    success,
+		Auth:       SharedAuthenticator("ingest", "none", conf),
+		UrlTmpl:    urlTmpl,
+		HeaderTmpl: headerTmpl,
+	}
+}
@@ -0,0 +1,38 @@
+package utils
+
+import "testing"
+
+func TestParseStatusSet(t *testing.T) {
+	tests := []struct {
+		spec     string
+		accepted []int
+		rejected []int
+	}{
+		{"200", []int{200}, []int{201, 199}},
+		{"200-299", []int{200, 250, 299}, []int{199, 300}},
+		{"200-299,409", []int{204, 409}, []int{404, 410}},
+		{" 200 - 204 , 409 ,", []int{202, 409}, []int{205}},
+	}
+	for _, test := range tests {
+		success, err := ParseStatusSet(test.spec)
+		if err != nil {
+			t.Errorf("ParseStatusSet(%q): %v", test.spec, err)
+			continue
+		}
+		for _, code := range test.accepted {
+			if !success(code) {
+				t.Errorf("ParseStatusSet(%q) rejects %d", test.spec, code)
+			}
+		}
+		for _, code := range test.rejected {
+			if success(code) {
+				t.Errorf("ParseStatusSet(%q) accepts %d", test.spec, code)
+			}
+		}
+	}
+	for _, spec := range []string{"", ",", "ok", "200-", "299-200", "2xx"} {
+		if _, err := ParseStatusSet(spec); err == nil {
+			t.Errorf("ParseStatusSet(%q) is accepted", spec)
+		}
+	}
+}
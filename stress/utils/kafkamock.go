@@ -0,0 +1,573 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/apiversions"
+	"github.com/segmentio/kafka-go/protocol/fetch"
+	"github.com/segmentio/kafka-go/protocol/listoffsets"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+	log "github.com/sirupsen/logrus"
+)
+
+// kafkaMockVersions are the versions advertised by the mock broker. Only
+// v2 record batches are stored, Produce v3 and Fetch v4 are the first
+// versions carrying them. KafkaHandler uses Metadata and Produce v8,
+// kafka-go readers Metadata v1, ListOffsets v1 and Fetch v10, the other
+// versions are round tripped by TestKafkaMockVersions.
+var kafkaMockVersions = []apiversions.ApiKeyResponse{
+	{ApiKey: int16(protocol.ApiVersions), MinVersion: 0, MaxVersion: 2},
+	{ApiKey: int16(protocol.Metadata), MinVersion: 1, MaxVersion: 8},
+	{ApiKey: int16(protocol.Produce), MinVersion: 3, MaxVersion: 8},
+	{ApiKey: int16(protocol.ListOffsets), MinVersion: 1, MaxVersion: 5},
+	{ApiKey: int16(protocol.Fetch), MinVersion: 4, MaxVersion: 11},
+}
+
+// kafkaMockBatch is a v2 record batch as stored in the log, its base offset
+// is patched into data when it is appended.
+type kafkaMockBatch struct {
+	BaseOffset int64
+	Count      int64
+	MaxTime    int64 // Milliseconds
+	Data       []byte
+}
+
+type kafkaMockPartition struct {
+	batches  []kafkaMockBatch
+	logStart int64
+	next     int64 // high watermark
+	size     int64
+}
+
+// KafkaMockCounter counts the records of a topic received and fetched by
+// the mock broker.
+type KafkaMockCounter struct {
+	Messages int64
+	Bytes    int64
+	Rows     int64
+	Invalid  int64 // message values failing to parse as datafmt
+	Fetched  int64
+}
+
+// KafkaMock is a single node kafka broker keeping the topics in memory, it
+// answers the ApiVersions, Metadata, Produce, ListOffsets and Fetch requests
+// of kafka-go writers and readers without consumer groups.
+type KafkaMock struct {
+	Conf      *Config
+	StartTime time.Time
+	lock      sync.Mutex
+	topics    map[string][]*kafkaMockPartition
+	counters  map[string]*KafkaMockCounter
+	listener  net.Listener
+	host      string
+	port      int32
+	// closed when records are appended, long polling fetches wait on it
+	notify chan struct{}
+}
+
+// NewKafkaMock returns a broker with the topics of the [required] section.
+func NewKafkaMock(conf *Config) *KafkaMock {
+	mock := &KafkaMock{
+		Conf:      conf,
+		StartTime: time.Now(),
+		topics:    make(map[string][]*kafkaMockPartition),
+		counters:  make(map[string]*KafkaMockCounter),
+		notify:    make(chan struct{}),
+	}
+	for _, topic := range conf.Topics {
+		mock.topic(topic, true)
+	}
+	return mock
+}
+
+// Listen opens the listener of kafkamock.listen, the broker advertises its
+// address in metadata responses, or kafkamock.advertisedhost and
+// kafkamock.advertisedport when clients connect through a proxy. It returns
+// the address clients connect to.
+func (k *KafkaMock) Listen() (string, error) {
+	listener, err := net.Listen("tcp", k.Conf.KafkaMockListen)
+	if err != nil {
+		return "", err
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	k.listener = listener
+	k.host = addr.IP.String()
+	k.port = int32(addr.Port)
+	if k.Conf.KafkaMockAdvertisedHost != "" {
+		k.host = k.Conf.KafkaMockAdvertisedHost
+	}
+	if k.Conf.KafkaMockAdvertisedPort > 0 {
+		k.port = int32(k.Conf.KafkaMockAdvertisedPort)
+	}
+	return net.JoinHostPort(k.host, strconv.Itoa(int(k.port))), nil
+}
+
+// Serve accepts connections until Close.
+func (k *KafkaMock) Serve() error {
+	for {
+		conn, err := k.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go k.serveConn(conn)
+	}
+}
+
+func (k *KafkaMock) Close() error {
+	return k.listener.Close()
+}
+
+// topic returns the partitions of name, the topic is created with
+// kafkamock.partitions when create is set. The lock is held by the caller.
+func (k *KafkaMock) topic(name string, create bool) []*kafkaMockPartition {
+	partitions, ok := k.topics[name]
+	if ok || !create || name == "" {
+		return partitions
+	}
+	for i := 0; i < k.Conf.KafkaMockPartitions; i++ {
+		partitions = append(partitions, &kafkaMockPartition{})
+	}
+	k.topics[name] = partitions
+	k.counters[name] = &KafkaMockCounter{}
+	log.Infof("Kafka mock created topic %s with %d partitions", name, len(partitions))
+	return partitions
+}
+
+func (k *KafkaMock) partition(topic string, index int32) *kafkaMockPartition {
+	partitions := k.topic(topic, false)
+	if index < 0 || int(index) >= len(partitions) {
+		return nil
+	}
+	return partitions[index]
+}
+
+func (k *KafkaMock) serveConn(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		version, correlationId, _, request, err := protocol.ReadRequest(reader)
+		if err != nil {
+			// clients close their connections between two requests
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, net.ErrClosed) {
+				log.Errorf("Read kafka request from %s with error, %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		log.Debugf("Kafka mock got %s v%d request from %s", request.ApiKey(), version, conn.RemoteAddr())
+		var response protocol.Message
+		switch r := request.(type) {
+		case *apiversions.Request:
+			response = k.apiVersions()
+		case *metadata.Request:
+			response = k.metadata(r)
+		case *produce.Request:
+			k.delay()
+			response = k.produce(r)
+			if r.Acks == 0 {
+				continue
+			}
+		case *listoffsets.Request:
+			response = k.listOffsets(r)
+		case *fetch.Request:
+			err = k.fetch(conn, version, correlationId, r)
+		default:
+			log.Errorf("Kafka mock does not support %s requests", request.ApiKey())
+			return
+		}
+		if response != nil {
+			err = protocol.WriteResponse(conn, version, correlationId, response)
+		}
+		if err != nil {
+			log.Errorf("Write kafka response to %s with error, %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
+
+// delay sleeps kafkamock.latency plus a random part of kafkamock.latencyjitter.
+func (k *KafkaMock) delay() {
+	latency := time.Duration(k.Conf.KafkaMockLatency) * time.Millisecond
+	if k.Conf.KafkaMockLatencyJitter > 0 {
+		latency += time.Duration(rand.Intn(k.Conf.KafkaMockLatencyJitter+1)) * time.Millisecond
+	}
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+}
+
+func (k *KafkaMock) apiVersions() *apiversions.Response {
+	return &apiversions.Response{ApiKeys: kafkaMockVersions}
+}
+
+func (k *KafkaMock) metadata(request *metadata.Request) *metadata.Response {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	// kafka-go writers do not ask for auto creation, unknown topics are
+	// created whenever kafkamock.autocreate is set
+	create := k.Conf.KafkaMockAutoCreate
+	names := request.TopicNames
+	if len(names) == 0 {
+		for name := range k.topics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	response := &metadata.Response{
+		Brokers:   []metadata.ResponseBroker{{NodeID: 0, Host: k.host, Port: k.port}},
+		ClusterID: "stress-mock",
+	}
+	for _, name := range names {
+		topic := metadata.ResponseTopic{Name: name}
+		partitions := k.topic(name, create)
+		if partitions == nil {
+			topic.ErrorCode = int16(kafka.UnknownTopicOrPartition)
+		}
+		for i := range partitions {
+			topic.Partitions = append(topic.Partitions, metadata.ResponsePartition{
+				PartitionIndex: int32(i),
+				ReplicaNodes:   []int32{0},
+				IsrNodes:       []int32{0},
+			})
+		}
+		response.Topics = append(response.Topics, topic)
+	}
+	return response
+}
+
+// readRecords copies the records of set and returns their values, the
+// records of a request are only valid while it is handled.
+func readRecords(set protocol.RecordSet) ([]protocol.Record, [][]byte, error) {
+	var records []protocol.Record
+	var values [][]byte
+	if set.Records == nil {
+		return records, values, nil
+	}
+	for {
+		record, err := set.Records.ReadRecord()
+		if errors.Is(err, io.EOF) {
+			return records, values, nil
+		}
+		if err != nil {
+			return records, values, err
+		}
+		key, err := protocol.ReadAll(record.Key)
+		if err != nil {
+			return records, values, err
+		}
+		value, err := protocol.ReadAll(record.Value)
+		if err != nil {
+			return records, values, err
+		}
+		records = append(records, protocol.Record{
+			Time:    record.Time,
+			Key:     protocol.NewBytes(key),
+			Value:   protocol.NewBytes(value),
+			Headers: append([]protocol.Header(nil), record.Headers...),
+		})
+		values = append(values, value)
+	}
+}
+
+// append stores records as a batch of p, the oldest batches are dropped
+// when the partition exceeds kafkamock.maxbytes. The lock is held by the caller.
+func (k *KafkaMock) append(p *kafkaMockPartition, records []protocol.Record) (int64, error) {
+	buffer := &bytes.Buffer{}
+	set := protocol.RecordSet{Version: 2, Records: protocol.NewRecordReader(records...)}
+	if _, err := set.WriteTo(buffer); err != nil {
+		return 0, err
+	}
+	// the record set starts with its size, the base offset is not part
+	// of the crc of the batch
+	data := buffer.Bytes()[4:]
+	binary.BigEndian.PutUint64(data[0:8], uint64(p.next))
+	batch := kafkaMockBatch{BaseOffset: p.next, Count: int64(len(records)), Data: data}
+	for _, record := range records {
+		if t := record.Time.UnixMilli(); t > batch.MaxTime {
+			batch.MaxTime = t
+		}
+	}
+	p.batches = append(p.batches, batch)
+	p.next += batch.Count
+	p.size += int64(len(data))
+	for len(p.batches) > 1 && p.size > k.Conf.KafkaMockMaxBytes {
+		p.size -= int64(len(p.batches[0].Data))
+		p.batches = p.batches[1:]
+		p.logStart = p.batches[0].BaseOffset
+	}
+	close(k.notify)
+	k.notify = make(chan struct{})
+	return batch.BaseOffset, nil
+}
+
+func (k *KafkaMock) produce(request *produce.Request) *produce.Response {
+	response := &produce.Response{}
+	for _, t := range request.Topics {
+		topic := produce.ResponseTopic{Topic: t.Topic}
+		for _, p := range t.Partitions {
+			result := produce.ResponsePartition{Partition: p.Partition, LogAppendTime: -1}
+			records, values, err := readRecords(p.RecordSet)
+			k.lock.Lock()
+			partition := k.partition(t.Topic, p.Partition)
+			switch {
+			case partition == nil:
+				result.ErrorCode = int16(kafka.UnknownTopicOrPartition)
+			case err != nil:
+				log.Errorf("Read records of topic %s with error, %v", t.Topic, err)
+				result.ErrorCode = int16(kafka.InvalidMessage)
+			case len(records) > 0:
+				if result.BaseOffset, err = k.append(partition, records); err != nil {
+					log.Errorf("Append records of topic %s with error, %v", t.Topic, err)
+					result.ErrorCode = int16(kafka.InvalidMessage)
+				} else {
+					k.count(t.Topic, values)
+				}
+			}
+			if partition != nil {
+				result.LogStartOffset = partition.logStart
+			}
+			k.lock.Unlock()
+			topic.Partitions = append(topic.Partitions, result)
+		}
+		response.Topics = append(response.Topics, topic)
+	}
+	return response
+}
+
+// count parses the record values in datafmt, a message of KafkaHandler
+// is the rows of one message. The lock is held by the caller.
+func (k *KafkaMock) count(topic string, values [][]byte) {
+	counter := k.counters[topic]
+	for _, value := range values {
+		counter.Messages += 1
+		if value == nil {
+			continue
+		}
+		counter.Bytes += int64(len(value))
+		rows, err := DecodeRows(k.Conf.DataFmt, value)
+		if err != nil {
+			counter.Invalid += 1
+			continue
+		}
+		counter.Rows += int64(len(rows))
+	}
+}
+
+func (k *KafkaMock) listOffsets(request *listoffsets.Request) *listoffsets.Response {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	response := &listoffsets.Response{}
+	for _, t := range request.Topics {
+		topic := listoffsets.ResponseTopic{Topic: t.Topic}
+		for _, p := range t.Partitions {
+			result := listoffsets.ResponsePartition{Partition: p.Partition, Timestamp: -1, Offset: -1}
+			partition := k.partition(t.Topic, p.Partition)
+			switch {
+			case partition == nil:
+				result.ErrorCode = int16(kafka.UnknownTopicOrPartition)
+			case p.Timestamp == kafka.LastOffset:
+				result.Offset = partition.next
+			case p.Timestamp == kafka.FirstOffset:
+				result.Offset = partition.logStart
+			default:
+				// the first batch with records at or after the timestamp
+				for _, batch := range partition.batches {
+					if batch.MaxTime >= p.Timestamp {
+						result.Offset = batch.BaseOffset
+						result.Timestamp = batch.MaxTime
+						break
+					}
+				}
+			}
+			topic.Partitions = append(topic.Partitions, result)
+		}
+		response.Topics = append(response.Topics, topic)
+	}
+	return response
+}
+
+// kafkaMockFetchPartition is the answer of a fetch for one partition.
+type kafkaMockFetchPartition struct {
+	Partition     int32
+	ErrorCode     int16
+	HighWatermark int64
+	LogStart      int64
+	Records       []byte
+}
+
+// read collects the batches of topic from the fetch offset of the request.
+// The lock is held by the caller.
+func (k *KafkaMock) read(topic string, p fetch.RequestPartition) kafkaMockFetchPartition {
+	result := kafkaMockFetchPartition{Partition: p.Partition, HighWatermark: -1, LogStart: -1}
+	partition := k.partition(topic, p.Partition)
+	if partition == nil {
+		result.ErrorCode = int16(kafka.UnknownTopicOrPartition)
+		return result
+	}
+	result.HighWatermark = partition.next
+	result.LogStart = partition.logStart
+	if p.FetchOffset < partition.logStart || p.FetchOffset > partition.next {
+		result.ErrorCode = int16(kafka.OffsetOutOfRange)
+		return result
+	}
+	i := sort.Search(len(partition.batches), func(i int) bool {
+		batch := partition.batches[i]
+		return batch.BaseOffset+batch.Count > p.FetchOffset
+	})
+	for ; i < len(partition.batches); i++ {
+		batch := partition.batches[i]
+		// the first batch is sent even if it is larger than the limit
+		if len(result.Records) > 0 && len(result.Records)+len(batch.Data) > int(p.PartitionMaxBytes) {
+			break
+		}
+		result.Records = append(result.Records, batch.Data...)
+		k.counters[topic].Fetched += batch.Count
+	}
+	return result
+}
+
+// fetch answers a fetch request, it waits up to the max wait time of the
+// request for records when there are none at the fetch offsets.
+func (k *KafkaMock) fetch(w io.Writer, version int16, correlationId int32, request *fetch.Request) error {
+	deadline := time.Now().Add(time.Duration(request.MaxWaitTime) * time.Millisecond)
+	results := make([][]kafkaMockFetchPartition, len(request.Topics))
+	for {
+		found := false
+		k.lock.Lock()
+		for i, t := range request.Topics {
+			results[i] = results[i][:0]
+			for _, p := range t.Partitions {
+				result := k.read(t.Topic, p)
+				found = found || len(result.Records) > 0 || result.ErrorCode != 0
+				results[i] = append(results[i], result)
+			}
+		}
+		notify := k.notify
+		k.lock.Unlock()
+		wait := time.Until(deadline)
+		if found || wait <= 0 {
+			break
+		}
+		// any append wakes the fetch up to read again
+		timer := time.NewTimer(wait)
+		select {
+		case <-notify:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	return writeFetchResponse(w, version, correlationId, request, results)
+}
+
+func appendKafkaString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+// writeFetchResponse encodes the fetch response of versions 4 to 11, the
+// records are the stored batches as they are.
+func writeFetchResponse(w io.Writer, version int16, correlationId int32, request *fetch.Request, results [][]kafkaMockFetchPartition) error {
+	buf := make([]byte, 8, 1024)
+	binary.BigEndian.PutUint32(buf[4:8], uint32(correlationId))
+	buf = binary.BigEndian.AppendUint32(buf, 0) // throttle time
+	if version >= 7 {
+		buf = binary.BigEndian.AppendUint16(buf, 0) // error code
+		buf = binary.BigEndian.AppendUint32(buf, 0) // session id
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(request.Topics)))
+	for i, t := range request.Topics {
+		buf = appendKafkaString(buf, t.Topic)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(results[i])))
+		for _, p := range results[i] {
+			buf = binary.BigEndian.AppendUint32(buf, uint32(p.Partition))
+			buf = binary.BigEndian.AppendUint16(buf, uint16(p.ErrorCode))
+			buf = binary.BigEndian.AppendUint64(buf, uint64(p.HighWatermark))
+			buf = binary.BigEndian.AppendUint64(buf, uint64(p.HighWatermark)) // last stable offset
+			if version >= 5 {
+				buf = binary.BigEndian.AppendUint64(buf, uint64(p.LogStart))
+			}
+			buf = binary.BigEndian.AppendUint32(buf, 0) // aborted transactions
+			if version >= 11 {
+				buf = binary.BigEndian.AppendUint32(buf, ^uint32(0)) // preferred read replica
+			}
+			buf = binary.BigEndian.AppendUint32(buf, uint32(len(p.Records)))
+			buf = append(buf, p.Records...)
+		}
+	}
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(buf)-4))
+	_, err := w.Write(buf)
+	return err
+}
+
+// Print prints the counters per topic, Rows is compared with Transmit
+// Successful Rows of the client report.
+func (k *KafkaMock) Print() {
+	k.lock.Lock()
+	names := make([]string, 0, len(k.counters))
+	for name := range k.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := []string{
+		fmt.Sprintf("==============Kafka mock, up %.3f s======================", time.Since(k.StartTime).Seconds()),
+		fmt.Sprintf("%-30s %10s %10s %14s %16s %10s %10s", "Topic", "Partitions", "Messages", "Rows", "Bytes", "Invalid", "Fetched"),
+	}
+	for _, name := range names {
+		c := k.counters[name]
+		lines = append(lines, fmt.Sprintf("%-30s %10d %10d %14d %16d %10d %10d", name, len(k.topics[name]), c.Messages, c.Rows, c.Bytes, c.Invalid, c.Fetched))
+	}
+	k.lock.Unlock()
+	for _, line := range lines {
+		log.Infoln(line)
+	}
+	fmt.Println(strings.Join(lines, "\n"))
+}
+
+// ServeKafkaMock runs the mock broker of the [kafkamock] section until the
+// process is interrupted, the counters are printed at exit.
+func ServeKafkaMock(conf *Config) {
+	conf.ValidateKafkaMock()
+	mock := NewKafkaMock(conf)
+	addr, err := mock.Listen()
+	if err != nil {
+		log.Fatalf("Listen on %s with error %v", conf.KafkaMockListen, err)
+	}
+	if conf.KafkaMockStatsInterval > 0 {
+		go func() {
+			for range time.Tick(time.Duration(conf.KafkaMockStatsInterval) * time.Second) {
+				mock.Print()
+			}
+		}()
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		mock.Close()
+	}()
+	log.Infof("Kafka mock listening on %s", addr)
+	if err := mock.Serve(); err != nil {
+		log.Fatalf("Serve kafka mock on %s with error %v", addr, err)
+	}
+	mock.Print()
+}
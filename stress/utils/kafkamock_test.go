@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go/protocol"
+	"github.com/segmentio/kafka-go/protocol/apiversions"
+	"github.com/segmentio/kafka-go/protocol/fetch"
+	"github.com/segmentio/kafka-go/protocol/listoffsets"
+	"github.com/segmentio/kafka-go/protocol/metadata"
+	"github.com/segmentio/kafka-go/protocol/produce"
+)
+
+// startKafkaMock serves a mock broker with topic t1 on a random port.
+func startKafkaMock(t *testing.T) (*KafkaMock, string) {
+	t.Helper()
+	conf := &Config{
+		Topics:              []string{"t1"},
+		DataFmt:             "csv",
+		KafkaMockListen:     "127.0.0.1:0",
+		KafkaMockPartitions: 2,
+		KafkaMockMaxBytes:   1 << 20,
+	}
+	mock := NewKafkaMock(conf)
+	addr, err := mock.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go mock.Serve()
+	t.Cleanup(func() { mock.Close() })
+	return mock, addr
+}
+
+func kafkaMockRoundTrip(t *testing.T, addr string, version int16, request protocol.Message) protocol.Message {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	response, err := protocol.RoundTrip(conn, version, 1, "test", request)
+	if err != nil {
+		t.Fatalf("%s v%d: %v", request.ApiKey(), version, err)
+	}
+	return response
+}
+
+// TestKafkaMockVersions round trips every advertised version.
+func TestKafkaMockVersions(t *testing.T) {
+	_, addr := startKafkaMock(t)
+	versions := make(map[protocol.ApiKey]apiversions.ApiKeyResponse)
+	for _, key := range kafkaMockVersions {
+		versions[protocol.ApiKey(key.ApiKey)] = key
+	}
+	each := func(key protocol.ApiKey, test func(version int16)) {
+		for v := versions[key].MinVersion; v <= versions[key].MaxVersion; v++ {
+			test(v)
+		}
+	}
+
+	each(protocol.ApiVersions, func(v int16) {
+		response := kafkaMockRoundTrip(t, addr, v, &apiversions.Request{}).(*apiversions.Response)
+		if len(response.ApiKeys) != len(kafkaMockVersions) {
+			t.Errorf("ApiVersions v%d: %d keys", v, len(response.ApiKeys))
+		}
+	})
+	each(protocol.Metadata, func(v int16) {
+		response := kafkaMockRoundTrip(t, addr, v, &metadata.Request{TopicNames: []string{"t1"}}).(*metadata.Response)
+		if len(response.Brokers) != 1 || len(response.Topics) != 1 || len(response.Topics[0].Partitions) != 2 {
+			t.Errorf("Metadata v%d: %+v", v, response)
+		}
+	})
+	each(protocol.Produce, func(v int16) {
+		request := &produce.Request{
+			Acks:    1,
+			Timeout: 1000,
+			Topics: []produce.RequestTopic{{
+				Topic: "t1",
+				Partitions: []produce.RequestPartition{{
+					Partition: 0,
+					RecordSet: protocol.RecordSet{
+						Version: 2,
+						Records: protocol.NewRecordReader(protocol.Record{Value: protocol.NewBytes(Write2Csv(1).Bytes())}),
+					},
+				}},
+			}},
+		}
+		response := kafkaMockRoundTrip(t, addr, v, request).(*produce.Response)
+		partition := response.Topics[0].Partitions[0]
+		if partition.ErrorCode != 0 || partition.BaseOffset != int64(v-3) {
+			t.Errorf("Produce v%d: %+v", v, partition)
+		}
+	})
+	produced := int64(versions[protocol.Produce].MaxVersion - versions[protocol.Produce].MinVersion + 1)
+	each(protocol.ListOffsets, func(v int16) {
+		request := &listoffsets.Request{
+			ReplicaID: -1,
+			Topics: []listoffsets.RequestTopic{{
+				Topic:      "t1",
+				Partitions: []listoffsets.RequestPartition{{Partition: 0, Timestamp: -1}},
+			}},
+		}
+		response := kafkaMockRoundTrip(t, addr, v, request).(*listoffsets.Response)
+		if offset := response.Topics[0].Partitions[0].Offset; offset != produced {
+			t.Errorf("ListOffsets v%d: offset %d, expect %d", v, offset, produced)
+		}
+	})
+	each(protocol.Fetch, func(v int16) {
+		request := &fetch.Request{
+			ReplicaID: -1,
+			MaxBytes:  1 << 20,
+			Topics: []fetch.RequestTopic{{
+				Topic:      "t1",
+				Partitions: []fetch.RequestPartition{{Partition: 0, PartitionMaxBytes: 1 << 20}},
+			}},
+		}
+		response := kafkaMockRoundTrip(t, addr, v, request).(*fetch.Response)
+		partition := response.Topics[0].Partitions[0]
+		var records int64
+		for partition.RecordSet.Records != nil {
+			record, err := partition.RecordSet.Records.ReadRecord()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Fetch v%d: %v", v, err)
+			}
+			if record.Offset != records {
+				t.Errorf("Fetch v%d: record %d has offset %d", v, records, record.Offset)
+			}
+			records++
+		}
+		if partition.ErrorCode != 0 || partition.HighWatermark != produced || records != produced {
+			t.Errorf("Fetch v%d: error %d, high watermark %d, %d records", v, partition.ErrorCode, partition.HighWatermark, records)
+		}
+	})
+}
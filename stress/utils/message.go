@@ -2,13 +2,16 @@ package utils
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/csv"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"math/rand"
 
 	"net"
 	"reflect"
+	"strconv"
 	"strings"
 	"time"
 
@@ -394,6 +397,20 @@ func NewDataRow() *DataRow {
 	return buf
 }
 
+// NewAvroRecord converts data to a generic record of schema.
+func NewAvroRecord(schema avro.Schema, data DataRow) *avro.GenericRecord {
+	record := avro.NewGenericRecord(schema)
+	value := reflect.ValueOf(data)
+	typ := reflect.TypeOf(data)
+	for j := 0; j < value.NumField(); j++ {
+		tag := typ.Field(j).Tag.Get("avro")
+		val := value.Field(j).Interface()
+		record.Set(tag, val)
+		log.Tracef("Set avro field %s: %v", tag, val)
+	}
+	return record
+}
+
 func Write2Avro(bucketSize int) *bytes.Buffer {
 	buffer := &bytes.Buffer{}
 	schema := avro.MustParseSchema(DataSchema)
@@ -403,80 +420,270 @@ func Write2Avro(bucketSize int) *bytes.Buffer {
 
 	for i := 0; i < bucketSize; i++ {
 		ptrData := NewDataRow()
-		data := *ptrData
-		record := avro.NewGenericRecord(schema)
-		value := reflect.ValueOf(data)
-		typ := reflect.TypeOf(data)
-		for j := 0; j < value.NumField(); j++ {
-			tag := typ.Field(j).Tag.Get("avro")
-			val := value.Field(j).Interface()
-			record.Set(tag, val)
-			log.Tracef("Set avro field %s: %v", tag, val)
-		}
+		record := NewAvroRecord(schema, *ptrData)
 		writer.Write(record, encoder)
 	}
 	return buffer
 }
 
+// AvroContainer wraps datums made by Write2Avro into a single block of an
+// avro object container file, rows is the number of datums.
+func AvroContainer(rows int64, datums []byte) []byte {
+	buffer := bytes.NewBuffer(make([]byte, 0, len(datums)+len(DataSchema)+64))
+	sync := []byte(RandStr(8)) // 16 bytes marker
+	encoder := avro.NewBinaryEncoder(buffer)
+	encoder.WriteRaw([]byte{'O', 'b', 'j', 1})
+	encoder.WriteMapStart(2)
+	encoder.WriteString("avro.schema")
+	encoder.WriteBytes([]byte(DataSchema))
+	encoder.WriteString("avro.codec")
+	encoder.WriteBytes([]byte("null"))
+	encoder.WriteMapNext(0)
+	encoder.WriteRaw(sync)
+	encoder.WriteLong(rows)
+	encoder.WriteLong(int64(len(datums)))
+	encoder.WriteRaw(datums)
+	encoder.WriteRaw(sync)
+	return buffer.Bytes()
+}
+
+// NewCsvLine converts data to a csv line, ip columns are written as dotted strings.
+func NewCsvLine(data DataRow) []string {
+	value := reflect.ValueOf(data)
+
+	var line []string
+	for j := 0; j < value.NumField(); j++ {
+		kind := value.Field(j).Kind()
+		name := value.Type().Field(j).Name
+		fieldValue := value.Field(j).Interface()
+		switch kind {
+
+		case reflect.Int32:
+			v := fmt.Sprintf("%v", fieldValue.(int32))
+			line = append(line, v)
+			log.Tracef("%s match int32 item %d, val: %s", name, j, v)
+		case reflect.Int64:
+			// ipv4 addr
+			if strings.HasSuffix(name, "_ip") || strings.HasSuffix(name, "_ipv4") {
+				v := Int2Ipv4(fieldValue.(int64))
+				line = append(line, v)
+				log.Tracef("%s match int64-ipv4 item %d, val: %s", name, j, v)
+			} else {
+				v := fmt.Sprintf("%v", fieldValue.(int64))
+				line = append(line, v)
+				log.Tracef("%s match int64 item %d, val: %s", name, j, v)
+			}
+		case reflect.String:
+			v := fieldValue.(string)
+			line = append(line, v)
+			log.Tracef("%s match string item %d, val: %s", name, j, v)
+		case reflect.Slice:
+			// ipv6 address
+			tmp := fieldValue.([]byte)
+			v := Bytes2Ipv6(tmp)
+			line = append(line, v)
+			log.Tracef("%s match slice item %d, val: %s", name, j, v)
+		default:
+			v := "0"
+			line = append(line, v)
+			log.Tracef("%s match default item %d, val: %s", name, j, v)
+		}
+
+	}
+	return line
+}
+
 func Write2Csv(bucketSize int) *bytes.Buffer {
 	buffer := &bytes.Buffer{}
 	writer := csv.NewWriter(buffer)
 	var records [][]string
 	for i := 0; i < bucketSize; i++ {
 		ptrData := NewDataRow()
-		data := *ptrData
-		value := reflect.ValueOf(data)
-
-		var line []string
-		for j := 0; j < value.NumField(); j++ {
-			kind := value.Field(j).Kind()
-			name := value.Type().Field(j).Name
-			fieldValue := value.Field(j).Interface()
-			switch kind {
-
-			case reflect.Int32:
-				v := fmt.Sprintf("%v", fieldValue.(int32))
-				line = append(line, v)
-				log.Tracef("%s match int32 item %d, val: %s", name, j, v)
-			case reflect.Int64:
-				// ipv4 addr
-				if strings.HasSuffix(name, "_ip") || strings.HasSuffix(name, "_ipv4") {
-					v := Int2Ipv4(fieldValue.(int64))
-					line = append(line, v)
-					log.Tracef("%s match int64-ipv4 item %d, val: %s", name, j, v)
-				} else {
-					v := fmt.Sprintf("%v", fieldValue.(int64))
-					line = append(line, v)
-					log.Tracef("%s match int64 item %d, val: %s", name, j, v)
+		records = append(records, NewCsvLine(*ptrData))
+	}
+	writer.WriteAll(records)
+	return buffer
+}
+
+// RowField is a column of a DataRow named by its avro tag, ip columns
+// hold the same strings as written to csv.
+type RowField struct {
+	Name  string
+	Value interface{}
+}
+
+// RowFields returns the columns of data in schema order.
+func RowFields(data DataRow) []RowField {
+	value := reflect.ValueOf(data)
+	typ := value.Type()
+	fields := make([]RowField, 0, value.NumField())
+	for j := 0; j < value.NumField(); j++ {
+		name := typ.Field(j).Name
+		field := RowField{Name: typ.Field(j).Tag.Get("avro"), Value: value.Field(j).Interface()}
+		switch v := field.Value.(type) {
+		case int64:
+			if strings.HasSuffix(name, "_ip") || strings.HasSuffix(name, "_ipv4") {
+				field.Value = Int2Ipv4(v)
+			}
+		case []byte:
+			field.Value = Bytes2Ipv6(v)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+// DecodeRows parses a message made by Write2Csv or Write2Avro back into rows,
+// sinks with their own payload format convert these rows.
+func DecodeRows(dataFmt string, data []byte) ([]*DataRow, error) {
+	var rows []*DataRow
+	if dataFmt == "avro" {
+		schema := avro.MustParseSchema(DataSchema)
+		reader := avro.NewSpecificDatumReader()
+		reader.SetSchema(schema)
+		for start := 0; start < len(data); {
+			// the decoder reads zeros past the end of data, a truncated
+			// datum is found by walking its fields first
+			end, err := skipAvroRow(data, start)
+			if err != nil {
+				return rows, err
+			}
+			row := &DataRow{}
+			if err := reader.Read(row, avro.NewBinaryDecoder(data[start:end])); err != nil {
+				return rows, err
+			}
+			rows = append(rows, row)
+			start = end
+		}
+		return rows, nil
+	}
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range records {
+		row := &DataRow{}
+		if err := parseCsvLine(row, line); err != nil {
+			return rows, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// dataRowFields are the fields of an avro datum of DataRow in the order
+// they are written.
+var dataRowFields = avro.MustParseSchema(DataSchema).(*avro.RecordSchema).Fields
+
+// skipAvroRow returns the end of the datum starting at start, ints and
+// longs are zigzag varints, strings and bytes are prefixed by their length.
+func skipAvroRow(data []byte, start int) (int, error) {
+	pos := start
+	for _, field := range dataRowFields {
+		v, n := binary.Varint(data[pos:])
+		if n <= 0 {
+			return 0, fmt.Errorf("invalid avro %s at byte %d", field.Name, pos)
+		}
+		pos += n
+		switch field.Type.Type() {
+		case avro.String, avro.Bytes:
+			if v < 0 || v > int64(len(data)-pos) {
+				return 0, fmt.Errorf("invalid avro length %d of %s at byte %d", v, field.Name, pos)
+			}
+			pos += int(v)
+		}
+	}
+	return pos, nil
+}
+
+// parseCsvLine is the reverse of NewCsvLine.
+func parseCsvLine(row *DataRow, line []string) error {
+	value := reflect.ValueOf(row).Elem()
+	if len(line) != value.NumField() {
+		return fmt.Errorf("csv line has %d columns, expect %d", len(line), value.NumField())
+	}
+	for j := 0; j < value.NumField(); j++ {
+		name := value.Type().Field(j).Name
+		field := value.Field(j)
+		switch field.Kind() {
+		case reflect.Int32, reflect.Int64:
+			if strings.HasSuffix(name, "_ip") || strings.HasSuffix(name, "_ipv4") {
+				ip := net.ParseIP(line[j]).To4()
+				if ip == nil {
+					return fmt.Errorf("invalid ipv4 %q of %s", line[j], name)
 				}
-			case reflect.String:
-				v := fieldValue.(string)
-				line = append(line, v)
-				log.Tracef("%s match string item %d, val: %s", name, j, v)
-			case reflect.Slice:
-				// ipv6 address
-				tmp := fieldValue.([]byte)
-				v := Bytes2Ipv6(tmp)
-				line = append(line, v)
-				log.Tracef("%s match slice item %d, val: %s", name, j, v)
-			default:
-				v := "0"
-				line = append(line, v)
-				log.Tracef("%s match default item %d, val: %s", name, j, v)
+				field.SetInt(int64(ip[0])<<24 | int64(ip[1])<<16 | int64(ip[2])<<8 | int64(ip[3]))
+				continue
 			}
+			v, err := strconv.ParseInt(line[j], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid number %q of %s", line[j], name)
+			}
+			field.SetInt(v)
+		case reflect.String:
+			field.SetString(line[j])
+		case reflect.Slice:
+			field.SetBytes(net.ParseIP(line[j]))
+		}
+	}
+	return nil
+}
 
+// StreamRows generates rowNum rows in dataFmt and writes them to w,
+// flush is called after every rowsPerFlush rows and once at the end.
+func StreamRows(w io.Writer, dataFmt string, rowNum int, rowsPerFlush int, flush func() error) error {
+	if rowsPerFlush < 1 {
+		rowsPerFlush = rowNum
+	}
+	if dataFmt == "avro" {
+		schema := avro.MustParseSchema(DataSchema)
+		writer := avro.NewGenericDatumWriter()
+		writer.SetSchema(schema)
+		encoder := avro.NewBinaryEncoder(w)
+		for i := 1; i <= rowNum; i++ {
+			record := NewAvroRecord(schema, *NewDataRow())
+			if err := writer.Write(record, encoder); err != nil {
+				return err
+			}
+			if i%rowsPerFlush == 0 {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
 		}
-		records = append(records, line)
+		return flush()
 	}
-	writer.WriteAll(records)
-	return buffer
+	writer := csv.NewWriter(w)
+	for i := 1; i <= rowNum; i++ {
+		if err := writer.Write(NewCsvLine(*NewDataRow())); err != nil {
+			return err
+		}
+		if i%rowsPerFlush == 0 {
+			writer.Flush()
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return flush()
 }
 
 func PushMessage(conf *Config, ptrMap *map[string]*chan *bytes.Buffer) {
 	pipMap := *ptrMap
 	var msg []byte
 	bufSize := conf.MessageSize
-	if conf.DataFmt == "avro" {
+	if conf.HttpStreaming {
+		// rows are generated by the http handler while the request is in flight,
+		// an empty message only asks for one more request
+		for _, ptrPipe := range pipMap {
+			*ptrPipe <- &bytes.Buffer{}
+		}
+		return
+	} else if conf.DataFmt == "avro" {
 		buffer := Write2Avro(bufSize)
 		msg = buffer.Bytes()
 		buffer.Reset()
@@ -503,6 +710,20 @@ func sentByCli(conf *Config, buf *bytes.Buffer, h interface{}, chanOut *chan *St
 		h.(*HttpHandler).Do(conf, buf, chanOut)
 	case *KafkaHandler:
 		h.(*KafkaHandler).Do(conf, buf, chanOut)
+	case *NatsHandler:
+		h.(*NatsHandler).Do(conf, buf, chanOut)
+	case *RedisHandler:
+		h.(*RedisHandler).Do(conf, buf, chanOut)
+	case *MqttHandler:
+		h.(*MqttHandler).Do(conf, buf, chanOut)
+	case *SocketHandler:
+		h.(*SocketHandler).Do(conf, buf, chanOut)
+	case *S3Handler:
+		h.(*S3Handler).Do(conf, buf, chanOut)
+	case *OtlpHandler:
+		h.(*OtlpHandler).Do(conf, buf, chanOut)
+	case *WebSocketHandler:
+		h.(*WebSocketHandler).Do(conf, buf, chanOut)
 	default:
 		log.Fatalf("Unknow handler type %T", t)
 	}
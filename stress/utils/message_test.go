@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/csv"
+	"reflect"
+	"strings"
+	"testing"
+
+	avro "gopkg.in/avro.v0"
+)
+
+func TestDecodeRowsCsv(t *testing.T) {
+	var rows []*DataRow
+	buffer := &bytes.Buffer{}
+	writer := csv.NewWriter(buffer)
+	for i := 0; i < 5; i++ {
+		row := NewDataRow()
+		rows = append(rows, row)
+		writer.Write(NewCsvLine(*row))
+	}
+	writer.Flush()
+	decoded, err := DecodeRows("csv", buffer.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(rows) {
+		t.Fatalf("decoded %d rows, expect %d", len(decoded), len(rows))
+	}
+	for i := range rows {
+		// ipv6 columns may come back in their 16 byte form, the csv
+		// lines are the same
+		if line, expect := NewCsvLine(*decoded[i]), NewCsvLine(*rows[i]); !reflect.DeepEqual(line, expect) {
+			t.Errorf("row %d = %v, expect %v", i, line, expect)
+		}
+	}
+}
+
+func TestDecodeRowsAvro(t *testing.T) {
+	var rows []*DataRow
+	buffer := &bytes.Buffer{}
+	schema := avro.MustParseSchema(DataSchema)
+	writer := avro.NewGenericDatumWriter()
+	writer.SetSchema(schema)
+	encoder := avro.NewBinaryEncoder(buffer)
+	for i := 0; i < 5; i++ {
+		row := NewDataRow()
+		rows = append(rows, row)
+		if err := writer.Write(NewAvroRecord(schema, *row), encoder); err != nil {
+			t.Fatal(err)
+		}
+	}
+	decoded, err := DecodeRows("avro", buffer.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(rows) {
+		t.Fatalf("decoded %d rows, expect %d", len(decoded), len(rows))
+	}
+	for i := range rows {
+		if !reflect.DeepEqual(decoded[i], rows[i]) {
+			t.Errorf("row %d = %+v, expect %+v", i, decoded[i], rows[i])
+		}
+	}
+
+	if _, err := DecodeRows("avro", buffer.Bytes()[:buffer.Len()-1]); err == nil {
+		t.Error("truncated avro is decoded")
+	}
+}
+
+func TestDecodeRowsInvalidCsv(t *testing.T) {
+	line := NewCsvLine(*NewDataRow())
+	columns := len(line)
+	tests := map[string]func(line []string) []string{
+		"missing column": func(line []string) []string { return line[1:] },
+		"invalid number": func(line []string) []string { line[0] = "x"; return line },
+		"invalid ipv4":   func(line []string) []string { line[1] = "1.2.3"; return line },
+	}
+	for name, change := range tests {
+		changed := change(append([]string(nil), line...))
+		data := strings.Join(changed, ",") + "\n"
+		if _, err := DecodeRows("csv", []byte(data)); err == nil {
+			t.Errorf("%s of %d columns is decoded", name, columns)
+		}
+	}
+}
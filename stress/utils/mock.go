@@ -0,0 +1,223 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MockCounter counts the requests of a topic received by the mock dataproxy.
+type MockCounter struct {
+	Requests       int64 `json:"requests"`
+	Rows           int64 `json:"rows"`
+	Bytes          int64 `json:"bytes"` // body bytes after decompression
+	InjectedErrors int64 `json:"injected_errors"`
+	Rejected       int64 `json:"rejected"` // bodies failing to parse
+}
+
+// MockServer answers /dataload like dataproxy, the rows of each request
+// are parsed and counted per topic.
+type MockServer struct {
+	Conf      *Config
+	StartTime time.Time
+	lock      sync.Mutex
+	counters  map[string]*MockCounter
+}
+
+func NewMockServer(conf *Config) *MockServer {
+	return &MockServer{
+		Conf:      conf,
+		StartTime: time.Now(),
+		counters:  make(map[string]*MockCounter),
+	}
+}
+
+// count updates the counter of topic under the lock.
+func (m *MockServer) count(topic string, update func(counter *MockCounter)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	counter, ok := m.counters[topic]
+	if !ok {
+		counter = &MockCounter{}
+		m.counters[topic] = counter
+	}
+	counter.Requests += 1
+	update(counter)
+}
+
+func (m *MockServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/dataload":
+		m.dataload(w, r)
+	case "/stats":
+		m.stats(w)
+	case "/health":
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// delay sleeps mock.latency plus a random part of mock.latencyjitter.
+func (m *MockServer) delay() {
+	latency := time.Duration(m.Conf.MockLatency) * time.Millisecond
+	if m.Conf.MockLatencyJitter > 0 {
+		latency += time.Duration(rand.Intn(m.Conf.MockLatencyJitter+1)) * time.Millisecond
+	}
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+}
+
+// injectError returns the status code of a failed request picked with
+// mock.errorrate, 0 to answer the request normally.
+func (m *MockServer) injectError() int {
+	if m.Conf.MockErrorRate <= 0 || rand.Float64() >= m.Conf.MockErrorRate {
+		return 0
+	}
+	return m.Conf.MockErrorStatus[rand.Intn(len(m.Conf.MockErrorStatus))]
+}
+
+func (m *MockServer) dataload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	topic := r.URL.Query().Get("topic")
+	if topic == "" {
+		http.Error(w, "missing topic", http.StatusBadRequest)
+		return
+	}
+	// the body is read first, a client failing in the middle of the
+	// upload is not answered with an injected error
+	reader, err := NewDecompressReader(r.Header.Get("Content-Encoding"), r.Body)
+	var data []byte
+	if err == nil {
+		data, err = io.ReadAll(reader)
+		reader.Close()
+	}
+	m.delay()
+	if err != nil {
+		m.count(topic, func(counter *MockCounter) { counter.Rejected += 1 })
+		log.Debugf("Read request of topic %s with error, %v", topic, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if code := m.injectError(); code != 0 {
+		m.count(topic, func(counter *MockCounter) { counter.InjectedErrors += 1 })
+		if m.Conf.MockRetryAfter > 0 && (code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable) {
+			w.Header().Set("Retry-After", strconv.Itoa(m.Conf.MockRetryAfter))
+		}
+		http.Error(w, "injected error", code)
+		return
+	}
+	// the sender names the format of the body in Context-Type
+	dataFmt := r.Header.Get("Context-Type")
+	if dataFmt == "" {
+		dataFmt = m.Conf.DataFmt
+	}
+	var rows []*DataRow
+	if dataFmt != "csv" && dataFmt != "avro" {
+		err = fmt.Errorf("unsupported Context-Type %s", dataFmt)
+	} else {
+		rows, err = DecodeRows(dataFmt, data)
+	}
+	if err != nil {
+		m.count(topic, func(counter *MockCounter) { counter.Rejected += 1 })
+		log.Debugf("Parse request of topic %s with error, %v", topic, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.count(topic, func(counter *MockCounter) {
+		counter.Rows += int64(len(rows))
+		counter.Bytes += int64(len(data))
+	})
+	w.WriteHeader(http.StatusOK)
+}
+
+// snapshot returns a copy of the counters.
+func (m *MockServer) snapshot() map[string]MockCounter {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	counters := make(map[string]MockCounter, len(m.counters))
+	for topic, counter := range m.counters {
+		counters[topic] = *counter
+	}
+	return counters
+}
+
+func (m *MockServer) stats(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.snapshot())
+}
+
+// Print prints the counters per topic, the rows are compared with
+// Transmit Successful Rows of the client report.
+func (m *MockServer) Print() {
+	counters := m.snapshot()
+	topics := make([]string, 0, len(counters))
+	for topic := range counters {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	lines := []string{
+		fmt.Sprintf("==============Mock dataproxy, up %.3f s======================", time.Since(m.StartTime).Seconds()),
+		fmt.Sprintf("%-30s %10s %14s %16s %10s %10s", "Topic", "Requests", "Rows", "Bytes", "Injected", "Rejected"),
+	}
+	for _, topic := range topics {
+		c := counters[topic]
+		lines = append(lines, fmt.Sprintf("%-30s %10d %14d %16d %10d %10d", topic, c.Requests, c.Rows, c.Bytes, c.InjectedErrors, c.Rejected))
+	}
+	for _, line := range lines {
+		log.Infoln(line)
+	}
+	fmt.Println(strings.Join(lines, "\n"))
+}
+
+// ServeMock runs the mock dataproxy of the [mock] section until the
+// process is interrupted, the counters are printed at exit.
+func ServeMock(conf *Config) {
+	conf.ValidateMock()
+	mock := NewMockServer(conf)
+	server := &http.Server{Addr: conf.MockListen, Handler: mock}
+	// with tls http/2 is negotiated by alpn
+	if conf.MockCertFile == "" {
+		enableServerH2c(server)
+	}
+	if conf.MockStatsInterval > 0 {
+		go func() {
+			for range time.Tick(time.Duration(conf.MockStatsInterval) * time.Second) {
+				mock.Print()
+			}
+		}()
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		server.Close()
+	}()
+	log.Infof("Mock dataproxy listening on %s", conf.MockListen)
+	var err error
+	if conf.MockCertFile != "" {
+		err = server.ListenAndServeTLS(conf.MockCertFile, conf.MockKeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatalf("Serve mock dataproxy on %s with error %v", conf.MockListen, err)
+	}
+	mock.Print()
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"bytes"
+	"fmt"
 	//"runtime"
 	//"context"
 	"sync"
@@ -12,6 +13,74 @@ import (
 	//"golang.org/x/time/rate"
 )
 
+// RunSinks sends the messages of the test to every sink of conf and returns
+// the reports of each sink by topic once all sinks are done.
+func RunSinks(conf *Config) []map[string]*Report {
+	log.Println(fmt.Sprintf("PoolSize: %v", conf.Threads))
+	consumerPoolSize := conf.Threads
+	producerPoolSize := consumerPoolSize * 2
+	capStatisChan := conf.Threads
+
+	//make a channel to send timeout signal
+	timeout := conf.RunTimeout * float64(time.Minute)
+	produceCtl := time.After(time.Duration(timeout))
+	if conf.RunTimeout > 0 {
+		log.Infof("Process will exit after %v Minute", conf.RunTimeout)
+	}
+
+	//map to keep channel ptr for each topic of each sink, the producer
+	//puts every message to all of them
+	chanPipes := make(map[string]*chan *bytes.Buffer)
+
+	// every sink of test.usemethods consumes its own pipes and
+	// counts its own reports
+	sinks := conf.SinkConfs()
+	sinkReports := make([]map[string]*Report, len(sinks))
+	var wg sync.WaitGroup
+	for i, sink := range sinks {
+		// make chan to recive statis records
+		chanStatis := make(chan *Statistician, capStatisChan)
+
+		// make to save report for each topic
+		reports := make(map[string]*Report)
+		sinkPipes := make(map[string]*chan *bytes.Buffer)
+		consumerCtlMap := make(map[string]*<-chan time.Time)
+		for _, topic := range conf.Topics {
+			ctlChan := time.After(time.Duration(timeout))
+			pipe := make(chan *bytes.Buffer, producerPoolSize+1)
+			sinkPipes[topic] = &pipe
+			chanPipes[fmt.Sprintf("%d/%s", sink.MethodId, topic)] = &pipe
+			report := NewReport(topic, sink, &chanStatis)
+			if len(sinks) > 1 {
+				report.Sink = MethodNames[sink.MethodId]
+			}
+			reports[topic] = report
+			consumerCtlMap[topic] = &ctlChan
+		}
+		sinkReports[i] = reports
+
+		wg.Add(1)
+		go func(sink *Config) {
+			defer wg.Done()
+			//Start go routine to consume elements in channel chanStatis
+			//to avoid process blocked after chanStatis is full
+			calcDone := make(chan struct{})
+			go func() {
+				Calc(&reports, &chanStatis)
+				close(calcDone)
+			}()
+			// collect statis records, calculate and print summary
+			Consumer4Topics(sink, &chanStatis, &sinkPipes, &reports, &consumerCtlMap, consumerPoolSize)
+			// wait until the last statis records are counted
+			<-calcDone
+		}(sink)
+	}
+
+	go DataProducer(conf, &chanPipes, &produceCtl, producerPoolSize)
+	wg.Wait()
+	return sinkReports
+}
+
 func Consumer4Topics(conf *Config, ptrChanStatis *chan *Statistician, ptrMapChanPipes *map[string]*chan *bytes.Buffer, ptrMapReports *map[string]*Report, ptrCtlChans *map[string]*<-chan time.Time, poolSize int) {
 	var wg sync.WaitGroup
 
@@ -28,6 +97,18 @@ func Consumer4Topics(conf *Config, ptrChanStatis *chan *Statistician, ptrMapChan
 			var pipe = mapChanPipes[topic]
 			DataConsumer(conf, topic, ptrChanStatis, pipe, ctlChan, poolSize)
 			mapReports[topic].EndTime = time.Now()
+			if conf.MethodId == MethodKafka {
+				// the workers of the topic are done with the shared writer
+				if err := CloseKafkaWriter(conf, topic); err != nil {
+					log.Errorf("Close kafka writer of topic %s with error, %v", topic, err)
+				}
+			}
+			// the producer puts every message to the pipes of all sinks,
+			// it must not block on the pipe of a stopped consumer
+			go func() {
+				for range *pipe {
+				}
+			}()
 			wg.Done()
 			log.Debugf("Test done for topic %s!", topic)
 		}(topic)
@@ -81,8 +162,8 @@ func DataProducer(conf *Config, mpPipe *map[string]*chan *bytes.Buffer, ptrCtlCh
 	}
 ForEnd:
 	wg.Wait()
-	for _, topic := range conf.Topics {
-		ch := (*mpPipe)[topic]
+	// the pipes of all topics of all sinks
+	for _, ch := range *mpPipe {
 		close(*ch)
 	}
 	log.Debugln("Put data to channel done!")
@@ -95,10 +176,44 @@ func DataConsumer(conf *Config, topic string, out *chan *Statistician, pipe *cha
 	pool, err := ants.NewPoolWithFunc(
 		poolSize,
 		func(i interface{}) {
-			if conf.MethodId == 1 {
+			switch conf.MethodId {
+			case MethodDataproxy:
 				handler := NewHttpHandler(topic, conf)
 				SendMessage(conf, pipe, handler, out)
-			} else {
+			case MethodIngest:
+				handler := NewIngestHandler(topic, conf)
+				SendMessage(conf, pipe, handler, out)
+			case MethodBulk:
+				handler := NewBulkHandler(topic, conf)
+				SendMessage(conf, pipe, handler, out)
+			case MethodClickHouse:
+				handler := NewClickHouseHandler(topic, conf)
+				SendMessage(conf, pipe, handler, out)
+			case MethodNats:
+				handler := NewNatsHandler(topic, conf)
+				SendMessage(conf, pipe, handler, out)
+			case MethodRedis:
+				handler := NewRedisHandler(topic, conf)
+				SendMessage(conf, pipe, handler, out)
+			case MethodMqtt:
+				handler := NewMqttHandler(topic, conf)
+				SendMessage(conf, pipe, handler, out)
+			case MethodTcp, MethodUdp, MethodSyslog:
+				handler := NewSocketHandler(topic, conf)
+				SendMessage(conf, pipe, handler, out)
+			case MethodS3:
+				handler := NewS3Handler(topic, conf)
+				SendMessage(conf, pipe, handler, out)
+			case MethodRemoteWrite:
+				handler := NewRemoteWriteHandler(topic, conf)
+				SendMessage(conf, pipe, handler, out)
+			case MethodOtlp:
+				handler := NewOtlpHandler(topic, conf)
+				SendMessage(conf, pipe, handler, out)
+			case MethodWebSocket:
+				handler := NewWebSocketHandler(topic, conf)
+				SendMessage(conf, pipe, handler, out)
+			default:
 				handler := NewKafkaHandler(topic, conf)
 				SendMessage(conf, pipe, handler, out)
 			}
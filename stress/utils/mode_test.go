@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// TestRunSinks sends the messages of a test to the dataproxy mock and the
+// kafka mock at once, both sinks get the same messages.
+func TestRunSinks(t *testing.T) {
+	mock := NewMockServer(&Config{DataFmt: "csv"})
+	var lock sync.Mutex
+	var posted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		posted = append(posted, string(body))
+		lock.Unlock()
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		mock.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	kafkaMock, addr := startKafkaMock(t)
+
+	conf := testConf(t, fmt.Sprintf(`
+[required]
+eip=%q
+brokerips=[%q]
+topics=["t1"]
+recordnum=10
+sndnum=6
+threadsnum=2
+datafmt="csv"
+[test]
+usemethods=[1,2]
+`, strings.TrimPrefix(server.URL, "http://"), addr))
+	sinkReports := RunSinks(conf)
+
+	if len(sinkReports) != 2 {
+		t.Fatalf("%d sinks reported", len(sinkReports))
+	}
+	for i, sink := range []string{"dataproxy", "kafka"} {
+		report := sinkReports[i]["t1"]
+		if report.Sink != sink || report.SussfulRequests != 6 || report.SuccessfulRows != 60 || report.FailedRequests != 0 {
+			t.Errorf("sink %s: %+v", sink, report)
+		}
+	}
+	if counter := mock.snapshot()["t1"]; counter.Requests != 6 || counter.Rows != 60 {
+		t.Errorf("dataproxy mock counted %+v", counter)
+	}
+	kafkaMock.lock.Lock()
+	counter := *kafkaMock.counters["t1"]
+	kafkaMock.lock.Unlock()
+	if counter.Messages != 6 || counter.Rows != 60 {
+		t.Errorf("kafka mock counted %+v", counter)
+	}
+
+	var produced []string
+	for partition := 0; partition < 2; partition++ {
+		reader := kafka.NewReader(kafka.ReaderConfig{Brokers: []string{addr}, Topic: "t1", Partition: partition, MaxWait: 100 * time.Millisecond})
+		end, err := reader.ReadLag(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < end; i++ {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			message, err := reader.ReadMessage(ctx)
+			cancel()
+			if err != nil {
+				t.Fatalf("read partition %d: %v", partition, err)
+			}
+			produced = append(produced, string(message.Value))
+		}
+		reader.Close()
+	}
+	sort.Strings(posted)
+	sort.Strings(produced)
+	if len(produced) != 6 || strings.Join(posted, "|") != strings.Join(produced, "|") {
+		t.Errorf("dataproxy got %d messages, kafka %d, they differ", len(posted), len(produced))
+	}
+
+	lines := SinkComparison(sinkReports)
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], "dataproxy ") || !strings.HasPrefix(lines[3], "kafka ") {
+		t.Errorf("comparison:\n%s", strings.Join(lines, "\n"))
+	}
+}
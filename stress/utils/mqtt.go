@@ -0,0 +1,503 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	mqttLock  sync.Mutex
+	mqttConns []*MqttConn
+	mqttNext  uint64
+)
+
+// mqtt control packet types, the high nibble of the fixed header
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttPubrec     = 5
+	mqttPubrel     = 6
+	mqttPubcomp    = 7
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+// mqttReasons names the reason codes reported by brokers, codes of
+// mqtt 3.1.1 CONNACK use the same names.
+var mqttReasons = map[byte]string{
+	0x01: "unacceptable_protocol_version",
+	0x02: "identifier_rejected",
+	0x03: "server_unavailable",
+	0x04: "bad_user_name_or_password",
+	0x05: "not_authorized",
+	0x80: "unspecified_error",
+	0x81: "malformed_packet",
+	0x82: "protocol_error",
+	0x83: "implementation_specific_error",
+	0x84: "unsupported_protocol_version",
+	0x86: "bad_user_name_or_password",
+	0x87: "not_authorized",
+	0x88: "server_unavailable",
+	0x89: "server_busy",
+	0x8D: "keep_alive_timeout",
+	0x90: "topic_name_invalid",
+	0x91: "packet_identifier_in_use",
+	0x93: "receive_maximum_exceeded",
+	0x95: "packet_too_large",
+	0x96: "message_rate_too_high",
+	0x97: "quota_exceeded",
+	0x99: "payload_format_invalid",
+	0x9F: "connection_rate_exceeded",
+}
+
+// mqttReasonError converts a failure reason code of an ack or CONNACK.
+func mqttReasonError(packet string, code byte) error {
+	name, ok := mqttReasons[code]
+	if !ok {
+		name = fmt.Sprintf("0x%02x", code)
+	}
+	return &SinkError{Reason: "mqtt_" + name, Message: fmt.Sprintf("%s with reason code 0x%02x", packet, code)}
+}
+
+// mqttWriteString writes a length prefixed utf-8 string.
+func mqttWriteString(buffer *bytes.Buffer, s string) {
+	binary.Write(buffer, binary.BigEndian, uint16(len(s)))
+	buffer.WriteString(s)
+}
+
+// mqttWritePacket writes a control packet with the remaining length encoded
+// as variable byte integer.
+func mqttWritePacket(w io.Writer, header byte, body ...[]byte) error {
+	size := 0
+	for _, part := range body {
+		size += len(part)
+	}
+	packet := []byte{header}
+	for {
+		digit := byte(size % 128)
+		size /= 128
+		if size > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if size == 0 {
+			break
+		}
+	}
+	if _, err := w.Write(packet); err != nil {
+		return err
+	}
+	for _, part := range body {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mqttReadPacket reads a control packet and returns its first header byte and body.
+func mqttReadPacket(reader *bufio.Reader) (byte, []byte, error) {
+	header, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	size, multiplier := 0, 1
+	for i := 0; ; i++ {
+		digit, err := reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		size += int(digit&0x7F) * multiplier
+		multiplier *= 128
+		if digit&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, fmt.Errorf("malformed mqtt remaining length")
+		}
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+// MqttConn is a client connection to the broker shared by the workers of
+// the mqtt sink, acks are read by its own goroutine.
+type MqttConn struct {
+	sync.Mutex
+	conf     *Config
+	clientId string
+	conn     net.Conn
+	writer   *bufio.Writer
+	nextId   uint16
+	inflight chan struct{}
+	pendLock sync.Mutex
+	pending  map[uint16]chan error
+}
+
+func newMqttConn(conf *Config, i int) *MqttConn {
+	return &MqttConn{
+		conf:     conf,
+		clientId: fmt.Sprintf("%s-%s-%d", conf.MqttClientId, conf.RunId, i),
+		inflight: make(chan struct{}, conf.MqttMaxInflight),
+		pending:  make(map[uint16]chan error),
+	}
+}
+
+func (c *MqttConn) v5() bool {
+	return c.conf.MqttVersion == "5"
+}
+
+// connect dials the broker and waits for CONNACK, the caller holds the lock.
+func (c *MqttConn) connect() error {
+	// the url is checked by Validate
+	u, _ := url.Parse(c.conf.MqttUrl)
+	conn, err := DialSink(c.conf, u.Host, u.Scheme == "mqtts")
+	if err != nil {
+		return err
+	}
+
+	var user, password string
+	auth := SharedAuthenticator("mqtt", "none", c.conf)
+	switch auth.Mode {
+	case "basic", "header":
+		cred := auth.Next()
+		user, password = cred.User, cred.Password
+	case "bearer":
+		if password, err = auth.token.Token(); err != nil {
+			conn.Close()
+			return err
+		}
+		user = auth.Next().User
+	}
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	body := &bytes.Buffer{}
+	mqttWriteString(body, "MQTT")
+	flags := byte(0x02) // clean session
+	if c.v5() {
+		body.WriteByte(5)
+	} else {
+		body.WriteByte(4)
+	}
+	if user != "" {
+		flags |= 0x80
+		if password != "" {
+			flags |= 0x40
+		}
+	}
+	body.WriteByte(flags)
+	binary.Write(body, binary.BigEndian, uint16(c.conf.MqttKeepAlive))
+	if c.v5() {
+		body.WriteByte(0) // no properties
+	}
+	mqttWriteString(body, c.clientId)
+	if user != "" {
+		mqttWriteString(body, user)
+		if password != "" {
+			mqttWriteString(body, password)
+		}
+	}
+	conn.SetDeadline(time.Now().Add(time.Duration(c.conf.HttpDialTimeout) * time.Second))
+	if err := mqttWritePacket(conn, mqttConnect<<4, body.Bytes()); err != nil {
+		conn.Close()
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	header, ack, err := mqttReadPacket(reader)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	if header>>4 != mqttConnack || len(ack) < 2 {
+		conn.Close()
+		return fmt.Errorf("expect CONNACK from mqtt broker, got packet type %d", header>>4)
+	}
+	if ack[1] != 0 {
+		conn.Close()
+		return mqttReasonError("CONNACK", ack[1])
+	}
+	c.conn = conn
+	c.writer = bufio.NewWriterSize(conn, 64*1024)
+	done := make(chan struct{})
+	go c.readLoop(conn, reader, done)
+	go c.keepAlive(conn, done)
+	log.Debugf("Connected to mqtt broker %s as %s", u.Host, c.clientId)
+	return nil
+}
+
+// keepAlive sends PINGREQ at half of the keep alive interval.
+func (c *MqttConn) keepAlive(conn net.Conn, done chan struct{}) {
+	if c.conf.MqttKeepAlive == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(c.conf.MqttKeepAlive) * time.Second / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			c.Lock()
+			var err error
+			if c.conn == conn {
+				if err = mqttWritePacket(c.writer, mqttPingreq<<4); err == nil {
+					err = c.writer.Flush()
+				}
+			}
+			c.Unlock()
+			if err != nil {
+				c.fail(conn, err)
+				return
+			}
+		}
+	}
+}
+
+// readLoop completes the publishes acked by the broker, PUBREC of QoS 2 is
+// answered with PUBREL and the publish completes at PUBCOMP.
+func (c *MqttConn) readLoop(conn net.Conn, reader *bufio.Reader, done chan struct{}) {
+	defer close(done)
+	for {
+		header, body, err := mqttReadPacket(reader)
+		if err != nil {
+			c.fail(conn, err)
+			return
+		}
+		packetType := header >> 4
+		switch packetType {
+		case mqttPuback, mqttPubrec, mqttPubcomp:
+			if len(body) < 2 {
+				c.fail(conn, fmt.Errorf("malformed mqtt ack"))
+				return
+			}
+			id := binary.BigEndian.Uint16(body)
+			var reason byte
+			if len(body) > 2 {
+				reason = body[2]
+			}
+			if packetType == mqttPubrec && reason < 0x80 {
+				c.Lock()
+				if c.conn == conn {
+					if err = mqttWritePacket(c.writer, mqttPubrel<<4|0x02, body[:2]); err == nil {
+						err = c.writer.Flush()
+					}
+				}
+				c.Unlock()
+				if err != nil {
+					c.fail(conn, err)
+					return
+				}
+				continue
+			}
+			if reason >= 0x80 {
+				err = mqttReasonError(map[byte]string{mqttPuback: "PUBACK", mqttPubrec: "PUBREC", mqttPubcomp: "PUBCOMP"}[packetType], reason)
+			}
+			c.pendLock.Lock()
+			reply, ok := c.pending[id]
+			delete(c.pending, id)
+			c.pendLock.Unlock()
+			if ok {
+				reply <- err
+			}
+		case mqttDisconnect:
+			err = errors.New("disconnected by mqtt broker")
+			if len(body) > 0 && body[0] >= 0x80 {
+				err = mqttReasonError("DISCONNECT", body[0])
+			}
+			c.fail(conn, err)
+			return
+		case mqttPingresp:
+		default:
+			log.Debugf("Ignore mqtt packet type %d", packetType)
+		}
+	}
+}
+
+// fail closes conn if it is still in use, the next publish connects again.
+func (c *MqttConn) fail(conn net.Conn, err error) {
+	c.Lock()
+	if c.conn == conn {
+		c.conn = nil
+		c.writer = nil
+		conn.Close()
+		log.Errorf("Mqtt connection closed with error, %v", err)
+	}
+	c.Unlock()
+	c.pendLock.Lock()
+	defer c.pendLock.Unlock()
+	for id, reply := range c.pending {
+		reply <- err
+		delete(c.pending, id)
+	}
+}
+
+// allocateId returns a packet id not waiting for its ack, ids of given up
+// publishes stay in use until their ack arrives. The caller holds the lock.
+func (c *MqttConn) allocateId() (uint16, bool) {
+	c.pendLock.Lock()
+	defer c.pendLock.Unlock()
+	for i := 0; i < 65535; i++ {
+		c.nextId += 1
+		if c.nextId == 0 {
+			c.nextId = 1
+		}
+		if _, used := c.pending[c.nextId]; !used {
+			return c.nextId, true
+		}
+	}
+	return 0, false
+}
+
+// Publish sends data to topic with mqtt.qos and waits for PUBACK or PUBCOMP.
+func (c *MqttConn) Publish(topic string, data []byte, statis *Statistician) error {
+	c.inflight <- struct{}{}
+	defer func() { <-c.inflight }()
+
+	c.Lock()
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			c.Unlock()
+			return err
+		}
+		statis.ConnOpened = true
+	} else {
+		statis.ConnReused = true
+	}
+	qos := byte(c.conf.MqttQos)
+	header := mqttPublish<<4 | qos<<1
+	if c.conf.MqttRetain {
+		header |= 0x01
+	}
+	variable := &bytes.Buffer{}
+	mqttWriteString(variable, topic)
+	var reply chan error
+	var id uint16
+	if qos > 0 {
+		var ok bool
+		if id, ok = c.allocateId(); !ok {
+			c.Unlock()
+			return &SinkError{Reason: "mqtt_no_packet_id", Message: "all packet ids are waiting for acks"}
+		}
+		binary.Write(variable, binary.BigEndian, id)
+		reply = make(chan error, 1)
+		c.pendLock.Lock()
+		c.pending[id] = reply
+		c.pendLock.Unlock()
+	}
+	if c.v5() {
+		variable.WriteByte(0) // no properties
+	}
+	err := mqttWritePacket(c.writer, header, variable.Bytes(), data)
+	if err == nil {
+		err = c.writer.Flush()
+	}
+	statis.WireBytes = int64(variable.Len() + len(data))
+	conn := c.conn
+	c.Unlock()
+	if err != nil {
+		c.fail(conn, err)
+		return err
+	}
+	if reply == nil {
+		return nil
+	}
+
+	ackStart := time.Now()
+	timer := time.NewTimer(time.Duration(c.conf.MqttAckTimeout) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case err = <-reply:
+		statis.AckTime = time.Since(ackStart).Microseconds()
+		return err
+	case <-timer.C:
+		return fmt.Errorf("wait for ack of packet %d: %w", id, context.DeadlineExceeded)
+	}
+}
+
+// SharedMqttConn returns the next client of the mqtt sink, messages are
+// spread round robin over mqtt.connections clients. They are built from
+// the config of the mqtt sink, the only one using them.
+func SharedMqttConn(conf *Config) *MqttConn {
+	mqttLock.Lock()
+	if mqttConns == nil {
+		for i := 0; i < conf.MqttConnections; i++ {
+			mqttConns = append(mqttConns, newMqttConn(conf, i))
+		}
+	}
+	mqttLock.Unlock()
+	i := atomic.AddUint64(&mqttNext, 1) - 1
+	return mqttConns[i%uint64(len(mqttConns))]
+}
+
+// parseMqttTopic parses the topic name template of the [mqtt] section.
+func parseMqttTopic(conf *Config) (*template.Template, error) {
+	return template.New("topic").Option("missingkey=error").Parse(conf.MqttTopic)
+}
+
+// MqttTopic returns the mqtt topic of topic, a name given in mqtt.topics
+// wins over the mqtt.topic template.
+func MqttTopic(topic string, conf *Config) (string, error) {
+	tmpl, err := parseMqttTopic(conf)
+	if err != nil {
+		return "", err
+	}
+	return TopicName(topic, conf, conf.MqttTopics, tmpl)
+}
+
+type MqttHandler struct {
+	Topic     string
+	MqttTopic string
+	Conf      *Config
+	Conn      *MqttConn
+}
+
+func NewMqttHandler(topic string, conf *Config) *MqttHandler {
+	// the template is checked by Validate
+	mqttTopic, _ := MqttTopic(topic, conf)
+	return &MqttHandler{
+		Topic:     topic,
+		MqttTopic: mqttTopic,
+		Conf:      conf,
+		Conn:      SharedMqttConn(conf),
+	}
+}
+
+func (m *MqttHandler) Do(conf *Config, data *bytes.Buffer, chanOut *chan *Statistician) {
+	statis := NewStatistician(m.Topic)
+	startTime := time.Now()
+	err := m.Conn.Publish(m.MqttTopic, data.Bytes(), statis)
+	statis.SentTime = time.Since(startTime).Milliseconds()
+	if err != nil {
+		log.Errorf("Publish message to mqtt with error, %v", err)
+		statis.State = false
+		statis.Reason = ClassifyError(err)
+		statis.Error = err.Error()
+	} else {
+		statis.State = true
+		statis.Reason = "ok"
+		statis.SentBytes = int64(data.Len())
+	}
+	*chanOut <- statis
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+// the remaining lengths are the boundaries of the variable byte integer
+// table of the mqtt specification
+func TestMqttWritePacket(t *testing.T) {
+	tests := []struct {
+		size   int
+		length []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7F}},
+		{128, []byte{0x80, 0x01}},
+		{16383, []byte{0xFF, 0x7F}},
+		{16384, []byte{0x80, 0x80, 0x01}},
+		{2097151, []byte{0xFF, 0xFF, 0x7F}},
+		{2097152, []byte{0x80, 0x80, 0x80, 0x01}},
+	}
+	for _, test := range tests {
+		body := bytes.Repeat([]byte{'x'}, test.size)
+		buffer := &bytes.Buffer{}
+		// the body may be given in parts
+		half := test.size / 2
+		if err := mqttWritePacket(buffer, mqttPublish<<4|1<<1, body[:half], body[half:]); err != nil {
+			t.Fatal(err)
+		}
+		packet := buffer.Bytes()
+		if packet[0] != 0x32 || !bytes.Equal(packet[1:1+len(test.length)], test.length) || len(packet) != 1+len(test.length)+test.size {
+			t.Errorf("size %d has header % x", test.size, packet[:1+len(test.length)])
+			continue
+		}
+		header, read, err := mqttReadPacket(bufio.NewReader(buffer))
+		if err != nil || header != 0x32 || !bytes.Equal(read, body) {
+			t.Errorf("size %d reads back %x, %d bytes, %v", test.size, header, len(read), err)
+		}
+	}
+}
+
+func TestMqttReadPacketMalformed(t *testing.T) {
+	for _, packet := range [][]byte{
+		{0x40, 0x80, 0x80, 0x80, 0x80, 0x01}, // five length bytes
+		{0x40, 0x02, 0x00},                   // short body
+		{0x40},
+	} {
+		if _, _, err := mqttReadPacket(bufio.NewReader(bytes.NewReader(packet))); err == nil {
+			t.Errorf("mqttReadPacket(% x) is accepted", packet)
+		}
+	}
+}
+
+func TestMqttWriteString(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	mqttWriteString(buffer, "MQTT")
+	if expect := []byte{0x00, 0x04, 'M', 'Q', 'T', 'T'}; !bytes.Equal(buffer.Bytes(), expect) {
+		t.Errorf("mqttWriteString = % x, expect % x", buffer.Bytes(), expect)
+	}
+}
+
+func TestMqttReasonError(t *testing.T) {
+	tests := map[byte]string{
+		0x05: "mqtt_not_authorized",
+		0x87: "mqtt_not_authorized",
+		0x97: "mqtt_quota_exceeded",
+		0x42: "mqtt_0x42",
+	}
+	for code, reason := range tests {
+		if got := ClassifyError(mqttReasonError("PUBACK", code)); got != reason {
+			t.Errorf("reason code 0x%02x = %s, expect %s", code, got, reason)
+		}
+	}
+}
@@ -0,0 +1,475 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	natsLock  sync.Mutex
+	natsConns []*NatsConn
+	natsNext  uint64
+)
+
+// natsInfo is the part of the INFO sent by the server used by the client.
+type natsInfo struct {
+	MaxPayload  int64 `json:"max_payload"`
+	Headers     bool  `json:"headers"`
+	TlsRequired bool  `json:"tls_required"`
+}
+
+// natsAck is the reply of the stream to a JetStream publish.
+type natsAck struct {
+	Stream    string `json:"stream"`
+	Seq       uint64 `json:"seq"`
+	Duplicate bool   `json:"duplicate"`
+	Error     *struct {
+		Code        int    `json:"code"`
+		ErrCode     int    `json:"err_code"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+type natsReply struct {
+	ack *natsAck
+	err error
+}
+
+// NatsConn is a connection to the NATS server shared by the workers of the
+// nats sink, it is dialed on first use and again after it broke.
+type NatsConn struct {
+	sync.Mutex
+	conf     *Config
+	conn     net.Conn
+	writer   *bufio.Writer
+	info     natsInfo
+	inbox    string
+	next     uint64
+	inflight chan struct{}
+	pendLock sync.Mutex
+	pending  map[string]chan *natsReply
+}
+
+func newNatsConn(conf *Config) *NatsConn {
+	return &NatsConn{
+		conf:     conf,
+		inbox:    "_INBOX." + RandStr(8),
+		inflight: make(chan struct{}, conf.NatsMaxInflight),
+		pending:  make(map[string]chan *natsReply),
+	}
+}
+
+// natsServerError converts a -ERR line of the server.
+func natsServerError(line string) error {
+	message := strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, "-ERR")), "'")
+	reason := strings.ToLower(message)
+	if i := strings.Index(reason, " for "); i > 0 {
+		reason = reason[:i]
+	}
+	return &SinkError{Reason: "nats_" + strings.ReplaceAll(reason, " ", "_"), Message: message}
+}
+
+// connect dials the server and sends CONNECT, the caller holds the lock.
+func (c *NatsConn) connect() error {
+	// the url is checked by Validate
+	u, _ := url.Parse(c.conf.NatsUrl)
+	conn, err := DialSink(c.conf, u.Host, false)
+	if err != nil {
+		return err
+	}
+	return c.handshake(conn, u)
+}
+
+// handshake reads the INFO of the server on conn and sends CONNECT, conn
+// is closed if it fails.
+func (c *NatsConn) handshake(conn net.Conn, u *url.URL) error {
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("expect INFO from nats server, got %q", strings.TrimSpace(line))
+	}
+	c.info = natsInfo{}
+	if err := json.Unmarshal([]byte(line[5:]), &c.info); err != nil {
+		conn.Close()
+		return err
+	}
+	if len(c.conf.NatsHeaders) > 0 && !c.info.Headers {
+		// the server would close the connection on every HPUB
+		conn.Close()
+		return &SinkError{Reason: "nats_no_headers", Message: "nats server does not support headers, remove nats.headers"}
+	}
+	if u.Scheme == "tls" || c.info.TlsRequired {
+		var err error
+		if conn, err = StartTls(c.conf, conn, u.Host); err != nil {
+			return err
+		}
+		reader = bufio.NewReader(conn)
+	}
+
+	options := map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"headers":       true,
+		"no_responders": true,
+		"name":          "stress",
+		"lang":          "go",
+		"protocol":      1,
+	}
+	auth := SharedAuthenticator("nats", "none", c.conf)
+	switch auth.Mode {
+	case "basic", "header":
+		cred := auth.Next()
+		options["user"] = cred.User
+		options["pass"] = cred.Password
+	case "bearer":
+		token, err := auth.token.Token()
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		options["auth_token"] = token
+	}
+	if u.User != nil {
+		options["user"] = u.User.Username()
+		options["pass"], _ = u.User.Password()
+	}
+	connect, _ := json.Marshal(options)
+	writer := bufio.NewWriterSize(conn, 64*1024)
+	fmt.Fprintf(writer, "CONNECT %s\r\n", connect)
+	if c.conf.NatsJetStream {
+		fmt.Fprintf(writer, "SUB %s.* 1\r\n", c.inbox)
+	}
+	writer.WriteString("PING\r\n")
+	if err := writer.Flush(); err != nil {
+		conn.Close()
+		return err
+	}
+	// the server answers PONG once CONNECT and SUB are accepted
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return natsServerError(line)
+		}
+	}
+	c.conn = conn
+	c.writer = writer
+	go c.readLoop(conn, reader)
+	log.Debugf("Connected to nats server %s", u.Host)
+	return nil
+}
+
+// readLoop answers the PINGs of the server and hands acks to the waiting publishers.
+func (c *NatsConn) readLoop(conn net.Conn, reader *bufio.Reader) {
+	var serverErr error
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if serverErr != nil {
+				// the server closed the connection because of the error
+				err = serverErr
+			}
+			c.fail(conn, err)
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "PING":
+			c.Lock()
+			if c.conn == conn {
+				c.writer.WriteString("PONG\r\n")
+				c.writer.Flush()
+			}
+			c.Unlock()
+		case strings.HasPrefix(line, "MSG "), strings.HasPrefix(line, "HMSG "):
+			if err := c.deliver(line, reader); err != nil {
+				c.fail(conn, err)
+				return
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			// the server closes the connection after most errors,
+			// the pending publishes fail once the read returns
+			serverErr = natsServerError(line)
+			log.Errorf("Nats server error, %v", serverErr)
+		}
+	}
+}
+
+// deliver reads the payload of a MSG or HMSG and completes its publish.
+func (c *NatsConn) deliver(line string, reader *bufio.Reader) error {
+	args := strings.Fields(line)
+	withHeader := args[0] == "HMSG"
+	// MSG <subject> <sid> [reply-to] <#bytes>
+	// HMSG <subject> <sid> [reply-to] <#header bytes> <#total bytes>
+	minArgs := 4
+	if withHeader {
+		minArgs = 5
+	}
+	if len(args) < minArgs {
+		return fmt.Errorf("invalid nats message %q", line)
+	}
+	total, err := strconv.Atoi(args[len(args)-1])
+	if err != nil {
+		return fmt.Errorf("invalid nats message %q", line)
+	}
+	headerSize := 0
+	if withHeader {
+		if headerSize, err = strconv.Atoi(args[len(args)-2]); err != nil || headerSize > total {
+			return fmt.Errorf("invalid nats message %q", line)
+		}
+	}
+	payload := make([]byte, total+2)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return err
+	}
+	c.pendLock.Lock()
+	reply, ok := c.pending[args[1]]
+	delete(c.pending, args[1])
+	c.pendLock.Unlock()
+	if !ok {
+		// the publish gave up waiting
+		return nil
+	}
+	result := &natsReply{}
+	header := string(payload[:headerSize])
+	if status := strings.Fields(strings.SplitN(header, "\r\n", 2)[0]); len(status) > 1 && status[1] == "503" {
+		result.err = &SinkError{Reason: "nats_no_responders", Message: "no stream is listening on the subject"}
+	} else {
+		ack := &natsAck{}
+		if err := json.Unmarshal(payload[headerSize:total], ack); err != nil {
+			result.err = &SinkError{Reason: "jetstream_bad_ack", Message: err.Error()}
+		} else if ack.Error != nil {
+			result.err = &SinkError{
+				Reason:  fmt.Sprintf("jetstream_%d_%d", ack.Error.Code, ack.Error.ErrCode),
+				Message: ack.Error.Description,
+			}
+		}
+		result.ack = ack
+	}
+	reply <- result
+	return nil
+}
+
+// fail closes conn if it is still in use, the next publish dials again.
+func (c *NatsConn) fail(conn net.Conn, err error) {
+	c.Lock()
+	if c.conn == conn {
+		c.conn = nil
+		c.writer = nil
+		conn.Close()
+		log.Errorf("Nats connection closed with error, %v", err)
+	}
+	c.Unlock()
+	c.failPending(err)
+}
+
+func (c *NatsConn) failPending(err error) {
+	c.pendLock.Lock()
+	defer c.pendLock.Unlock()
+	for token, reply := range c.pending {
+		reply <- &natsReply{err: err}
+		delete(c.pending, token)
+	}
+}
+
+// Publish sends data to subject with PUB, or HPUB when header is given, and
+// waits for the ack of the stream in JetStream mode.
+func (c *NatsConn) Publish(subject string, header []byte, data []byte, statis *Statistician) error {
+	c.inflight <- struct{}{}
+	defer func() { <-c.inflight }()
+
+	c.Lock()
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			c.Unlock()
+			return err
+		}
+		statis.ConnOpened = true
+	} else {
+		statis.ConnReused = true
+	}
+	if c.info.MaxPayload > 0 && int64(len(header)+len(data)) > c.info.MaxPayload {
+		c.Unlock()
+		return &SinkError{
+			Reason:  "nats_max_payload",
+			Message: fmt.Sprintf("message of %d bytes exceeds max_payload %d", len(header)+len(data), c.info.MaxPayload),
+		}
+	}
+	replyTo := ""
+	var reply chan *natsReply
+	if c.conf.NatsJetStream {
+		c.next += 1
+		token := fmt.Sprintf("%s.%d", c.inbox, c.next)
+		replyTo = " " + token
+		reply = make(chan *natsReply, 1)
+		c.pendLock.Lock()
+		c.pending[token] = reply
+		c.pendLock.Unlock()
+		defer func() {
+			c.pendLock.Lock()
+			delete(c.pending, token)
+			c.pendLock.Unlock()
+		}()
+	}
+	if len(header) > 0 {
+		fmt.Fprintf(c.writer, "HPUB %s%s %d %d\r\n", subject, replyTo, len(header), len(header)+len(data))
+		c.writer.Write(header)
+	} else {
+		fmt.Fprintf(c.writer, "PUB %s%s %d\r\n", subject, replyTo, len(data))
+	}
+	c.writer.Write(data)
+	c.writer.WriteString("\r\n")
+	err := c.writer.Flush()
+	conn := c.conn
+	c.Unlock()
+	if err != nil {
+		c.fail(conn, err)
+		return err
+	}
+	if reply == nil {
+		return nil
+	}
+
+	ackStart := time.Now()
+	timer := time.NewTimer(time.Duration(c.conf.NatsAckTimeout) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case result := <-reply:
+		statis.AckTime = time.Since(ackStart).Microseconds()
+		if result.err == nil && result.ack.Duplicate {
+			log.Debugf("Nats message of subject %s is a duplicate of seq %d", subject, result.ack.Seq)
+		}
+		return result.err
+	case <-timer.C:
+		return fmt.Errorf("wait for ack of subject %s: %w", subject, context.DeadlineExceeded)
+	}
+}
+
+// SharedNatsConn returns the next connection of the nats sink, messages are
+// spread round robin over nats.connections connections. They are built
+// from the config of the nats sink, the only one using them.
+func SharedNatsConn(conf *Config) *NatsConn {
+	natsLock.Lock()
+	if natsConns == nil {
+		for i := 0; i < conf.NatsConnections; i++ {
+			natsConns = append(natsConns, newNatsConn(conf))
+		}
+	}
+	natsLock.Unlock()
+	i := atomic.AddUint64(&natsNext, 1) - 1
+	return natsConns[i%uint64(len(natsConns))]
+}
+
+// parseNatsSubject parses the subject template of the [nats] section.
+func parseNatsSubject(conf *Config) (*template.Template, error) {
+	return template.New("subject").Option("missingkey=error").Parse(conf.NatsSubject)
+}
+
+// NatsSubject returns the subject of topic, a subject given in nats.subjects
+// wins over the nats.subject template.
+func NatsSubject(topic string, conf *Config) (string, error) {
+	tmpl, err := parseNatsSubject(conf)
+	if err != nil {
+		return "", err
+	}
+	return TopicName(topic, conf, conf.NatsSubjects, tmpl)
+}
+
+// natsHeader encodes nats.headers as the header block of HPUB, the values
+// are templates like the ones of the ingest sink.
+func natsHeader(conf *Config, vars *TemplateVars) ([]byte, error) {
+	if len(conf.NatsHeaders) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(conf.NatsHeaders))
+	for name := range conf.NatsHeaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buffer := &bytes.Buffer{}
+	buffer.WriteString("NATS/1.0\r\n")
+	for _, name := range names {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(conf.NatsHeaders[name])
+		if err != nil {
+			return nil, err
+		}
+		value, err := vars.Render(tmpl)
+		if err != nil {
+			return nil, err
+		}
+		// keys are lower cased by viper, JetStream matches Nats-Msg-Id exactly
+		fmt.Fprintf(buffer, "%s: %s\r\n", textproto.CanonicalMIMEHeaderKey(name), value)
+	}
+	buffer.WriteString("\r\n")
+	return buffer.Bytes(), nil
+}
+
+type NatsHandler struct {
+	Topic   string
+	Subject string
+	Conf    *Config
+	Conn    *NatsConn
+}
+
+func NewNatsHandler(topic string, conf *Config) *NatsHandler {
+	// the template is checked by Validate
+	subject, _ := NatsSubject(topic, conf)
+	return &NatsHandler{
+		Topic:   topic,
+		Subject: subject,
+		Conf:    conf,
+		Conn:    SharedNatsConn(conf),
+	}
+}
+
+func (n *NatsHandler) Do(conf *Config, data *bytes.Buffer, chanOut *chan *Statistician) {
+	statis := NewStatistician(n.Topic)
+	vars := &TemplateVars{Topic: n.Topic, RunId: conf.RunId, Seq: NextSeq(conf, n.Topic)}
+	header, err := natsHeader(conf, vars)
+	if err == nil {
+		startTime := time.Now()
+		err = n.Conn.Publish(n.Subject, header, data.Bytes(), statis)
+		statis.SentTime = time.Since(startTime).Milliseconds()
+	}
+	if err != nil {
+		log.Errorf("Publish message to nats with error, %v", err)
+		statis.State = false
+		statis.Reason = ClassifyError(err)
+		statis.Error = err.Error()
+	} else {
+		statis.State = true
+		statis.Reason = "ok"
+		statis.SentBytes = int64(data.Len())
+		statis.WireBytes = int64(len(header) + data.Len())
+	}
+	*chanOut <- statis
+}
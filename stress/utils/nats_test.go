@@ -0,0 +1,224 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNatsServerError(t *testing.T) {
+	tests := []struct {
+		line   string
+		reason string
+	}{
+		{"-ERR 'Authorization Violation'\r\n", "nats_authorization_violation"},
+		{"-ERR 'Maximum Payload Violation'", "nats_maximum_payload_violation"},
+		{"-ERR 'Permissions Violation for Publish to foo'", "nats_permissions_violation"},
+	}
+	for _, test := range tests {
+		if reason := ClassifyError(natsServerError(test.line)); reason != test.reason {
+			t.Errorf("natsServerError(%q) = %s, expect %s", test.line, reason, test.reason)
+		}
+	}
+}
+
+func TestNatsHeader(t *testing.T) {
+	vars := &TemplateVars{Topic: "t1", RunId: "r1", Seq: 3}
+	// keys are lower cased by viper and sorted
+	conf := &Config{NatsHeaders: map[string]string{"nats-msg-id": "{{.RunId}}-{{.Topic}}-{{.Seq}}", "a-source": "stress"}}
+	header, err := natsHeader(conf, vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := "NATS/1.0\r\nA-Source: stress\r\nNats-Msg-Id: r1-t1-3\r\n\r\n"; string(header) != expect {
+		t.Errorf("natsHeader = %q, expect %q", header, expect)
+	}
+	if header, err := natsHeader(&Config{}, vars); header != nil || err != nil {
+		t.Errorf("natsHeader without headers = %q, %v", header, err)
+	}
+	if _, err := natsHeader(&Config{NatsHeaders: map[string]string{"id": "{{.Unknown}}"}}, vars); err == nil {
+		t.Error("unknown variable is rendered")
+	}
+}
+
+// natsMsg returns a MSG, or a HMSG if header is given, to subject.
+func natsMsg(subject, header, body string) string {
+	if header == "" {
+		return fmt.Sprintf("MSG %s 1 %d\r\n%s\r\n", subject, len(body), body)
+	}
+	return fmt.Sprintf("HMSG %s 1 %d %d\r\n%s%s\r\n", subject, len(header), len(header)+len(body), header, body)
+}
+
+func TestNatsDeliver(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    string
+		reason string
+		seq    uint64
+	}{
+		{"ack", natsMsg("_INBOX.x.1", "", `{"stream":"s1","seq":7}`), "", 7},
+		{"duplicate", natsMsg("_INBOX.x.1", "", `{"stream":"s1","seq":7,"duplicate":true}`), "", 7},
+		{"jetstream error", natsMsg("_INBOX.x.1", "", `{"error":{"code":503,"err_code":10077,"description":"maximum messages exceeded"}}`), "jetstream_503_10077", 0},
+		{"bad ack", natsMsg("_INBOX.x.1", "", `+OK`), "jetstream_bad_ack", 0},
+		{"no responders", natsMsg("_INBOX.x.1", "NATS/1.0 503\r\n\r\n", ""), "nats_no_responders", 0},
+		{"ack with header", natsMsg("_INBOX.x.1", "NATS/1.0\r\nA: b\r\n\r\n", `{"seq":2}`), "", 2},
+	}
+	for _, test := range tests {
+		c := newNatsConn(&Config{NatsMaxInflight: 1})
+		reply := make(chan *natsReply, 1)
+		c.pending["_INBOX.x.1"] = reply
+		reader := bufio.NewReader(strings.NewReader(test.msg))
+		line, _ := reader.ReadString('\n')
+		if err := c.deliver(strings.TrimRight(line, "\r\n"), reader); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		result := <-reply
+		if test.reason == "" && result.err != nil || test.reason != "" && (result.err == nil || ClassifyError(result.err) != test.reason) {
+			t.Errorf("%s: reply error %v, expect %s", test.name, result.err, test.reason)
+		}
+		if test.seq > 0 && (result.ack == nil || result.ack.Seq != test.seq) {
+			t.Errorf("%s: ack %+v", test.name, result.ack)
+		}
+		if len(c.pending) != 0 || reader.Buffered() != 0 {
+			t.Errorf("%s: pending %v, %d bytes left", test.name, c.pending, reader.Buffered())
+		}
+	}
+
+	// a message nobody waits for is read and dropped
+	c := newNatsConn(&Config{NatsMaxInflight: 1})
+	reader := bufio.NewReader(strings.NewReader("{}\r\n"))
+	if err := c.deliver("MSG _INBOX.x.9 1 2", reader); err != nil || reader.Buffered() != 0 {
+		t.Errorf("late ack: %v", err)
+	}
+	for _, line := range []string{"MSG _INBOX.x.1 1", "MSG _INBOX.x.1 1 x", "HMSG _INBOX.x.1 1 9 4"} {
+		if err := c.deliver(line, bufio.NewReader(strings.NewReader(""))); err == nil {
+			t.Errorf("invalid message %q is accepted", line)
+		}
+	}
+}
+
+// natsPipe connects c to a fake server on a net.Pipe sending info. The
+// server sends the lines and payloads it receives to the returned channel
+// and answers each publish with the next reply, called with the reply
+// subject of the publish.
+func natsPipe(t *testing.T, c *NatsConn, info string, replies []func(replyTo string) string) (<-chan string, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+	received := make(chan string, 16)
+	go func() {
+		reader := bufio.NewReader(server)
+		fmt.Fprintf(server, "INFO %s\r\n", info)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			received <- line
+			args := strings.Fields(line)
+			switch args[0] {
+			case "PING":
+				server.Write([]byte("PONG\r\n"))
+			case "PUB", "HPUB":
+				total, _ := strconv.Atoi(args[len(args)-1])
+				payload := make([]byte, total+2)
+				if _, err := io.ReadFull(reader, payload); err != nil {
+					return
+				}
+				received <- string(payload)
+				if len(replies) > 0 {
+					server.Write([]byte(replies[0](args[2])))
+					replies = replies[1:]
+				}
+			}
+		}
+	}()
+	u, _ := url.Parse(c.conf.NatsUrl)
+	c.Lock()
+	defer c.Unlock()
+	return received, c.handshake(client, u)
+}
+
+func TestNatsConnPublish(t *testing.T) {
+	conf := &Config{
+		NatsUrl:         "nats://127.0.0.1:4222",
+		NatsJetStream:   true,
+		NatsHeaders:     map[string]string{"nats-msg-id": "{{.Seq}}"},
+		NatsMaxInflight: 4,
+		NatsAckTimeout:  5000,
+	}
+	c := newNatsConn(conf)
+	received, err := natsPipe(t, c, `{"max_payload":64,"headers":true}`, []func(string) string{
+		func(replyTo string) string { return natsMsg(replyTo, "", `{"stream":"s1","seq":1}`) },
+		func(replyTo string) string { return natsMsg(replyTo, "NATS/1.0 503\r\n\r\n", "") },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect := <-received
+	if !strings.HasPrefix(connect, "CONNECT {") || !strings.Contains(connect, `"headers":true`) || !strings.Contains(connect, `"no_responders":true`) {
+		t.Errorf("handshake sent %q", connect)
+	}
+	if sub := <-received; sub != "SUB "+c.inbox+".* 1" {
+		t.Errorf("handshake subscribed %q", sub)
+	}
+	if ping := <-received; ping != "PING" {
+		t.Errorf("handshake sent %q", ping)
+	}
+
+	header, _ := natsHeader(conf, &TemplateVars{Seq: 1})
+	statis := NewStatistician("t1")
+	if err := c.Publish("flows.t1", header, []byte("a,b\n"), statis); err != nil {
+		t.Fatal(err)
+	}
+	// HPUB <subject> <reply-to> <#header bytes> <#total bytes>
+	if line := <-received; line != fmt.Sprintf("HPUB flows.t1 %s.1 %d %d", c.inbox, len(header), len(header)+4) {
+		t.Errorf("publish sent %q", line)
+	}
+	if payload := <-received; payload != "NATS/1.0\r\nNats-Msg-Id: 1\r\n\r\na,b\n\r\n" {
+		t.Errorf("publish sent payload %q", payload)
+	}
+	if !statis.ConnReused || statis.AckTime < 0 {
+		t.Errorf("publish: %+v", statis)
+	}
+
+	err = c.Publish("flows.t1", nil, []byte("a,b\n"), NewStatistician("t1"))
+	if reason := ClassifyError(err); reason != "nats_no_responders" {
+		t.Errorf("no responders is %s, %v", reason, err)
+	}
+	if line := <-received; line != fmt.Sprintf("PUB flows.t1 %s.2 4", c.inbox) {
+		t.Errorf("publish sent %q", line)
+	}
+	<-received
+
+	// max_payload is checked before anything is written
+	err = c.Publish("flows.t1", header, make([]byte, 64), NewStatistician("t1"))
+	if reason := ClassifyError(err); reason != "nats_max_payload" {
+		t.Errorf("large message is %s, %v", reason, err)
+	}
+	select {
+	case line := <-received:
+		t.Errorf("large message sent %q", line)
+	default:
+	}
+}
+
+func TestNatsConnNoHeaders(t *testing.T) {
+	conf := &Config{NatsUrl: "nats://127.0.0.1:4222", NatsHeaders: map[string]string{"nats-msg-id": "{{.Seq}}"}, NatsMaxInflight: 1}
+	_, err := natsPipe(t, newNatsConn(conf), `{"max_payload":1048576}`, nil)
+	if reason := ClassifyError(err); reason != "nats_no_headers" {
+		t.Errorf("server without headers is %s, %v", reason, err)
+	}
+	// plain PUB works without header support
+	conf.NatsHeaders = nil
+	if _, err := natsPipe(t, newNatsConn(conf), `{"max_payload":1048576}`, nil); err != nil {
+		t.Errorf("server without headers: %v", err)
+	}
+}
@@ -0,0 +1,318 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// severity of the log records, SEVERITY_NUMBER_INFO
+const (
+	otlpSeverityNumber = 9
+	otlpSeverityText   = "INFO"
+)
+
+// OtlpBodyField checks otlp.bodyfield, an empty field makes the csv line
+// of the row the body.
+func OtlpBodyField(conf *Config) error {
+	if conf.OtlpBodyField == "" {
+		return nil
+	}
+	for _, field := range RowFields(DataRow{}) {
+		if field.Name == conf.OtlpBodyField {
+			return nil
+		}
+	}
+	return fmt.Errorf("no column %s", conf.OtlpBodyField)
+}
+
+// otlpRecord is a row as log record, the body column is not an attribute.
+type otlpRecord struct {
+	Body       interface{}
+	Attributes []RowField
+}
+
+func otlpRecords(conf *Config, rows []*DataRow) ([]otlpRecord, error) {
+	var lines [][]byte
+	if conf.OtlpBodyField == "" {
+		var err error
+		if lines, err = EncodeRows("csv", rows); err != nil {
+			return nil, err
+		}
+	}
+	records := make([]otlpRecord, 0, len(rows))
+	for i, row := range rows {
+		record := otlpRecord{}
+		if lines != nil {
+			record.Body = string(lines[i])
+		}
+		for _, field := range RowFields(*row) {
+			if field.Name == conf.OtlpBodyField {
+				record.Body = field.Value
+				continue
+			}
+			record.Attributes = append(record.Attributes, field)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// appendAnyValue appends an AnyValue message of value, integers are
+// int_value and all other values string_value.
+func appendAnyValue(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case int32:
+		// a oneof field is written even if it is zero
+		buf = appendTag(buf, 3, wireVarint)
+		return binary.AppendUvarint(buf, uint64(int64(v)))
+	case int64:
+		buf = appendTag(buf, 3, wireVarint)
+		return binary.AppendUvarint(buf, uint64(v))
+	default:
+		return appendStringField(buf, 1, fmt.Sprint(v))
+	}
+}
+
+func appendKeyValue(buf []byte, field int, key string, value interface{}) []byte {
+	kv := appendStringField(nil, 1, key)
+	kv = appendBytesField(kv, 2, appendAnyValue(nil, value))
+	return appendBytesField(buf, field, kv)
+}
+
+// encodeOtlpProto returns the protobuf ExportLogsServiceRequest of records.
+func encodeOtlpProto(conf *Config, topic string, records []otlpRecord, now uint64) []byte {
+	var scopeLogs, record []byte
+	scope := appendStringField(nil, 1, "stress")
+	scopeLogs = appendBytesField(scopeLogs, 1, scope)
+	for _, r := range records {
+		record = appendFixed64Field(record[:0], 1, now)
+		record = appendVarintField(record, 2, otlpSeverityNumber)
+		record = appendStringField(record, 3, otlpSeverityText)
+		record = appendBytesField(record, 5, appendAnyValue(nil, r.Body))
+		for _, field := range r.Attributes {
+			record = appendKeyValue(record, 6, field.Name, field.Value)
+		}
+		record = appendFixed64Field(record, 11, now)
+		scopeLogs = appendBytesField(scopeLogs, 2, record)
+	}
+	var resource []byte
+	resource = appendKeyValue(resource, 1, "service.name", conf.OtlpServiceName)
+	resource = appendKeyValue(resource, 1, "topic", topic)
+	resourceLogs := appendBytesField(nil, 1, resource)
+	resourceLogs = appendBytesField(resourceLogs, 2, scopeLogs)
+	return appendBytesField(nil, 1, resourceLogs)
+}
+
+// otlpJsonValue is an AnyValue of OTLP/JSON, int64 values are strings.
+type otlpJsonValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    string  `json:"intValue,omitempty"`
+}
+
+type otlpJsonKeyValue struct {
+	Key   string        `json:"key"`
+	Value otlpJsonValue `json:"value"`
+}
+
+type otlpJsonRecord struct {
+	TimeUnixNano         string             `json:"timeUnixNano"`
+	ObservedTimeUnixNano string             `json:"observedTimeUnixNano"`
+	SeverityNumber       int                `json:"severityNumber"`
+	SeverityText         string             `json:"severityText"`
+	Body                 otlpJsonValue      `json:"body"`
+	Attributes           []otlpJsonKeyValue `json:"attributes"`
+}
+
+type otlpJsonScopeLogs struct {
+	Scope      map[string]string `json:"scope"`
+	LogRecords []otlpJsonRecord  `json:"logRecords"`
+}
+
+type otlpJsonResourceLogs struct {
+	Resource  map[string][]otlpJsonKeyValue `json:"resource"`
+	ScopeLogs []otlpJsonScopeLogs           `json:"scopeLogs"`
+}
+
+type otlpJsonRequest struct {
+	ResourceLogs []otlpJsonResourceLogs `json:"resourceLogs"`
+}
+
+func newOtlpJsonValue(value interface{}) otlpJsonValue {
+	switch v := value.(type) {
+	case int32:
+		return otlpJsonValue{IntValue: strconv.FormatInt(int64(v), 10)}
+	case int64:
+		return otlpJsonValue{IntValue: strconv.FormatInt(v, 10)}
+	default:
+		s := fmt.Sprint(v)
+		return otlpJsonValue{StringValue: &s}
+	}
+}
+
+// encodeOtlpJson returns the OTLP/JSON ExportLogsServiceRequest of records.
+func encodeOtlpJson(conf *Config, topic string, records []otlpRecord, now uint64) ([]byte, error) {
+	timestamp := strconv.FormatUint(now, 10)
+	logRecords := make([]otlpJsonRecord, 0, len(records))
+	for _, r := range records {
+		record := otlpJsonRecord{
+			TimeUnixNano:         timestamp,
+			ObservedTimeUnixNano: timestamp,
+			SeverityNumber:       otlpSeverityNumber,
+			SeverityText:         otlpSeverityText,
+			Body:                 newOtlpJsonValue(r.Body),
+		}
+		for _, field := range r.Attributes {
+			record.Attributes = append(record.Attributes, otlpJsonKeyValue{field.Name, newOtlpJsonValue(field.Value)})
+		}
+		logRecords = append(logRecords, record)
+	}
+	request := otlpJsonRequest{ResourceLogs: []otlpJsonResourceLogs{{
+		Resource: map[string][]otlpJsonKeyValue{"attributes": {
+			{"service.name", newOtlpJsonValue(conf.OtlpServiceName)},
+			{"topic", newOtlpJsonValue(topic)},
+		}},
+		ScopeLogs: []otlpJsonScopeLogs{{
+			Scope:      map[string]string{"name": "stress"},
+			LogRecords: logRecords,
+		}},
+	}}}
+	return json.Marshal(request)
+}
+
+// EncodeOtlpLogs returns the ExportLogsServiceRequest of rows in otlp.encoding.
+func EncodeOtlpLogs(conf *Config, topic string, rows []*DataRow) ([]byte, error) {
+	records, err := otlpRecords(conf, rows)
+	if err != nil {
+		return nil, err
+	}
+	now := uint64(time.Now().UnixNano())
+	if conf.OtlpEncoding == "json" {
+		return encodeOtlpJson(conf, topic, records, now)
+	}
+	return encodeOtlpProto(conf, topic, records, now), nil
+}
+
+// InspectOtlp counts the log records rejected by a partial success answer.
+func InspectOtlp(conf *Config) func(content []byte, statis *Statistician) {
+	return func(content []byte, statis *Statistician) {
+		if len(content) == 0 {
+			return
+		}
+		var rejected int64
+		var message string
+		var err error
+		if conf.OtlpEncoding == "json" {
+			response := struct {
+				PartialSuccess struct {
+					RejectedLogRecords json.RawMessage `json:"rejectedLogRecords"`
+					ErrorMessage       string          `json:"errorMessage"`
+				} `json:"partialSuccess"`
+			}{}
+			if err = json.Unmarshal(content, &response); err == nil && len(response.PartialSuccess.RejectedLogRecords) > 0 {
+				// int64 is a string in OTLP/JSON but some servers send a number
+				count := strings.Trim(string(response.PartialSuccess.RejectedLogRecords), `"`)
+				rejected, err = strconv.ParseInt(count, 10, 64)
+				message = response.PartialSuccess.ErrorMessage
+			}
+		} else {
+			err = protoFields(content, func(field int, varint uint64, data []byte) {
+				if field == 1 {
+					protoFields(data, func(field int, varint uint64, data []byte) {
+						switch field {
+						case 1:
+							rejected = int64(varint)
+						case 2:
+							message = string(data)
+						}
+					})
+				}
+			})
+		}
+		if err != nil {
+			log.Errorf("Parse otlp response with error, %v", err)
+			return
+		}
+		if rejected <= 0 {
+			return
+		}
+		statis.FailedRows = rejected
+		statis.RowReasons = map[string]*ReasonCount{"otlp_rejected": {Count: rejected, Sample: message}}
+		log.Debugf("Otlp request of topic %s has %d rejected log records", statis.Topic, rejected)
+	}
+}
+
+type OtlpHandler struct {
+	Topic string
+	Conf  *Config
+	Http  *HttpHandler
+}
+
+func NewOtlpHandler(topic string, conf *Config) *OtlpHandler {
+	header := http.Header{}
+	if conf.OtlpEncoding == "json" {
+		header.Set("Content-Type", "application/json")
+	} else {
+		header.Set("Content-Type", "application/x-protobuf")
+	}
+	return &OtlpHandler{
+		Topic: topic,
+		Conf:  conf,
+		Http: &HttpHandler{
+			Topic:  topic,
+			Cli:    &http.Client{Transport: SharedTransport("otlp", conf)},
+			Url:    conf.OtlpUrl,
+			Conf:   conf,
+			Method: "POST",
+			Header: header,
+			Success: func(code int) bool {
+				return code >= 200 && code <= 299
+			},
+			Auth:    SharedAuthenticator("otlp", "none", conf),
+			Inspect: InspectOtlp(conf),
+		},
+	}
+}
+
+// Do sends the rows of a message in requests of otlp.batchsize log records,
+// each request is reported on its own.
+func (o *OtlpHandler) Do(conf *Config, data *bytes.Buffer, chanOut *chan *Statistician) {
+	rows, err := DecodeRows(conf.DataFmt, data.Bytes())
+	size := conf.OtlpBatchSize
+	if size == 0 || size > len(rows) {
+		size = len(rows)
+	}
+	i := 0
+	for ; err == nil && i < len(rows); i += size {
+		end := i + size
+		if end > len(rows) {
+			end = len(rows)
+		}
+		var body []byte
+		if body, err = EncodeOtlpLogs(conf, o.Topic, rows[i:end]); err != nil {
+			break
+		}
+		out := make(chan *Statistician, 1)
+		// a request failing before it is sent is reported as well
+		o.Http.Do(conf, bytes.NewBuffer(body), &out)
+		statis := <-out
+		statis.Rows = int64(end - i)
+		*chanOut <- statis
+	}
+	if err != nil {
+		log.Errorf("Encode message for otlp with error, %v", err)
+		statis := NewStatistician(o.Topic)
+		// rows of the batches already sent are reported by their requests
+		statis.Rows = int64(len(rows) - i)
+		statis.Reason = "encode"
+		statis.Error = err.Error()
+		*chanOut <- statis
+	}
+}
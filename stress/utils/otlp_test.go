@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// decodeOtlpAnyValue parses an AnyValue of common.proto, string_value = 1
+// and int_value = 3.
+func decodeOtlpAnyValue(t *testing.T, buf []byte) otlpJsonValue {
+	t.Helper()
+	var value otlpJsonValue
+	err := protoFields(buf, func(field int, varint uint64, data []byte) {
+		switch field {
+		case 1:
+			s := string(data)
+			value.StringValue = &s
+		case 3:
+			value.IntValue = strconv.FormatInt(int64(varint), 10)
+		default:
+			t.Errorf("AnyValue has field %d", field)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+// decodeOtlpKeyValue parses a KeyValue of common.proto, key = 1 and value = 2.
+func decodeOtlpKeyValue(t *testing.T, buf []byte) otlpJsonKeyValue {
+	t.Helper()
+	var kv otlpJsonKeyValue
+	err := protoFields(buf, func(field int, _ uint64, data []byte) {
+		if field == 1 {
+			kv.Key = string(data)
+		} else {
+			kv.Value = decodeOtlpAnyValue(t, data)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kv
+}
+
+// decodeOtlpProto parses an ExportLogsServiceRequest following the field
+// numbers of logs.proto into its OTLP/JSON form.
+func decodeOtlpProto(t *testing.T, buf []byte) otlpJsonRequest {
+	t.Helper()
+	var request otlpJsonRequest
+	fields := func(buf []byte, fn func(field int, varint uint64, data []byte)) {
+		if err := protoFields(buf, fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fields(buf, func(_ int, _ uint64, data []byte) {
+		resourceLogs := otlpJsonResourceLogs{}
+		fields(data, func(field int, _ uint64, data []byte) {
+			switch field {
+			case 1: // resource
+				resourceLogs.Resource = map[string][]otlpJsonKeyValue{}
+				fields(data, func(_ int, _ uint64, data []byte) {
+					resourceLogs.Resource["attributes"] = append(resourceLogs.Resource["attributes"], decodeOtlpKeyValue(t, data))
+				})
+			case 2: // scope_logs
+				scopeLogs := otlpJsonScopeLogs{}
+				fields(data, func(field int, _ uint64, data []byte) {
+					if field == 1 {
+						fields(data, func(_ int, _ uint64, name []byte) {
+							scopeLogs.Scope = map[string]string{"name": string(name)}
+						})
+						return
+					}
+					record := otlpJsonRecord{}
+					fields(data, func(field int, varint uint64, data []byte) {
+						switch field {
+						case 1:
+							record.TimeUnixNano = strconv.FormatUint(varint, 10)
+						case 2:
+							record.SeverityNumber = int(varint)
+						case 3:
+							record.SeverityText = string(data)
+						case 5:
+							record.Body = decodeOtlpAnyValue(t, data)
+						case 6:
+							record.Attributes = append(record.Attributes, decodeOtlpKeyValue(t, data))
+						case 11:
+							record.ObservedTimeUnixNano = strconv.FormatUint(varint, 10)
+						default:
+							t.Errorf("LogRecord has field %d", field)
+						}
+					})
+					scopeLogs.LogRecords = append(scopeLogs.LogRecords, record)
+				})
+				resourceLogs.ScopeLogs = append(resourceLogs.ScopeLogs, scopeLogs)
+			}
+		})
+		request.ResourceLogs = append(request.ResourceLogs, resourceLogs)
+	})
+	return request
+}
+
+func TestAppendAnyValue(t *testing.T) {
+	tests := []struct {
+		value  interface{}
+		expect string
+	}{
+		{int32(0), "\x18\x00"},
+		{int32(150), "\x18\x96\x01"},
+		{int64(-1), "\x18\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01"},
+		{"ab", "\x0a\x02ab"},
+		{"", "\x0a\x00"},
+	}
+	for _, test := range tests {
+		if value := appendAnyValue(nil, test.value); string(value) != test.expect {
+			t.Errorf("appendAnyValue(%v) = %q, expect %q", test.value, value, test.expect)
+		}
+	}
+}
+
+// TestEncodeOtlpProto checks that the protobuf and the json encodings of
+// the same records hold the same request.
+func TestEncodeOtlpProto(t *testing.T) {
+	rows, err := DecodeRows("csv", Write2Csv(3).Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bodyField := range []string{"", "c_flowid", "c_netnum"} {
+		conf := &Config{OtlpServiceName: "stress", OtlpBodyField: bodyField}
+		records, err := otlpRecords(conf, rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := encodeOtlpJson(conf, "t1", records, 1700000000000000000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expect otlpJsonRequest
+		if err := json.Unmarshal(content, &expect); err != nil {
+			t.Fatal(err)
+		}
+		request := decodeOtlpProto(t, encodeOtlpProto(conf, "t1", records, 1700000000000000000))
+		if !reflect.DeepEqual(request, expect) {
+			t.Errorf("bodyfield %q: protobuf request\n%+v\nexpect\n%+v", bodyField, request, expect)
+		}
+		if n := len(request.ResourceLogs[0].ScopeLogs[0].LogRecords); n != len(rows) {
+			t.Errorf("bodyfield %q: %d log records of %d rows", bodyField, n, len(rows))
+		}
+	}
+}
+
+func TestInspectOtlp(t *testing.T) {
+	partial := appendBytesField(nil, 1, appendStringField(appendVarintField(nil, 1, 2), 2, "bad record"))
+	tests := []struct {
+		encoding string
+		content  []byte
+		rejected int64
+	}{
+		{"protobuf", nil, 0},
+		{"protobuf", partial, 2},
+		{"protobuf", []byte{0x0a, 0x05}, 0},
+		{"json", []byte(`{"partialSuccess":{"rejectedLogRecords":"2","errorMessage":"bad record"}}`), 2},
+		{"json", []byte(`{"partialSuccess":{"rejectedLogRecords":3}}`), 3},
+		{"json", []byte(`{}`), 0},
+	}
+	for _, test := range tests {
+		statis := NewStatistician("t1")
+		InspectOtlp(&Config{OtlpEncoding: test.encoding})(test.content, statis)
+		if statis.FailedRows != test.rejected {
+			t.Errorf("%s %q rejected %d, expect %d", test.encoding, test.content, statis.FailedRows, test.rejected)
+		}
+		if test.rejected > 0 && statis.RowReasons["otlp_rejected"].Count != test.rejected {
+			t.Errorf("%s %q has reasons %v", test.encoding, test.content, statis.RowReasons)
+		}
+	}
+}
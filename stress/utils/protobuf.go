@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// protobuf wire types used by the hand encoded messages of the
+// remote_write and otlp sinks
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+var errInvalidProto = errors.New("invalid protobuf message")
+
+func appendTag(buf []byte, field int, wire int) []byte {
+	return binary.AppendUvarint(buf, uint64(field<<3|wire))
+}
+
+// appendVarintField appends an int64 or uint64 field, zero is skipped
+// like proto3 does for default values.
+func appendVarintField(buf []byte, field int, value uint64) []byte {
+	if value == 0 {
+		return buf
+	}
+	buf = appendTag(buf, field, wireVarint)
+	return binary.AppendUvarint(buf, value)
+}
+
+func appendFixed64Field(buf []byte, field int, value uint64) []byte {
+	buf = appendTag(buf, field, wireFixed64)
+	return binary.LittleEndian.AppendUint64(buf, value)
+}
+
+func appendDoubleField(buf []byte, field int, value float64) []byte {
+	return appendFixed64Field(buf, field, math.Float64bits(value))
+}
+
+// appendBytesField appends a string, bytes or embedded message field.
+func appendBytesField(buf []byte, field int, value []byte) []byte {
+	buf = appendTag(buf, field, wireBytes)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func appendStringField(buf []byte, field int, value string) []byte {
+	buf = appendTag(buf, field, wireBytes)
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// protoFields calls fn with each field of the protobuf message buf, varint
+// holds the value of varint and fixed fields and data the bytes of the others.
+func protoFields(buf []byte, fn func(field int, varint uint64, data []byte)) error {
+	for len(buf) > 0 {
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return errInvalidProto
+		}
+		buf = buf[n:]
+		field := int(tag >> 3)
+		switch tag & 7 {
+		case wireVarint:
+			value, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return errInvalidProto
+			}
+			buf = buf[n:]
+			fn(field, value, nil)
+		case wireFixed64:
+			if len(buf) < 8 {
+				return errInvalidProto
+			}
+			fn(field, binary.LittleEndian.Uint64(buf), nil)
+			buf = buf[8:]
+		case wireBytes:
+			size, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < size {
+				return errInvalidProto
+			}
+			fn(field, 0, buf[n:n+int(size)])
+			buf = buf[n+int(size):]
+		case 5: // fixed32
+			if len(buf) < 4 {
+				return errInvalidProto
+			}
+			fn(field, uint64(binary.LittleEndian.Uint32(buf)), nil)
+			buf = buf[4:]
+		default:
+			return errInvalidProto
+		}
+	}
+	return nil
+}
@@ -0,0 +1,400 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	redisLock  sync.Mutex
+	redisConns []*RedisConn
+	redisNext  uint64
+)
+
+// redisReply is the reply of a command, err is either a -ERR reply or
+// the error of the connection.
+type redisReply struct {
+	value string
+	err   error
+}
+
+// RedisConn is a RESP connection shared by the workers of the redis sink,
+// replies are read by its own goroutine in the order the commands were sent.
+type RedisConn struct {
+	sync.Mutex
+	conf    *Config
+	conn    net.Conn
+	writer  *bufio.Writer
+	waiters chan chan *redisReply
+	// a slot per command waiting for its reply, waiters never fills up
+	inflight chan struct{}
+	acquire  sync.Mutex
+}
+
+// writeCommand writes args as a RESP array of bulk strings.
+func writeCommand(w *bufio.Writer, args [][]byte) {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n", len(arg))
+		w.Write(arg)
+		w.WriteString("\r\n")
+	}
+}
+
+// readReply reads a RESP2 reply, arrays are read but only their size is kept.
+func readReply(reader *bufio.Reader) (*redisReply, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return nil, fmt.Errorf("empty redis reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return &redisReply{value: line[1:]}, nil
+	case '-':
+		return &redisReply{err: redisServerError(line[1:])}, nil
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis reply %q", line)
+		}
+		if size < 0 {
+			return &redisReply{}, nil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		return &redisReply{value: string(buf[:size])}, nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis reply %q", line)
+		}
+		for i := 0; i < size; i++ {
+			if _, err := readReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return &redisReply{value: line[1:]}, nil
+	default:
+		return nil, fmt.Errorf("invalid redis reply %q", line)
+	}
+}
+
+// redisServerError converts an error reply, the reason is its error code
+// like ERR, WRONGTYPE or OOM.
+func redisServerError(message string) error {
+	code, _, _ := strings.Cut(message, " ")
+	return &SinkError{Reason: "redis_" + strings.ToLower(code), Message: message}
+}
+
+// connect dials the server, authenticates and selects the database of
+// redis.url, the caller holds the lock.
+func (c *RedisConn) connect() error {
+	// the url is checked by Validate
+	u, _ := url.Parse(c.conf.RedisUrl)
+	conn, err := DialSink(c.conf, u.Host, u.Scheme == "rediss")
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriterSize(conn, 64*1024)
+
+	var setup [][][]byte
+	auth := SharedAuthenticator("redis", "none", c.conf)
+	switch {
+	case u.User != nil:
+		password, _ := u.User.Password()
+		setup = append(setup, [][]byte{[]byte("AUTH"), []byte(u.User.Username()), []byte(password)})
+	case auth.Mode == "basic" || auth.Mode == "header":
+		cred := auth.Next()
+		setup = append(setup, [][]byte{[]byte("AUTH"), []byte(cred.User), []byte(cred.Password)})
+	case auth.Mode == "bearer":
+		token, err := auth.token.Token()
+		if err != nil {
+			conn.Close()
+			return err
+		}
+		setup = append(setup, [][]byte{[]byte("AUTH"), []byte(token)})
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" && db != "0" {
+		setup = append(setup, [][]byte{[]byte("SELECT"), []byte(db)})
+	}
+	for _, args := range setup {
+		writeCommand(writer, args)
+	}
+	if err := writer.Flush(); err != nil {
+		conn.Close()
+		return err
+	}
+	for range setup {
+		reply, err := readReply(reader)
+		if err == nil {
+			err = reply.err
+		}
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	c.conn = conn
+	c.writer = writer
+	c.waiters = make(chan chan *redisReply, cap(c.inflight))
+	go c.readLoop(conn, reader, c.waiters)
+	log.Debugf("Connected to redis server %s", u.Host)
+	return nil
+}
+
+// readLoop hands each reply to the oldest waiting command.
+func (c *RedisConn) readLoop(conn net.Conn, reader *bufio.Reader, waiters chan chan *redisReply) {
+	for {
+		reply, err := readReply(reader)
+		if err != nil {
+			c.fail(conn, err)
+			return
+		}
+		waiter := <-waiters
+		waiter <- reply
+		<-c.inflight
+	}
+}
+
+// fail closes conn if it is still in use and fails the commands waiting
+// for a reply, the next command dials again.
+func (c *RedisConn) fail(conn net.Conn, err error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.conn != conn {
+		return
+	}
+	log.Errorf("Redis connection closed with error, %v", err)
+	c.conn = nil
+	c.writer = nil
+	conn.Close()
+	for {
+		select {
+		case waiter := <-c.waiters:
+			waiter <- &redisReply{err: err}
+			<-c.inflight
+		default:
+			return
+		}
+	}
+}
+
+// Send writes commands in a single flush and returns the channels their
+// replies are delivered to.
+func (c *RedisConn) Send(commands [][][]byte, statis *Statistician) ([]chan *redisReply, error) {
+	// the slots of all commands are taken at once, a sender holding a
+	// part of them could block the others forever
+	c.acquire.Lock()
+	for range commands {
+		c.inflight <- struct{}{}
+	}
+	c.acquire.Unlock()
+	c.Lock()
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			c.Unlock()
+			for range commands {
+				<-c.inflight
+			}
+			return nil, err
+		}
+		statis.ConnOpened = true
+	} else if !statis.ConnOpened {
+		statis.ConnReused = true
+	}
+	replies := make([]chan *redisReply, 0, len(commands))
+	for _, args := range commands {
+		reply := make(chan *redisReply, 1)
+		writeCommand(c.writer, args)
+		// the lock keeps the waiters in the order of the commands
+		c.waiters <- reply
+		replies = append(replies, reply)
+	}
+	written := c.writer.Buffered()
+	err := c.writer.Flush()
+	conn := c.conn
+	c.Unlock()
+	if err != nil {
+		c.fail(conn, err)
+		return replies, err
+	}
+	statis.WireBytes += int64(written)
+	return replies, nil
+}
+
+// SharedRedisConn returns the next connection of the redis sink, messages
+// are spread round robin over redis.connections connections. They are
+// built from the config of the redis sink, the only one using them.
+func SharedRedisConn(conf *Config) *RedisConn {
+	redisLock.Lock()
+	if redisConns == nil {
+		for i := 0; i < conf.RedisConnections; i++ {
+			redisConns = append(redisConns, &RedisConn{
+				conf: conf,
+				// every worker of every topic has at most redis.pipeline
+				// commands waiting
+				inflight: make(chan struct{}, conf.RedisPipeline*conf.Threads*len(conf.Topics)),
+			})
+		}
+	}
+	redisLock.Unlock()
+	i := atomic.AddUint64(&redisNext, 1) - 1
+	return redisConns[i%uint64(len(redisConns))]
+}
+
+// parseRedisStream parses the stream key template of the [redis] section.
+func parseRedisStream(conf *Config) (*template.Template, error) {
+	return template.New("stream").Option("missingkey=error").Parse(conf.RedisStream)
+}
+
+// RedisStream returns the stream key of topic, a key given in redis.streams
+// wins over the redis.stream template.
+func RedisStream(topic string, conf *Config) (string, error) {
+	tmpl, err := parseRedisStream(conf)
+	if err != nil {
+		return "", err
+	}
+	return TopicName(topic, conf, conf.RedisStreams, tmpl)
+}
+
+type RedisHandler struct {
+	Topic  string
+	Stream string
+	Conf   *Config
+	Conn   *RedisConn
+}
+
+func NewRedisHandler(topic string, conf *Config) *RedisHandler {
+	// the template is checked by Validate
+	stream, _ := RedisStream(topic, conf)
+	return &RedisHandler{
+		Topic:  topic,
+		Stream: stream,
+		Conf:   conf,
+		Conn:   SharedRedisConn(conf),
+	}
+}
+
+// xadd returns the XADD command of fields, trimmed by redis.maxlen.
+func (r *RedisHandler) xadd(fields ...[]byte) [][]byte {
+	args := [][]byte{[]byte("XADD"), []byte(r.Stream)}
+	if r.Conf.RedisMaxLen > 0 {
+		args = append(args, []byte("MAXLEN"))
+		if r.Conf.RedisApproximate {
+			args = append(args, []byte("~"))
+		}
+		args = append(args, []byte(strconv.Itoa(r.Conf.RedisMaxLen)))
+	}
+	args = append(args, []byte("*"))
+	return append(args, fields...)
+}
+
+// commands returns an XADD of the whole message, or of each row in row mode.
+func (r *RedisHandler) commands(data []byte) ([][][]byte, error) {
+	if r.Conf.RedisMode != "row" {
+		return [][][]byte{r.xadd([]byte(r.Conf.RedisField), data)}, nil
+	}
+	rows, err := DecodeRows(r.Conf.DataFmt, data)
+	if err != nil {
+		return nil, err
+	}
+	commands := make([][][]byte, 0, len(rows))
+	for _, row := range rows {
+		var fields [][]byte
+		for _, field := range RowFields(*row) {
+			fields = append(fields, []byte(field.Name), []byte(fmt.Sprint(field.Value)))
+		}
+		commands = append(commands, r.xadd(fields...))
+	}
+	return commands, nil
+}
+
+func (r *RedisHandler) Do(conf *Config, data *bytes.Buffer, chanOut *chan *Statistician) {
+	statis := NewStatistician(r.Topic)
+	commands, err := r.commands(data.Bytes())
+	if err != nil {
+		log.Errorf("Encode message for redis with error, %v", err)
+		statis.Reason = "encode"
+		statis.Error = err.Error()
+		*chanOut <- statis
+		return
+	}
+	startTime := time.Now()
+	// at most redis.pipeline commands are sent before reading their replies
+	for i := 0; i < len(commands) && err == nil; i += conf.RedisPipeline {
+		end := i + conf.RedisPipeline
+		if end > len(commands) {
+			end = len(commands)
+		}
+		var replies []chan *redisReply
+		replies, err = r.Conn.Send(commands[i:end], statis)
+		for _, reply := range replies {
+			result := <-reply
+			if result.err == nil {
+				continue
+			}
+			if !IsSinkError(result.err) {
+				// the connection broke, the rest of the message is not sent
+				err = result.err
+				continue
+			}
+			if statis.RowReasons == nil {
+				statis.RowReasons = make(map[string]*ReasonCount)
+			}
+			name := ClassifyError(result.err)
+			reason, ok := statis.RowReasons[name]
+			if !ok {
+				reason = &ReasonCount{Sample: result.err.Error()}
+				statis.RowReasons[name] = reason
+			}
+			reason.Count += 1
+			statis.FailedRows += 1
+		}
+	}
+	statis.SentTime = time.Since(startTime).Milliseconds()
+	if conf.RedisMode == "row" {
+		statis.Rows = int64(len(commands))
+	}
+	switch {
+	case err != nil:
+		log.Errorf("Sent message to redis with error, %v", err)
+		statis.State = false
+		statis.Reason = ClassifyError(err)
+		statis.Error = err.Error()
+		statis.FailedRows = 0
+		statis.RowReasons = nil
+	case conf.RedisMode != "row" && statis.FailedRows > 0:
+		// the message is a single entry, its error fails the message
+		for name, reason := range statis.RowReasons {
+			statis.Reason = name
+			statis.Error = reason.Sample
+		}
+		statis.State = false
+		statis.FailedRows = 0
+		statis.RowReasons = nil
+	default:
+		statis.State = true
+		statis.Reason = "ok"
+		statis.SentBytes = int64(data.Len())
+	}
+	*chanOut <- statis
+}
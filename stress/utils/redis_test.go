@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		input  string
+		value  string
+		reason string // reason of the error reply
+	}{
+		{"+OK\r\n", "OK", ""},
+		{":42\r\n", "42", ""},
+		{"$15\r\n1700000000000-0\r\n", "1700000000000-0", ""},
+		{"$0\r\n\r\n", "", ""},
+		{"$-1\r\n", "", ""},
+		{"*2\r\n$1\r\na\r\n*1\r\n:1\r\n", "2", ""},
+		{"-OOM command not allowed\r\n", "", "redis_oom"},
+		{"-WRONGTYPE Operation against a key\r\n", "", "redis_wrongtype"},
+	}
+	for _, test := range tests {
+		reader := bufio.NewReader(strings.NewReader(test.input + "+NEXT\r\n"))
+		reply, err := readReply(reader)
+		if err != nil {
+			t.Errorf("readReply(%q): %v", test.input, err)
+			continue
+		}
+		if reply.value != test.value {
+			t.Errorf("readReply(%q) = %q, expect %q", test.input, reply.value, test.value)
+		}
+		if test.reason == "" && reply.err != nil || test.reason != "" && (reply.err == nil || ClassifyError(reply.err) != test.reason) {
+			t.Errorf("readReply(%q) error %v, expect %s", test.input, reply.err, test.reason)
+		}
+		// the whole reply is consumed
+		if next, err := readReply(reader); err != nil || next.value != "NEXT" {
+			t.Errorf("readReply(%q) leaves %v, %v", test.input, next, err)
+		}
+	}
+	for _, input := range []string{"", "\r\n", "?x\r\n", "$x\r\n", "$5\r\nab\r\n", "*2\r\n+a\r\n"} {
+		if _, err := readReply(bufio.NewReader(strings.NewReader(input))); err == nil {
+			t.Errorf("readReply(%q) is accepted", input)
+		}
+	}
+}
+
+func TestWriteCommand(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	writer := bufio.NewWriter(buffer)
+	writeCommand(writer, [][]byte{[]byte("XADD"), []byte("t1"), []byte("*"), []byte("data"), []byte("a,b\r\n")})
+	writer.Flush()
+	expect := "*5\r\n$4\r\nXADD\r\n$2\r\nt1\r\n$1\r\n*\r\n$4\r\ndata\r\n$5\r\na,b\r\n\r\n"
+	if buffer.String() != expect {
+		t.Errorf("writeCommand = %q, expect %q", buffer.String(), expect)
+	}
+}
+
+// TestRedisConnInflight sends more commands than in flight slots from
+// several workers, each reply goes to its own command.
+func TestRedisConnInflight(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// answer each XADD with the stream key as id
+				reader := bufio.NewReader(conn)
+				for {
+					var args []string
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					var size int
+					fmt.Sscanf(line, "*%d", &size)
+					for i := 0; i < size; i++ {
+						reader.ReadString('\n')
+						arg, _ := reader.ReadString('\n')
+						args = append(args, strings.TrimRight(arg, "\r\n"))
+					}
+					fmt.Fprintf(conn, "+%s\r\n", args[1])
+				}
+			}()
+		}
+	}()
+
+	conf := testConf(t, fmt.Sprintf(`
+[redis]
+url="redis://%s/0"
+`, listener.Addr()))
+	redis := &RedisConn{conf: conf, inflight: make(chan struct{}, 2)}
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for worker := 0; worker < 4; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				var commands [][][]byte
+				for j := 0; j < 2; j++ {
+					key := fmt.Sprintf("%d-%d-%d", worker, i, j)
+					commands = append(commands, [][]byte{[]byte("XADD"), []byte(key), []byte("*"), []byte("data"), []byte("x")})
+				}
+				replies, err := redis.Send(commands, NewStatistician("t1"))
+				if err != nil {
+					errs <- err
+					return
+				}
+				for j, reply := range replies {
+					if result := <-reply; result.err != nil || result.value != string(commands[j][1]) {
+						errs <- fmt.Errorf("reply of %s is %+v", commands[j][1], result)
+						return
+					}
+				}
+			}
+		}(worker)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("workers blocked")
+	}
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if len(redis.inflight) != 0 {
+		t.Errorf("%d slots are not released", len(redis.inflight))
+	}
+}
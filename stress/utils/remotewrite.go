@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+// RowColumns returns the numeric and the string columns of the flow schema,
+// ip columns are strings as in RowFields.
+func RowColumns() (numeric []string, labels []string) {
+	for _, field := range RowFields(DataRow{}) {
+		switch field.Value.(type) {
+		case int32, int64:
+			numeric = append(numeric, field.Name)
+		case string:
+			labels = append(labels, field.Name)
+		}
+	}
+	return numeric, labels
+}
+
+// selectColumns returns names, or all columns if names is empty, an error
+// names the first column not found in columns.
+func selectColumns(names []string, columns []string, kind string) ([]string, error) {
+	if len(names) == 0 {
+		return columns, nil
+	}
+	known := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		known[column] = true
+	}
+	for _, name := range names {
+		if !known[name] {
+			return nil, fmt.Errorf("%s is not a %s column", name, kind)
+		}
+	}
+	return names, nil
+}
+
+// RemoteWriteColumns returns the columns sent as samples and as labels
+// selected by remotewrite.metrics and remotewrite.labels.
+func RemoteWriteColumns(conf *Config) (metrics []string, labels []string, err error) {
+	numeric, strs := RowColumns()
+	if metrics, err = selectColumns(conf.RemoteWriteMetrics, numeric, "numeric"); err != nil {
+		return nil, nil, err
+	}
+	if labels, err = selectColumns(conf.RemoteWriteLabels, strs, "string"); err != nil {
+		return nil, nil, err
+	}
+	return metrics, labels, nil
+}
+
+// EncodeWriteRequest returns the protobuf WriteRequest of rows, every metric
+// column of a row is a series of a single sample labeled with the label
+// columns and the topic.
+func EncodeWriteRequest(rows []*DataRow, topic string, prefix string, metrics []string, labels []string, timestamp int64) []byte {
+	// labels of a series are sorted by name, __name__ goes first
+	names := append([]string{"topic"}, labels...)
+	sort.Strings(names)
+	isMetric := make(map[string]bool, len(metrics))
+	for _, name := range metrics {
+		isMetric[name] = true
+	}
+
+	var request, series, label, sample []byte
+	values := make(map[string]string, len(names))
+	for _, row := range rows {
+		var numbers []RowField
+		for _, field := range RowFields(*row) {
+			switch v := field.Value.(type) {
+			case string:
+				values[field.Name] = v
+			case int32, int64:
+				if isMetric[field.Name] {
+					numbers = append(numbers, field)
+				}
+			}
+		}
+		values["topic"] = topic
+		for _, number := range numbers {
+			series = series[:0]
+			label = appendStringField(label[:0], 1, "__name__")
+			label = appendStringField(label, 2, prefix+number.Name)
+			series = appendBytesField(series, 1, label)
+			for _, name := range names {
+				label = appendStringField(label[:0], 1, name)
+				label = appendStringField(label, 2, values[name])
+				series = appendBytesField(series, 1, label)
+			}
+			var value float64
+			switch v := number.Value.(type) {
+			case int32:
+				value = float64(v)
+			case int64:
+				value = float64(v)
+			}
+			sample = appendDoubleField(sample[:0], 1, value)
+			sample = appendVarintField(sample, 2, uint64(timestamp))
+			series = appendBytesField(series, 2, sample)
+			request = appendBytesField(request, 1, series)
+		}
+	}
+	return request
+}
+
+// NewRemoteWriteHandler returns a http handler sending the rows of topic
+// as samples to a Prometheus remote_write endpoint.
+func NewRemoteWriteHandler(topic string, conf *Config) *HttpHandler {
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-protobuf")
+	header.Set("Content-Encoding", "snappy")
+	header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	// the columns are checked by Validate
+	metrics, labels, _ := RemoteWriteColumns(conf)
+	return &HttpHandler{
+		Topic:  topic,
+		Cli:    &http.Client{Transport: SharedTransport("remotewrite", conf)},
+		Url:    conf.RemoteWriteUrl,
+		Conf:   conf,
+		Method: "POST",
+		Header: header,
+		Success: func(code int) bool {
+			return code >= 200 && code <= 299
+		},
+		Auth: SharedAuthenticator("remotewrite", "none", conf),
+		Encode: func(data []byte, vars *TemplateVars) ([]byte, error) {
+			rows, err := DecodeRows(conf.DataFmt, data)
+			if err != nil {
+				return nil, err
+			}
+			request := EncodeWriteRequest(rows, topic, conf.RemoteWriteMetricPrefix, metrics, labels, time.Now().UnixMilli())
+			// remote_write uses the block format of snappy, not the framed one of http.compression
+			return snappy.Encode(nil, request), nil
+		},
+	}
+}
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+// writeSeries is a TimeSeries of prometheus.proto with a single sample.
+type writeSeries struct {
+	Labels    map[string]string
+	Value     float64
+	Timestamp int64
+}
+
+// decodeWriteRequest parses a WriteRequest following prometheus.proto,
+// WriteRequest.timeseries = 1, TimeSeries.labels = 1, TimeSeries.samples = 2,
+// Label.name = 1, Label.value = 2, Sample.value = 1 and Sample.timestamp = 2.
+func decodeWriteRequest(t *testing.T, request []byte) []writeSeries {
+	t.Helper()
+	var result []writeSeries
+	err := protoFields(request, func(field int, _ uint64, data []byte) {
+		if field != 1 {
+			t.Errorf("WriteRequest has field %d", field)
+			return
+		}
+		series := writeSeries{Labels: make(map[string]string)}
+		var names []string
+		err := protoFields(data, func(field int, _ uint64, data []byte) {
+			switch field {
+			case 1:
+				var name, value string
+				protoFields(data, func(field int, _ uint64, data []byte) {
+					if field == 1 {
+						name = string(data)
+					} else {
+						value = string(data)
+					}
+				})
+				names = append(names, name)
+				series.Labels[name] = value
+			case 2:
+				protoFields(data, func(field int, varint uint64, _ []byte) {
+					if field == 1 {
+						series.Value = math.Float64frombits(varint)
+					} else {
+						series.Timestamp = int64(varint)
+					}
+				})
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names[0] != "__name__" || !sort.StringsAreSorted(names[1:]) {
+			t.Errorf("labels are not sorted: %v", names)
+		}
+		result = append(result, series)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// TestEncodeWriteRequestBytes checks the wire bytes of a single series
+// derived by hand from prometheus.proto.
+func TestEncodeWriteRequestBytes(t *testing.T) {
+	row := &DataRow{C_netnum: 7, C_flowid: "f"}
+	request := EncodeWriteRequest([]*DataRow{row}, "t1", "stress_", []string{"c_netnum"}, []string{"c_flowid"}, 1000)
+	expect := []byte("\x0a\x47" + // timeseries, 71 bytes
+		"\x0a\x1b" + "\x0a\x08__name__" + "\x12\x0fstress_c_netnum" +
+		"\x0a\x0d" + "\x0a\x08c_flowid" + "\x12\x01f" +
+		"\x0a\x0b" + "\x0a\x05topic" + "\x12\x02t1" +
+		"\x12\x0c" + "\x09\x00\x00\x00\x00\x00\x00\x1c\x40" + "\x10\xe8\x07") // 7.0, 1000
+	if !bytes.Equal(request, expect) {
+		t.Errorf("EncodeWriteRequest =\n%q\nexpect\n%q", request, expect)
+	}
+}
+
+// TestRemoteWriteEncode decodes the snappy body of the remote_write handler
+// back into series.
+func TestRemoteWriteEncode(t *testing.T) {
+	conf := testConf(t, `
+[required]
+topics=["t1"]
+datafmt="csv"
+[test]
+usemethod=13
+[remotewrite]
+url="http://127.0.0.1:9090/api/v1/write"
+metrics=["c_netnum","c_up_bytes"]
+labels=["c_flowid"]
+`)
+	data := Write2Csv(3)
+	rows, err := DecodeRows("csv", data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := NewRemoteWriteHandler("t1", conf).Encode(data.Bytes(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := snappy.Decode(nil, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := decodeWriteRequest(t, request)
+	if len(series) != 2*len(rows) {
+		t.Fatalf("%d series of %d rows", len(series), len(rows))
+	}
+	for i, s := range series {
+		row := rows[i/2]
+		name, value := conf.RemoteWriteMetricPrefix+"c_netnum", float64(row.C_netnum)
+		if i%2 == 1 {
+			name, value = conf.RemoteWriteMetricPrefix+"c_up_bytes", float64(row.C_up_bytes)
+		}
+		if s.Labels["__name__"] != name || s.Labels["c_flowid"] != row.C_flowid || s.Labels["topic"] != "t1" || len(s.Labels) != 3 {
+			t.Errorf("series %d has labels %v", i, s.Labels)
+		}
+		if s.Value != value || s.Timestamp <= 0 {
+			t.Errorf("series %d has sample %v at %d, expect %v", i, s.Value, s.Timestamp, value)
+		}
+	}
+}
+
+func TestProtoFieldsInvalid(t *testing.T) {
+	for _, buf := range [][]byte{
+		{0x0a, 0x05, 'a'}, // bytes past the end
+		{0x09, 0x00},      // short fixed64
+		{0x08},            // missing varint
+		{0x0b},            // start group
+		binary.AppendUvarint(nil, math.MaxUint64)[:3], // truncated tag
+	} {
+		if err := protoFields(buf, func(int, uint64, []byte) {}); err != errInvalidProto {
+			t.Errorf("protoFields(%x) = %v", buf, err)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -13,6 +14,42 @@ type Statistician struct {
 	SentTime  int64
 	SentBytes int64
 	State     bool // is Reqeust response Ok
+	// connection used by a http request, taken from idle pool or new dialed
+	ConnReused bool
+	ConnOpened bool
+	TlsTime    int64 // Microseconds spent in tls handshake, part of SentTime
+	// bytes on the wire after compression and Microseconds spent on it
+	WireBytes    int64
+	CompressTime int64
+	// requests sent for the message and how many of the retried ones
+	// were completely written to the server before failing
+	Attempts          int
+	AmbiguousAttempts int
+	// classified outcome of the message and the error message of a failure
+	Reason string
+	Error  string
+	Proto  string // protocol negotiated by http requests
+	// sinks answering per row report the rows of a successful request
+	// which were rejected and why, Rows is 0 when all rows were handled
+	// as a whole
+	Rows       int64
+	FailedRows int64
+	RowReasons map[string]*ReasonCount
+	// Microseconds from the end of sending to the ack of the server, only
+	// set by sinks with acks like JetStream
+	AckTime int64
+	// datagrams sent and failed writes of the socket sinks
+	Datagrams   int64
+	WriteErrors int64
+	// objects uploaded by the s3 sink, its PUT requests and the
+	// Microseconds they took
+	Objects int64
+	Puts    int64
+	PutTime int64
+	// frames sent by the websocket sink
+	Frames int64
+	// requests of the message sent to the endpoints of dataproxy.endpoints
+	EndpointAttempts []EndpointAttempt
 }
 
 func NewStatistician(topic string) *Statistician {
@@ -22,11 +59,20 @@ func NewStatistician(topic string) *Statistician {
 		SentTime:  0,
 		SentBytes: 0,
 		State:     false,
+		Attempts:  1,
 	}
 }
 
+// ReasonCount counts the messages or the rows of an outcome reason, Sample
+// keeps the first error message seen for the reason.
+type ReasonCount struct {
+	Count  int64
+	Sample string
+}
+
 type Report struct {
 	Name              string
+	Sink              string // set when test.usemethods has several sinks
 	StartTime         time.Time
 	EndTime           time.Time
 	TotalSentBytes    int64
@@ -41,7 +87,31 @@ type Report struct {
 	SussfulRequests   int64
 	FailedRequests    int64
 	TotalRequestsSent int64
-	DataFmt	          string
+	DataFmt           string
+	ReusedConns       int64
+	OpenedConns       int64
+	TlsHandshakes     int64
+	TotalTlsTime      int64
+	Compression       string
+	TotalWireBytes    int64
+	TotalCompressTime int64
+	FirstAttemptSucc  int64
+	RetrySucc         int64
+	TotalRetries      int64
+	AmbiguousRetries  int64
+	Reasons           map[string]*ReasonCount
+	RowReasons        map[string]*ReasonCount // rows failed in successful messages
+	Protocols         map[string]int64
+	Acks              int64
+	TotalAckTime      int64
+	MaxAckTime        int64
+	TotalDatagrams    int64
+	WriteErrors       int64
+	TotalObjects      int64
+	TotalPuts         int64
+	TotalPutTime      int64
+	TotalFrames       int64
+	Endpoints         map[string]*EndpointReport
 	ChanStatis        *chan *Statistician
 }
 
@@ -62,7 +132,31 @@ func NewReport(name string, conf *Config, chanStatis *chan *Statistician) *Repor
 		SussfulRequests:   0,
 		FailedRequests:    0,
 		TotalRequestsSent: 0,
-		DataFmt:	   conf.DataFmt,
+		DataFmt:           conf.DataFmt,
+		ReusedConns:       0,
+		OpenedConns:       0,
+		TlsHandshakes:     0,
+		TotalTlsTime:      0,
+		Compression:       conf.HttpCompression,
+		TotalWireBytes:    0,
+		TotalCompressTime: 0,
+		FirstAttemptSucc:  0,
+		RetrySucc:         0,
+		TotalRetries:      0,
+		AmbiguousRetries:  0,
+		Reasons:           make(map[string]*ReasonCount),
+		RowReasons:        make(map[string]*ReasonCount),
+		Protocols:         make(map[string]int64),
+		Acks:              0,
+		TotalAckTime:      0,
+		MaxAckTime:        0,
+		TotalDatagrams:    0,
+		WriteErrors:       0,
+		TotalObjects:      0,
+		TotalPuts:         0,
+		TotalPutTime:      0,
+		TotalFrames:       0,
+		Endpoints:         make(map[string]*EndpointReport),
 		ChanStatis:        chanStatis,
 	}
 }
@@ -73,13 +167,85 @@ func Calc(ptrMapReport *map[string]*Report, ptrChanStatis *chan *Statistician) {
 	for data := range chanStatis {
 		topic := data.Topic
 		report := mapReports[topic]
+		if data.ConnReused {
+			report.ReusedConns += 1
+		}
+		if data.ConnOpened {
+			report.OpenedConns += 1
+		}
+		if data.TlsTime > 0 {
+			report.TlsHandshakes += 1
+			report.TotalTlsTime += data.TlsTime
+		}
+		if data.Reason != "" {
+			reason, ok := report.Reasons[data.Reason]
+			if !ok {
+				reason = &ReasonCount{Sample: data.Error}
+				report.Reasons[data.Reason] = reason
+			}
+			reason.Count += 1
+		}
+		for name, count := range data.RowReasons {
+			reason, ok := report.RowReasons[name]
+			if !ok {
+				reason = &ReasonCount{Sample: count.Sample}
+				report.RowReasons[name] = reason
+			}
+			reason.Count += count.Count
+		}
+		if data.Proto != "" {
+			report.Protocols[data.Proto] += 1
+		}
+		if data.AckTime > 0 {
+			report.Acks += 1
+			report.TotalAckTime += data.AckTime
+			if data.AckTime > report.MaxAckTime {
+				report.MaxAckTime = data.AckTime
+			}
+		}
+		report.TotalDatagrams += data.Datagrams
+		report.WriteErrors += data.WriteErrors
+		report.TotalObjects += data.Objects
+		report.TotalPuts += data.Puts
+		report.TotalPutTime += data.PutTime
+		report.TotalFrames += data.Frames
+		rows := int64(report.MessageSize)
+		if data.Rows > 0 {
+			rows = data.Rows
+		}
+		for i, attempt := range data.EndpointAttempts {
+			endpoint, ok := report.Endpoints[attempt.Endpoint]
+			if !ok {
+				endpoint = &EndpointReport{}
+				report.Endpoints[attempt.Endpoint] = endpoint
+			}
+			endpoint.Requests += 1
+			endpoint.TotalTime += attempt.Time
+			if attempt.Failed {
+				endpoint.FailedRequests += 1
+			} else if data.State && i == len(data.EndpointAttempts)-1 {
+				endpoint.SuccessfulRows += rows - data.FailedRows
+			}
+		}
+		if data.Attempts > 1 {
+			report.TotalRetries += int64(data.Attempts - 1)
+			report.AmbiguousRetries += int64(data.AmbiguousAttempts)
+		}
 		if data.State {
-			report.SuccessfulRows += int64(report.MessageSize)
+			if data.Attempts > 1 {
+				report.RetrySucc += 1
+			} else {
+				report.FirstAttemptSucc += 1
+			}
+			report.SuccessfulRows += rows - data.FailedRows
+			report.FailedRows += data.FailedRows
 			report.TotalSentBytes += data.SentBytes
+			report.TotalWireBytes += data.WireBytes
+			report.TotalCompressTime += data.CompressTime
 			report.TotalSentTime += data.SentTime
 			report.SussfulRequests += 1
 		} else {
-			report.FailedRows += int64(report.MessageSize)
+			report.FailedRows += rows
 			report.FailedRequests += 1
 		}
 		report.TotalRequestsSent = report.FailedRequests + report.SussfulRequests
@@ -95,37 +261,288 @@ func Calc(ptrMapReport *map[string]*Report, ptrChanStatis *chan *Statistician) {
 }
 
 func (r *Report) Print() {
-	var tableContent [17]string
 	spentSeconds := float64(r.TotalSentTime) / float64(1000)
 	totalSentMiB := float64(r.TotalSentBytes) / float64(2<<19)
 
-	tableContent[0] = fmt.Sprintf("==============Summary for Topic %s======================", r.Name)
-	tableContent[1] = fmt.Sprintf("Start At: %v", r.StartTime)
-	tableContent[2] = fmt.Sprintf("Threads: %d", r.ThreadsNum)
-	tableContent[3] = fmt.Sprintf("Data Format: %s", r.DataFmt)
-	tableContent[4] = fmt.Sprintf("SpentTime: %.3fs (%v Milliseconds)", spentSeconds, r.TotalSentTime)
-	tableContent[5] = fmt.Sprintf("Transmit Rows: %d (Total transmit rows)", r.TotalSentRows)
-	tableContent[6] = fmt.Sprintf("Transmit MiB: %.3f MiB (%v bytes)", totalSentMiB, r.TotalSentBytes)
-	tableContent[7] = fmt.Sprintf("Transmit Failed Rows: %d", r.FailedRows)
-	tableContent[8] = fmt.Sprintf("Transmit Successful Rows: %d", r.SuccessfulRows)
-	tableContent[9] = fmt.Sprintf("Rows Per Message: %d R/P", r.MessageSize)
-	tableContent[10] = fmt.Sprintf("Transmission Rate1: %.3f M/s (MiB per seconds)", r.SizePerSecond)
-	tableContent[11] = fmt.Sprintf("Transmission Rate2: %.3f R/s (Rows per seconds)", r.RowPerSecond)
-	tableContent[12] = fmt.Sprintf("Total Requests Sent: %d", r.TotalRequestsSent)
-	tableContent[13] = fmt.Sprintf("Failed Requests: %d", r.FailedRequests)
-	tableContent[14] = fmt.Sprintf("Successful Requests: %d", r.SussfulRequests)
-	tableContent[15] = fmt.Sprintf("ElapsedTime: %.3f s", r.EndTime.Sub(r.StartTime).Seconds())
-	tableContent[16] = fmt.Sprintf("StopTime: %v", r.EndTime)
+	title := fmt.Sprintf("==============Summary for Topic %s======================", r.Name)
+	if r.Sink != "" {
+		title = fmt.Sprintf("==============Summary for Topic %s, Sink %s======================", r.Name, r.Sink)
+	}
+	tableContent := []string{
+		title,
+		fmt.Sprintf("Start At: %v", r.StartTime),
+		fmt.Sprintf("Threads: %d", r.ThreadsNum),
+		fmt.Sprintf("Data Format: %s", r.DataFmt),
+		fmt.Sprintf("SpentTime: %.3fs (%v Milliseconds)", spentSeconds, r.TotalSentTime),
+		fmt.Sprintf("Transmit Rows: %d (Total transmit rows)", r.TotalSentRows),
+		fmt.Sprintf("Transmit MiB: %.3f MiB (%v bytes)", totalSentMiB, r.TotalSentBytes),
+		fmt.Sprintf("Transmit Failed Rows: %d", r.FailedRows),
+		fmt.Sprintf("Transmit Successful Rows: %d", r.SuccessfulRows),
+		fmt.Sprintf("Rows Per Message: %d R/P", r.MessageSize),
+		fmt.Sprintf("Transmission Rate1: %.3f M/s (MiB per seconds)", r.SizePerSecond),
+		fmt.Sprintf("Transmission Rate2: %.3f R/s (Rows per seconds)", r.RowPerSecond),
+		fmt.Sprintf("Total Requests Sent: %d", r.TotalRequestsSent),
+		fmt.Sprintf("Failed Requests: %d", r.FailedRequests),
+		fmt.Sprintf("Successful Requests: %d", r.SussfulRequests),
+	}
+	// the rows of the sink specific counters are only printed when the
+	// sink of the report filled them
+	if r.ReusedConns+r.OpenedConns > 0 {
+		tableContent = append(tableContent, fmt.Sprintf("Connections: %d reused, %d opened (%.2f%% reused)", r.ReusedConns, r.OpenedConns, r.ConnReuseRate()))
+	}
+	if r.TlsHandshakes > 0 {
+		tableContent = append(tableContent, fmt.Sprintf("TLS Handshake: %d handshakes, %.3f ms (%.2f%% of %v Milliseconds request time)", r.TlsHandshakes, float64(r.TotalTlsTime)/1000, r.TlsTimeRate(), r.TotalSentTime))
+	}
+	if r.TotalWireBytes > 0 {
+		tableContent = append(tableContent, fmt.Sprintf("Compression: %s, %v raw bytes, %v wire bytes, ratio %.3f, compress wall time %.3f ms", r.Compression, r.TotalSentBytes, r.TotalWireBytes, r.CompressRatio(), float64(r.TotalCompressTime)/1000))
+	}
+	if r.TotalRetries > 0 {
+		tableContent = append(tableContent, fmt.Sprintf("Retry: %d first attempt successes, %d successes after retry, %d permanent failures, %d retries", r.FirstAttemptSucc, r.RetrySucc, r.FailedRequests, r.TotalRetries))
+	}
+	if r.AmbiguousRetries > 0 {
+		tableContent = append(tableContent, fmt.Sprintf("Possibly Duplicated Rows: %d (%d retries after the body was sent)", r.AmbiguousRetries*int64(r.MessageSize), r.AmbiguousRetries))
+	}
+	if len(r.Protocols) > 0 {
+		tableContent = append(tableContent, fmt.Sprintf("Negotiated Protocols: %s", r.ProtocolSummary()))
+	}
+	if r.Acks > 0 {
+		tableContent = append(tableContent, fmt.Sprintf("Ack Latency: %d acks, avg %.3f ms, max %.3f ms", r.Acks, r.AvgAckTime(), float64(r.MaxAckTime)/1000))
+	}
+	if r.TotalDatagrams+r.WriteErrors > 0 {
+		tableContent = append(tableContent, fmt.Sprintf("Socket Writes: %d datagrams, %d write errors", r.TotalDatagrams, r.WriteErrors))
+	}
+	if r.TotalObjects+r.TotalPuts > 0 {
+		tableContent = append(tableContent, fmt.Sprintf("Object Uploads: %d objects, %.3f objects/s, %d PUT requests, avg PUT latency %.3f ms", r.TotalObjects, r.ObjectRate(), r.TotalPuts, r.AvgPutTime()))
+	}
+	if r.TotalFrames > 0 {
+		tableContent = append(tableContent, fmt.Sprintf("WebSocket Frames: %d frames, %.3f frames/s", r.TotalFrames, r.FrameRate()))
+	}
+	tableContent = append(tableContent,
+		fmt.Sprintf("ElapsedTime: %.3f s", r.EndTime.Sub(r.StartTime).Seconds()),
+		fmt.Sprintf("StopTime: %v", r.EndTime),
+	)
 	for i := 0; i < len(tableContent); i++ {
 		log.Infoln(tableContent[i])
 	}
-	tableStr := strings.Join(tableContent[:], "\n")
+	tableStr := strings.Join(tableContent, "\n")
 	fmt.Println(tableStr)
+	r.PrintReasons()
+	r.PrintEndpoints()
+}
+
+// PrintReasons prints the count of messages per outcome reason and the
+// count of rows failed in successful messages per reason, the most
+// frequent reason first.
+func (r *Report) PrintReasons() {
+	printReasons("Reason", "Messages", r.Reasons)
+	printReasons("Row Reason", "Rows", r.RowReasons)
+}
+
+func printReasons(title string, unit string, reasons map[string]*ReasonCount) {
+	if len(reasons) == 0 {
+		return
+	}
+	names := make([]string, 0, len(reasons))
+	for name := range reasons {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if reasons[names[i]].Count != reasons[names[j]].Count {
+			return reasons[names[i]].Count > reasons[names[j]].Count
+		}
+		return names[i] < names[j]
+	})
+	lines := []string{fmt.Sprintf("%-40s %10s  %s", title, unit, "First Error")}
+	for _, name := range names {
+		reason := reasons[name]
+		sample := strings.ReplaceAll(reason.Sample, "\n", " ")
+		if len(sample) > 120 {
+			sample = sample[:120] + "..."
+		}
+		lines = append(lines, fmt.Sprintf("%-40s %10d  %s", name, reason.Count, sample))
+	}
+	for _, line := range lines {
+		log.Infoln(line)
+	}
+	fmt.Println(strings.Join(lines, "\n"))
+}
+
+// EndpointReport counts the requests of a topic sent to an endpoint.
+type EndpointReport struct {
+	Requests       int64
+	FailedRequests int64
+	TotalTime      int64
+	SuccessfulRows int64
+}
+
+// PrintEndpoints prints the requests of the topic per endpoint.
+func (r *Report) PrintEndpoints() {
+	if len(r.Endpoints) == 0 {
+		return
+	}
+	names := make([]string, 0, len(r.Endpoints))
+	for name := range r.Endpoints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := []string{fmt.Sprintf("%-30s %10s %10s %8s %10s %14s", "Endpoint", "Requests", "Failed", "Error%", "Avg ms", "Rows")}
+	for _, name := range names {
+		endpoint := r.Endpoints[name]
+		var errorRate, avgTime float64
+		if endpoint.Requests > 0 {
+			errorRate = float64(endpoint.FailedRequests) * 100 / float64(endpoint.Requests)
+			avgTime = float64(endpoint.TotalTime) / float64(endpoint.Requests)
+		}
+		lines = append(lines, fmt.Sprintf("%-30s %10d %10d %8.2f %10.3f %14d", name, endpoint.Requests, endpoint.FailedRequests, errorRate, avgTime, endpoint.SuccessfulRows))
+	}
+	for _, line := range lines {
+		log.Infoln(line)
+	}
+	fmt.Println(strings.Join(lines, "\n"))
+}
+
+// ConnReuseRate returns the percentage of requests sent on a reused connection.
+func (r *Report) ConnReuseRate() float64 {
+	total := r.ReusedConns + r.OpenedConns
+	if total == 0 {
+		return 0
+	}
+	return float64(r.ReusedConns) * 100 / float64(total)
+}
+
+// TlsTimeRate returns the percentage of request time spent in tls handshakes.
+func (r *Report) TlsTimeRate() float64 {
+	if r.TotalSentTime == 0 {
+		return 0
+	}
+	return float64(r.TotalTlsTime) / 10 / float64(r.TotalSentTime)
+}
+
+// ProtocolSummary returns the number of responses per protocol, e.g. "HTTP/2.0 x 10".
+func (r *Report) ProtocolSummary() string {
+	if len(r.Protocols) == 0 {
+		return "-"
+	}
+	var items []string
+	for proto, count := range r.Protocols {
+		items = append(items, fmt.Sprintf("%s x %d", proto, count))
+	}
+	sort.Strings(items)
+	return strings.Join(items, ", ")
+}
+
+// AvgAckTime returns the average Milliseconds waited for an ack.
+func (r *Report) AvgAckTime() float64 {
+	if r.Acks == 0 {
+		return 0
+	}
+	return float64(r.TotalAckTime) / float64(r.Acks) / 1000
+}
+
+// ObjectRate returns the objects uploaded per second of the elapsed time.
+func (r *Report) ObjectRate() float64 {
+	elapsed := r.EndTime.Sub(r.StartTime).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(r.TotalObjects) / elapsed
+}
+
+// FrameRate returns the websocket frames sent per second of the elapsed time.
+func (r *Report) FrameRate() float64 {
+	elapsed := r.EndTime.Sub(r.StartTime).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(r.TotalFrames) / elapsed
+}
+
+// AvgPutTime returns the average Milliseconds of a PUT request.
+func (r *Report) AvgPutTime() float64 {
+	if r.TotalPuts == 0 {
+		return 0
+	}
+	return float64(r.TotalPutTime) / float64(r.TotalPuts) / 1000
+}
+
+// CompressRatio returns raw bytes divided by bytes on the wire.
+func (r *Report) CompressRatio() float64 {
+	if r.TotalWireBytes == 0 {
+		return 0
+	}
+	return float64(r.TotalSentBytes) / float64(r.TotalWireBytes)
 }
 
 func PrintSummary4Topics(ptrReports *map[string]*Report) {
-	reports := *ptrReports
-	for _, report := range reports {
-		report.Print()
+	PrintSummary4Sinks([]map[string]*Report{*ptrReports})
+}
+
+// PrintSummary4Sinks prints the reports of the topics of each sink of
+// test.usemethods, followed by a comparison of the sinks.
+func PrintSummary4Sinks(sinkReports []map[string]*Report) {
+	for _, reports := range sinkReports {
+		for _, report := range reports {
+			report.Print()
+		}
+	}
+	if endpointPool != nil {
+		endpointPool.Print()
+	}
+	if len(sinkReports) > 1 {
+		PrintSinkComparison(sinkReports)
+	}
+}
+
+// PrintSinkComparison prints the topics of each sink added up side by
+// side.
+func PrintSinkComparison(sinkReports []map[string]*Report) {
+	lines := SinkComparison(sinkReports)
+	for _, line := range lines {
+		log.Infoln(line)
+	}
+	fmt.Println(strings.Join(lines, "\n"))
+}
+
+// SinkComparison returns the lines of the comparison table, a row per sink.
+// The rates are per second of the elapsed time, the sinks got the same
+// messages at the same time.
+func SinkComparison(sinkReports []map[string]*Report) []string {
+	lines := []string{
+		"==============Comparison of Sinks======================",
+		fmt.Sprintf("%-14s %10s %10s %8s %14s %12s %12s %10s %10s %10s", "Sink", "Requests", "Failed", "Error%", "Rows", "FailedRows", "Rows/s", "MiB/s", "Avg ms", "Retries"),
+	}
+	for _, reports := range sinkReports {
+		var sink Report
+		for _, report := range reports {
+			sink.Sink = report.Sink
+			if sink.StartTime.IsZero() || report.StartTime.Before(sink.StartTime) {
+				sink.StartTime = report.StartTime
+			}
+			if report.EndTime.After(sink.EndTime) {
+				sink.EndTime = report.EndTime
+			}
+			sink.TotalRequestsSent += report.TotalRequestsSent
+			sink.FailedRequests += report.FailedRequests
+			sink.SussfulRequests += report.SussfulRequests
+			sink.SuccessfulRows += report.SuccessfulRows
+			sink.FailedRows += report.FailedRows
+			sink.TotalSentBytes += report.TotalSentBytes
+			sink.TotalSentTime += report.TotalSentTime
+			sink.TotalRetries += report.TotalRetries
+		}
+		var errorRate, rowRate, sizeRate, avgTime float64
+		if sink.TotalRequestsSent > 0 {
+			errorRate = float64(sink.FailedRequests) * 100 / float64(sink.TotalRequestsSent)
+		}
+		if elapsed := sink.EndTime.Sub(sink.StartTime).Seconds(); elapsed > 0 {
+			rowRate = float64(sink.SuccessfulRows) / elapsed
+			sizeRate = float64(sink.TotalSentBytes) / float64(2<<19) / elapsed
+		}
+		// only successful requests count the time they took
+		if sink.SussfulRequests > 0 {
+			avgTime = float64(sink.TotalSentTime) / float64(sink.SussfulRequests)
+		}
+		lines = append(lines, fmt.Sprintf("%-14s %10d %10d %8.2f %14d %12d %12.3f %10.3f %10.3f %10d", sink.Sink, sink.TotalRequestsSent, sink.FailedRequests, errorRate, sink.SuccessfulRows, sink.FailedRows, rowRate, sizeRate, avgTime, sink.TotalRetries))
 	}
+	return lines
 }
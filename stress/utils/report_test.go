@@ -0,0 +1,27 @@
+package utils
+
+import "testing"
+
+// TestCalcReasons checks that rows rejected in successful messages are
+// counted apart from the outcome of the messages.
+func TestCalcReasons(t *testing.T) {
+	reports := map[string]*Report{"t1": NewReport("t1", &Config{MessageSize: 10}, nil)}
+	out := make(chan *Statistician, 3)
+	out <- &Statistician{Topic: "t1", State: true, Reason: "http_200", Attempts: 1, Rows: 10, FailedRows: 3,
+		RowReasons: map[string]*ReasonCount{"bulk_mapper_parsing_exception": {Count: 3, Sample: "failed to parse"}}}
+	out <- &Statistician{Topic: "t1", State: true, Reason: "http_200", Attempts: 1}
+	out <- &Statistician{Topic: "t1", State: false, Reason: "timeout", Error: "deadline exceeded", Attempts: 1}
+	close(out)
+	Calc(&reports, &out)
+
+	report := reports["t1"]
+	if len(report.Reasons) != 2 || report.Reasons["http_200"].Count != 2 || report.Reasons["timeout"].Count != 1 {
+		t.Errorf("message reasons %v", report.Reasons)
+	}
+	if len(report.RowReasons) != 1 || report.RowReasons["bulk_mapper_parsing_exception"].Count != 3 {
+		t.Errorf("row reasons %v", report.RowReasons)
+	}
+	if report.SuccessfulRows != 17 || report.FailedRows != 13 || report.SussfulRequests != 2 || report.FailedRequests != 1 {
+		t.Errorf("report %+v", report)
+	}
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ShouldRetry reports whether the retry policy of conf retries a failed
+// attempt, err is the transport error and result the response received.
+func ShouldRetry(conf *Config, result *attemptResult, err error) bool {
+	if err != nil {
+		kind := netErrorKind(err)
+		for _, retryKind := range conf.RetryNetworkErrors {
+			if retryKind == kind || retryKind == "all" {
+				return true
+			}
+		}
+		return false
+	}
+	for _, code := range conf.RetryStatusCodes {
+		if code == result.StatusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryDelay returns how long to wait before the attempt after attempt,
+// the exponential backoff is replaced by Retry-After of the response if
+// retry.honorretryafter is set. Both are capped at retry.maxbackoff, a
+// server asking for hours must not stall the worker.
+func RetryDelay(conf *Config, attempt int, result *attemptResult) time.Duration {
+	if conf.RetryHonorRetryAfter && result.Header != nil {
+		if delay, ok := parseRetryAfter(result.Header.Get("Retry-After")); ok {
+			if max := time.Duration(conf.RetryMaxBackoff) * time.Millisecond; delay > max {
+				delay = max
+			}
+			return delay
+		}
+	}
+	backoff := float64(conf.RetryInitialBackoff) * math.Pow(conf.RetryMultiplier, float64(attempt-1))
+	if backoff > float64(conf.RetryMaxBackoff) {
+		backoff = float64(conf.RetryMaxBackoff)
+	}
+	// jitter spreads the retries of all workers failed at the same time
+	backoff -= backoff * conf.RetryJitter * rand.Float64()
+	return time.Duration(backoff * float64(time.Millisecond))
+}
+
+// parseRetryAfter parses a Retry-After value given in seconds or as http date.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		delay := time.Until(date)
+		if delay < 0 {
+			delay = 0
+		}
+		return delay, true
+	}
+	return 0, false
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		delay time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"0", 0, true},
+		{"3", 3 * time.Second, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, true},
+	}
+	for _, test := range tests {
+		delay, ok := parseRetryAfter(test.value)
+		if delay != test.delay || ok != test.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v, expect %v, %v", test.value, delay, ok, test.delay, test.ok)
+		}
+	}
+	// a date is rounded to seconds
+	date := time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat)
+	if delay, ok := parseRetryAfter(date); !ok || delay <= 8*time.Second || delay > 10*time.Second {
+		t.Errorf("parseRetryAfter(%q) = %v, %v", date, delay, ok)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	conf := &Config{
+		RetryInitialBackoff: 100,
+		RetryMaxBackoff:     1000,
+		RetryMultiplier:     2,
+	}
+	tests := []struct {
+		attempt int
+		delay   time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{10, time.Second},
+	}
+	result := &attemptResult{}
+	for _, test := range tests {
+		if delay := RetryDelay(conf, test.attempt, result); delay != test.delay {
+			t.Errorf("RetryDelay(%d) = %v, expect %v", test.attempt, delay, test.delay)
+		}
+	}
+
+	result.Header = http.Header{"Retry-After": []string{"7"}}
+	if delay := RetryDelay(conf, 1, result); delay != 100*time.Millisecond {
+		t.Errorf("RetryDelay ignoring Retry-After = %v", delay)
+	}
+	conf.RetryHonorRetryAfter = true
+	conf.RetryMaxBackoff = 10000
+	for _, test := range []struct {
+		value string
+		delay time.Duration
+	}{
+		{"7", 7 * time.Second},
+		// Retry-After is capped at retry.maxbackoff
+		{"86400", 10 * time.Second},
+		{time.Now().Add(24 * time.Hour).UTC().Format(http.TimeFormat), 10 * time.Second},
+	} {
+		result.Header = http.Header{"Retry-After": []string{test.value}}
+		if delay := RetryDelay(conf, 1, result); delay != test.delay {
+			t.Errorf("RetryDelay with Retry-After %s = %v, expect %v", test.value, delay, test.delay)
+		}
+	}
+	conf.RetryMaxBackoff = 1000
+
+	conf.RetryJitter = 0.5
+	result.Header = nil
+	for i := 0; i < 100; i++ {
+		if delay := RetryDelay(conf, 3, result); delay <= 200*time.Millisecond || delay > 400*time.Millisecond {
+			t.Fatalf("RetryDelay with jitter = %v", delay)
+		}
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	conf := &Config{
+		RetryStatusCodes:   []int{429, 503},
+		RetryNetworkErrors: []string{"refused"},
+	}
+	if !ShouldRetry(conf, &attemptResult{StatusCode: 503}, nil) {
+		t.Error("503 is not retried")
+	}
+	if ShouldRetry(conf, &attemptResult{StatusCode: 500}, nil) {
+		t.Error("500 is retried")
+	}
+	if !ShouldRetry(conf, nil, syscall.ECONNREFUSED) {
+		t.Error("refused is not retried")
+	}
+	if ShouldRetry(conf, nil, syscall.ECONNRESET) {
+		t.Error("reset is retried")
+	}
+	conf.RetryNetworkErrors = []string{"all"}
+	if !ShouldRetry(conf, nil, syscall.ECONNRESET) {
+		t.Error("reset is not retried with all")
+	}
+}
@@ -0,0 +1,358 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// s3MinPartSize is the smallest part except the last one accepted by S3.
+const s3MinPartSize = 5 * 1024 * 1024
+
+// parseS3Key parses the object key template of the [s3] section.
+func parseS3Key(conf *Config) (*template.Template, error) {
+	return template.New("key").Option("missingkey=error").Parse(conf.S3Key)
+}
+
+// S3Credentials returns the access key and secret key of the [s3] section,
+// the aws environment variables are used when they are not set.
+func S3Credentials(conf *Config) (string, string) {
+	accessKey, secretKey := conf.S3AccessKey, conf.S3SecretKey
+	if accessKey == "" {
+		accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if secretKey == "" {
+		secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	return accessKey, secretKey
+}
+
+// s3Escape escapes s like the canonical request of SigV4, all bytes but
+// the unreserved characters are percent encoded, slashes are kept if path.
+func s3Escape(s string, path bool) string {
+	var buffer strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && path:
+			buffer.WriteByte(c)
+		default:
+			fmt.Fprintf(&buffer, "%%%02X", c)
+		}
+	}
+	return buffer.String()
+}
+
+// s3Query returns the canonical query string of query, sorted by name.
+func s3Query(query map[string]string) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	items := make([]string, 0, len(names))
+	for _, name := range names {
+		items = append(items, s3Escape(name, false)+"="+s3Escape(query[name], false))
+	}
+	return strings.Join(items, "&")
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// SignS3Request signs request with AWS Signature Version 4, the host,
+// x-amz-content-sha256 and x-amz-date headers are signed.
+func SignS3Request(request *http.Request, body []byte, accessKey string, secretKey string, region string, now time.Time) {
+	bodyHash := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(bodyHash[:])
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	var canonical bytes.Buffer
+	canonical.WriteString(request.Method + "\n")
+	canonical.WriteString(request.URL.EscapedPath() + "\n")
+	canonical.WriteString(request.URL.RawQuery + "\n")
+	canonical.WriteString("host:" + request.URL.Host + "\n")
+	canonical.WriteString("x-amz-content-sha256:" + payloadHash + "\n")
+	canonical.WriteString("x-amz-date:" + amzDate + "\n")
+	canonical.WriteString("\n" + signedHeaders + "\n")
+	canonical.WriteString(payloadHash)
+	canonicalHash := sha256.Sum256(canonical.Bytes())
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+	key := hmacSha256([]byte("AWS4"+secretKey), date)
+	key = hmacSha256(key, region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(key, stringToSign))
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+// s3ErrorBody is the error document answered by S3, it is also the body
+// of a failed CompleteMultipartUpload answered with 200.
+type s3ErrorBody struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+// s3ServerError converts a failed response, the reason is the error code
+// like s3_nosuchbucket or the http status without an error document.
+func s3ServerError(code int, content []byte) error {
+	var body s3ErrorBody
+	if err := xml.Unmarshal(content, &body); err == nil && body.Code != "" {
+		return &SinkError{Reason: "s3_" + strings.ToLower(body.Code), Message: fmt.Sprintf("%d %s: %s", code, body.Code, body.Message)}
+	}
+	return &SinkError{Reason: StatusReason(code), Message: fmt.Sprintf("%d %s", code, content)}
+}
+
+type S3Handler struct {
+	Topic     string
+	Conf      *Config
+	Cli       *http.Client
+	KeyTmpl   *template.Template
+	AccessKey string
+	SecretKey string
+}
+
+func NewS3Handler(topic string, conf *Config) *S3Handler {
+	// the template and credentials are checked by Validate
+	keyTmpl, _ := parseS3Key(conf)
+	accessKey, secretKey := S3Credentials(conf)
+	return &S3Handler{
+		Topic:     topic,
+		Conf:      conf,
+		Cli:       &http.Client{Transport: SharedTransport("s3", conf)},
+		KeyTmpl:   keyTmpl,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+	}
+}
+
+// objectUrl returns the url of key, in the path of the endpoint with
+// s3.pathstyle or else in the bucket subdomain.
+func (s *S3Handler) objectUrl(key string, query map[string]string) string {
+	// the endpoint is checked by Validate
+	u, _ := url.Parse(s.Conf.S3Endpoint)
+	path := strings.TrimRight(u.Path, "/")
+	if s.Conf.S3PathStyle {
+		path += "/" + s3Escape(s.Conf.S3Bucket, false)
+	} else {
+		u.Host = s.Conf.S3Bucket + "." + u.Host
+	}
+	u.RawPath = path + "/" + s3Escape(key, true)
+	u.Path, _ = url.PathUnescape(u.RawPath)
+	u.RawQuery = s3Query(query)
+	return u.String()
+}
+
+// call sends a signed request and retries it with the [retry] policy,
+// PUT requests are counted for the PUT latency of the report.
+func (s *S3Handler) call(method string, key string, query map[string]string, header http.Header, body []byte, statis *Statistician) (*attemptResult, error) {
+	target := s.objectUrl(key, query)
+	for attempt := 1; ; attempt++ {
+		result, err := s.send(method, target, header, body, statis)
+		if err == nil && (result.StatusCode < 200 || result.StatusCode > 299) {
+			err = s3ServerError(result.StatusCode, result.Content)
+		}
+		if err == nil {
+			return result, nil
+		}
+		// an error answered by the server is retried by its status code
+		netErr := err
+		if IsSinkError(err) {
+			netErr = nil
+		}
+		if attempt >= s.Conf.RetryMaxAttempts || !ShouldRetry(s.Conf, result, netErr) {
+			return result, err
+		}
+		statis.Attempts += 1
+		if result.Wrote {
+			statis.AmbiguousAttempts += 1
+		}
+		delay := RetryDelay(s.Conf, attempt, result)
+		log.Debugf("Retry %s %s after %v, attempt %d", method, key, delay, attempt+1)
+		time.Sleep(delay)
+	}
+}
+
+func (s *S3Handler) send(method string, target string, header http.Header, body []byte, statis *Statistician) (*attemptResult, error) {
+	result := &attemptResult{}
+	request, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return result, err
+	}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				statis.ConnReused = !statis.ConnOpened
+			} else {
+				statis.ConnOpened = true
+				statis.ConnReused = false
+			}
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			result.Wrote = info.Err == nil
+		},
+	}
+	request = request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	SignS3Request(request, body, s.AccessKey, s.SecretKey, s.Conf.S3Region, time.Now())
+
+	startTime := time.Now()
+	response, err := s.Cli.Do(request)
+	if method == "PUT" {
+		statis.Puts += 1
+		statis.PutTime += time.Since(startTime).Microseconds()
+	}
+	if err != nil {
+		return result, err
+	}
+	defer response.Body.Close()
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		log.Errorln(err)
+	}
+	result.StatusCode = response.StatusCode
+	result.Proto = response.Proto
+	result.Header = response.Header
+	result.Content = content
+	return result, nil
+}
+
+type s3InitiateResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+type s3CompletePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteUpload struct {
+	XMLName xml.Name         `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletePart `xml:"Part"`
+}
+
+// multipart uploads body in parts of s3.partsize, the upload is aborted
+// if a part or the completion fails.
+func (s *S3Handler) multipart(key string, header http.Header, body []byte, statis *Statistician) error {
+	result, err := s.call("POST", key, map[string]string{"uploads": ""}, header, nil, statis)
+	if err != nil {
+		return err
+	}
+	var initiate s3InitiateResult
+	if err := xml.Unmarshal(result.Content, &initiate); err != nil || initiate.UploadId == "" {
+		return fmt.Errorf("invalid InitiateMultipartUpload answer %q", result.Content)
+	}
+	uploadId := initiate.UploadId
+
+	complete := s3CompleteUpload{}
+	for offset, number := 0, 1; offset < len(body); offset, number = offset+s.Conf.S3PartSize, number+1 {
+		end := offset + s.Conf.S3PartSize
+		if end > len(body) {
+			end = len(body)
+		}
+		query := map[string]string{"partNumber": strconv.Itoa(number), "uploadId": uploadId}
+		result, err := s.call("PUT", key, query, nil, body[offset:end], statis)
+		if err != nil {
+			s.abort(key, uploadId, statis)
+			return err
+		}
+		complete.Parts = append(complete.Parts, s3CompletePart{PartNumber: number, ETag: result.Header.Get("ETag")})
+	}
+	document, _ := xml.Marshal(complete)
+	completeHeader := http.Header{"Content-Type": {"application/xml"}}
+	result, err = s.call("POST", key, map[string]string{"uploadId": uploadId}, completeHeader, document, statis)
+	if err == nil && bytes.Contains(result.Content, []byte("<Error>")) {
+		// the completion fails after the status line has been sent
+		err = s3ServerError(result.StatusCode, result.Content)
+	}
+	if err != nil {
+		s.abort(key, uploadId, statis)
+	}
+	return err
+}
+
+// abort drops the parts of a failed multipart upload.
+func (s *S3Handler) abort(key string, uploadId string, statis *Statistician) {
+	if _, err := s.call("DELETE", key, map[string]string{"uploadId": uploadId}, nil, nil, statis); err != nil {
+		log.Errorf("Abort multipart upload of %s with error, %v", key, err)
+	}
+}
+
+func (s *S3Handler) Do(conf *Config, data *bytes.Buffer, chanOut *chan *Statistician) {
+	statis := NewStatistician(s.Topic)
+	vars := &TemplateVars{Topic: s.Topic, RunId: conf.RunId, Seq: NextSeq(conf, s.Topic)}
+	key, err := vars.Render(s.KeyTmpl)
+	body := data.Bytes()
+	header := http.Header{}
+	if conf.DataFmt == "avro" {
+		// an object is a complete avro file
+		body = AvroContainer(int64(conf.MessageSize), body)
+		header.Set("Content-Type", "application/avro")
+	} else {
+		header.Set("Content-Type", "text/csv")
+	}
+	if err == nil && conf.HttpCompression != "none" {
+		compressStart := time.Now()
+		body, err = Compress(conf.HttpCompression, body)
+		statis.CompressTime = time.Since(compressStart).Microseconds()
+		header.Set("Content-Encoding", Codecs[conf.HttpCompression])
+	}
+	if err != nil {
+		log.Errorf("Encode object for topic %s with error, %v", s.Topic, err)
+		statis.Reason = "encode"
+		statis.Error = err.Error()
+		*chanOut <- statis
+		return
+	}
+
+	startTime := time.Now()
+	if len(body) > conf.S3PartSize {
+		err = s.multipart(key, header, body, statis)
+	} else {
+		_, err = s.call("PUT", key, nil, header, body, statis)
+	}
+	statis.SentTime = time.Since(startTime).Milliseconds()
+	if err != nil {
+		log.Errorf("Upload object %s with error, %v", key, err)
+		statis.State = false
+		statis.Reason = ClassifyError(err)
+		statis.Error = err.Error()
+	} else {
+		log.Debugf("Uploaded object %s, %d bytes", key, len(body))
+		statis.State = true
+		statis.Reason = "ok"
+		statis.SentBytes = int64(data.Len())
+		statis.WireBytes = int64(len(body))
+		statis.Objects = 1
+	}
+	*chanOut <- statis
+}
@@ -0,0 +1,325 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	avro "gopkg.in/avro.v0"
+)
+
+var (
+	socketLock  sync.Mutex
+	socketConns = make(map[string][]*SocketConn)
+	socketNext  uint64
+)
+
+// SocketConn is a tcp or udp connection shared by the workers of the tcp,
+// udp and syslog sinks, a broken connection is dialed again by the next message.
+type SocketConn struct {
+	sync.Mutex
+	conf    *Config
+	network string
+	conn    net.Conn
+}
+
+// get returns the connection, opened tells whether it has just been dialed.
+// The caller holds the lock.
+func (s *SocketConn) get() (conn net.Conn, opened bool, err error) {
+	if s.conn != nil {
+		return s.conn, false, nil
+	}
+	if s.network == "udp" {
+		s.conn, err = NewDialer(s.conf, "udp").Dial("udp", s.conf.SocketAddr)
+	} else {
+		s.conn, err = DialSink(s.conf, s.conf.SocketAddr, s.conf.SocketTls)
+	}
+	if err != nil {
+		s.conn = nil
+		return nil, false, err
+	}
+	log.Debugf("Connected to %s %s", s.network, s.conf.SocketAddr)
+	return s.conn, true, nil
+}
+
+// drop closes the connection after a write error.
+func (s *SocketConn) drop() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// SocketNetwork returns the transport of the sink selected by test.usemethod.
+func SocketNetwork(conf *Config) string {
+	switch conf.MethodId {
+	case MethodUdp:
+		return "udp"
+	case MethodSyslog:
+		return conf.SyslogNetwork
+	default:
+		return "tcp"
+	}
+}
+
+// SharedSocketConn returns the next connection of the socket sink of conf,
+// messages are spread round robin over socket.connections connections.
+// The tcp, udp and syslog sinks of test.usemethods have connections of
+// their own built from their config.
+func SharedSocketConn(conf *Config) *SocketConn {
+	sink := MethodNames[conf.MethodId]
+	socketLock.Lock()
+	conns, ok := socketConns[sink]
+	if !ok {
+		for i := 0; i < conf.SocketConnections; i++ {
+			conns = append(conns, &SocketConn{conf: conf, network: SocketNetwork(conf)})
+		}
+		socketConns[sink] = conns
+	}
+	socketLock.Unlock()
+	i := atomic.AddUint64(&socketNext, 1) - 1
+	return conns[i%uint64(len(conns))]
+}
+
+// SplitRows returns the rows of a message made by Write2Csv or Write2Avro
+// as slices of data, a csv line without the line break or a single avro
+// datum. The rows are not decoded, the generated csv fields have no line
+// breaks and the fields of DataRow are ints, longs, strings and bytes.
+func SplitRows(dataFmt string, data []byte) ([][]byte, error) {
+	var rows [][]byte
+	if dataFmt == "avro" {
+		for start := 0; start < len(data); {
+			end, err := skipAvroRow(data, start)
+			if err != nil {
+				return nil, err
+			}
+			rows = append(rows, data[start:end])
+			start = end
+		}
+		return rows, nil
+	}
+	for len(data) > 0 {
+		line := data
+		data = nil
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line, data = line[:i], line[i+1:]
+		}
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if len(line) > 0 {
+			rows = append(rows, line)
+		}
+	}
+	return rows, nil
+}
+
+// EncodeRows returns each row alone in dataFmt, a csv line without the line
+// break or a single avro datum.
+func EncodeRows(dataFmt string, rows []*DataRow) ([][]byte, error) {
+	payloads := make([][]byte, 0, len(rows))
+	if dataFmt == "avro" {
+		schema := avro.MustParseSchema(DataSchema)
+		writer := avro.NewGenericDatumWriter()
+		writer.SetSchema(schema)
+		for _, row := range rows {
+			buffer := &bytes.Buffer{}
+			if err := writer.Write(NewAvroRecord(schema, *row), avro.NewBinaryEncoder(buffer)); err != nil {
+				return nil, err
+			}
+			payloads = append(payloads, buffer.Bytes())
+		}
+		return payloads, nil
+	}
+	for _, row := range rows {
+		buffer := &bytes.Buffer{}
+		writer := csv.NewWriter(buffer)
+		writer.Write(NewCsvLine(*row))
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, bytes.TrimRight(buffer.Bytes(), "\r\n"))
+	}
+	return payloads, nil
+}
+
+// Frame appends row to buffer with framing, newline is the non transparent
+// framing and octet the octet counting of RFC 6587.
+func Frame(buffer *bytes.Buffer, framing string, row []byte) {
+	switch framing {
+	case "length":
+		binary.Write(buffer, binary.BigEndian, uint32(len(row)))
+		buffer.Write(row)
+	case "octet":
+		buffer.WriteString(strconv.Itoa(len(row)))
+		buffer.WriteByte(' ')
+		buffer.Write(row)
+	default:
+		buffer.Write(row)
+		buffer.WriteByte('\n')
+	}
+}
+
+// SyslogMessage wraps row into a RFC 5424 message, the topic is the MSGID.
+func SyslogMessage(conf *Config, topic string, row []byte) []byte {
+	buffer := &bytes.Buffer{}
+	fmt.Fprintf(buffer, "<%d>1 %s %s %s %d %s - ",
+		conf.SyslogFacility*8+conf.SyslogSeverity,
+		time.Now().Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHostname(conf), conf.SyslogAppName, os.Getpid(), topic)
+	buffer.Write(row)
+	return buffer.Bytes()
+}
+
+func syslogHostname(conf *Config) string {
+	if conf.SyslogHostname != "" {
+		return conf.SyslogHostname
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+	return "-"
+}
+
+type SocketHandler struct {
+	Topic string
+	Conf  *Config
+	Conn  *SocketConn
+}
+
+func NewSocketHandler(topic string, conf *Config) *SocketHandler {
+	return &SocketHandler{
+		Topic: topic,
+		Conf:  conf,
+		Conn:  SharedSocketConn(conf),
+	}
+}
+
+// addRowError counts rows failed with err.
+func addRowError(statis *Statistician, err error, rows int64) {
+	if statis.RowReasons == nil {
+		statis.RowReasons = make(map[string]*ReasonCount)
+	}
+	name := ClassifyError(err)
+	reason, ok := statis.RowReasons[name]
+	if !ok {
+		reason = &ReasonCount{Sample: err.Error()}
+		statis.RowReasons[name] = reason
+	}
+	reason.Count += rows
+	statis.FailedRows += rows
+}
+
+// writeStream writes all rows with a single write, the rows completely
+// written before an error are sent.
+func (s *SocketHandler) writeStream(rows [][]byte, statis *Statistician) {
+	buffer := &bytes.Buffer{}
+	ends := make([]int, 0, len(rows))
+	for _, row := range rows {
+		Frame(buffer, s.Conf.SocketFraming, row)
+		ends = append(ends, buffer.Len())
+	}
+	s.Conn.Lock()
+	defer s.Conn.Unlock()
+	conn, opened, err := s.Conn.get()
+	if err != nil {
+		addRowError(statis, err, int64(len(rows)))
+		return
+	}
+	statis.ConnOpened = opened
+	statis.ConnReused = !opened
+	// a stalled peer fails the write instead of blocking the worker
+	conn.SetWriteDeadline(time.Now().Add(time.Duration(s.Conf.SocketTimeout) * time.Second))
+	n, err := conn.Write(buffer.Bytes())
+	statis.WireBytes = int64(n)
+	if err == nil {
+		return
+	}
+	log.Errorf("Write to %s with error, %v", s.Conf.SocketAddr, err)
+	s.Conn.drop()
+	statis.WriteErrors += 1
+	sent := 0
+	for sent < len(ends) && ends[sent] <= n {
+		sent++
+	}
+	addRowError(statis, err, int64(len(rows)-sent))
+}
+
+// writeDatagrams sends each row in its own datagram, a failed datagram
+// does not stop the rest of the message.
+func (s *SocketHandler) writeDatagrams(rows [][]byte, statis *Statistician) {
+	s.Conn.Lock()
+	defer s.Conn.Unlock()
+	conn, opened, err := s.Conn.get()
+	if err != nil {
+		addRowError(statis, err, int64(len(rows)))
+		return
+	}
+	statis.ConnOpened = opened
+	statis.ConnReused = !opened
+	conn.SetWriteDeadline(time.Now().Add(time.Duration(s.Conf.SocketTimeout) * time.Second))
+	for _, row := range rows {
+		n, err := conn.Write(row)
+		if err != nil {
+			// e.g. refused reported by the icmp answer to an earlier datagram
+			statis.WriteErrors += 1
+			addRowError(statis, err, 1)
+			continue
+		}
+		statis.Datagrams += 1
+		statis.WireBytes += int64(n)
+	}
+}
+
+func (s *SocketHandler) Do(conf *Config, data *bytes.Buffer, chanOut *chan *Statistician) {
+	statis := NewStatistician(s.Topic)
+	rows, err := SplitRows(conf.DataFmt, data.Bytes())
+	if err != nil {
+		log.Errorf("Encode message for %s with error, %v", s.Conn.network, err)
+		statis.Reason = "encode"
+		statis.Error = err.Error()
+		*chanOut <- statis
+		return
+	}
+	if conf.MethodId == MethodSyslog {
+		for i, row := range rows {
+			rows[i] = SyslogMessage(conf, s.Topic, row)
+		}
+	}
+	statis.Rows = int64(len(rows))
+	startTime := time.Now()
+	if len(rows) == 0 {
+		// an empty message is sent without writing anything
+	} else if s.Conn.network == "udp" {
+		s.writeDatagrams(rows, statis)
+	} else {
+		s.writeStream(rows, statis)
+	}
+	statis.SentTime = time.Since(startTime).Milliseconds()
+	if statis.FailedRows > 0 && statis.FailedRows == statis.Rows {
+		// nothing is sent, the most frequent error is the reason of the message
+		var count int64
+		for name, reason := range statis.RowReasons {
+			if reason.Count > count {
+				count = reason.Count
+				statis.Reason = name
+				statis.Error = reason.Sample
+			}
+		}
+		statis.State = false
+		statis.FailedRows = 0
+		statis.RowReasons = nil
+	} else {
+		statis.State = true
+		statis.Reason = "ok"
+		statis.SentBytes = int64(data.Len())
+	}
+	*chanOut <- statis
+}
@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestFrame(t *testing.T) {
+	tests := []struct {
+		framing string
+		framed  string
+	}{
+		{"newline", "a,b\nc\n"},
+		{"length", "\x00\x00\x00\x03a,b\x00\x00\x00\x01c"},
+		{"octet", "3 a,b1 c"},
+	}
+	for _, test := range tests {
+		buffer := &bytes.Buffer{}
+		Frame(buffer, test.framing, []byte("a,b"))
+		Frame(buffer, test.framing, []byte("c"))
+		if buffer.String() != test.framed {
+			t.Errorf("Frame(%s) = %q, expect %q", test.framing, buffer.String(), test.framed)
+		}
+	}
+}
+
+// the rows split from a message are the ones encoded one by one
+func TestSplitRows(t *testing.T) {
+	for _, dataFmt := range []string{"csv", "avro"} {
+		data := Write2Csv(7)
+		if dataFmt == "avro" {
+			data = Write2Avro(7)
+		}
+		rows, err := SplitRows(dataFmt, data.Bytes())
+		if err != nil {
+			t.Fatalf("%s: %v", dataFmt, err)
+		}
+		decoded, err := DecodeRows(dataFmt, data.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect, err := EncodeRows(dataFmt, decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != len(expect) {
+			t.Fatalf("%s: split %d rows, expect %d", dataFmt, len(rows), len(expect))
+		}
+		for i := range rows {
+			if !bytes.Equal(rows[i], expect[i]) {
+				t.Errorf("%s row %d = %q, expect %q", dataFmt, i, rows[i], expect[i])
+			}
+		}
+	}
+
+	rows, err := SplitRows("csv", []byte("a,b\r\n\nc"))
+	if err != nil || len(rows) != 2 || string(rows[0]) != "a,b" || string(rows[1]) != "c" {
+		t.Errorf("SplitRows = %q, %v", rows, err)
+	}
+	data := Write2Avro(2).Bytes()
+	if _, err := SplitRows("avro", data[:len(data)-1]); err == nil {
+		t.Error("truncated avro is split")
+	}
+}
+
+func TestSyslogMessage(t *testing.T) {
+	conf := &Config{SyslogFacility: 16, SyslogSeverity: 6, SyslogAppName: "stress", SyslogHostname: "probe1"}
+	message := string(SyslogMessage(conf, "t1", []byte("a,b")))
+	pattern := `^<134>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}(Z|[+-]\d\d:\d\d) probe1 stress \d+ t1 - a,b$`
+	if !regexp.MustCompile(pattern).MatchString(message) {
+		t.Errorf("SyslogMessage = %q", message)
+	}
+}
+
+func TestSocketHandlerDo(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	lines := make(chan string, 16)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	conf := testConf(t, fmt.Sprintf(`
+[required]
+topics=["t1"]
+datafmt="csv"
+[test]
+usemethod=9
+[socket]
+addr=%q
+`, listener.Addr()))
+	handler := NewSocketHandler("t1", conf)
+	out := make(chan *Statistician, 1)
+
+	// an empty message is not a failure without reason
+	handler.Do(conf, &bytes.Buffer{}, &out)
+	if statis := <-out; !statis.State || statis.Reason != "ok" || statis.Rows != 0 {
+		t.Errorf("empty message: %+v", statis)
+	}
+
+	data := Write2Csv(3)
+	expect := strings.Split(strings.TrimSpace(data.String()), "\n")
+	handler.Do(conf, data, &out)
+	if statis := <-out; !statis.State || statis.Rows != 3 || statis.FailedRows != 0 || !statis.ConnOpened {
+		t.Errorf("message: %+v", statis)
+	}
+	for _, line := range expect {
+		if got := <-lines; got != line {
+			t.Errorf("server got %q, expect %q", got, line)
+		}
+	}
+}
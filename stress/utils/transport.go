@@ -0,0 +1,235 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	transportLock sync.Mutex
+	transports    = make(map[string]http.RoundTripper)
+	localNext     uint64
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewTlsConfig builds the client tls.Config from the [tls] section of conf,
+// a client certificate is only presented when certfile and keyfile are set.
+func NewTlsConfig(conf *Config) *tls.Config {
+	// the files are checked by Validate
+	tlsConf, err := loadTlsConfig(conf)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return tlsConf
+}
+
+// loadTlsConfig reads the CA and the client certificate of the [tls] section.
+func loadTlsConfig(conf *Config) (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		ServerName:         conf.TlsServerName,
+		MinVersion:         tlsVersions[conf.TlsMinVersion],
+		InsecureSkipVerify: conf.TlsInsecureSkipVerify,
+	}
+	if conf.TlsCaFile != "" {
+		pem, err := os.ReadFile(conf.TlsCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file %s with error %v", conf.TlsCaFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in CA file %s", conf.TlsCaFile)
+		}
+		tlsConf.RootCAs = pool
+	}
+	if conf.TlsCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.TlsCertFile, conf.TlsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate %s with error %v", conf.TlsCertFile, err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
+
+// LocalAddr returns the source address of the next connection of network,
+// the addresses of http.local_addrs are used round robin, nil if not set.
+func LocalAddr(conf *Config, network string) net.Addr {
+	if len(conf.HttpLocalAddrs) == 0 || network == "unix" {
+		return nil
+	}
+	i := atomic.AddUint64(&localNext, 1) - 1
+	// the addresses are checked by Validate
+	ip := net.ParseIP(conf.HttpLocalAddrs[i%uint64(len(conf.HttpLocalAddrs))])
+	if network == "udp" {
+		return &net.UDPAddr{IP: ip}
+	}
+	return &net.TCPAddr{IP: ip}
+}
+
+// NewDialer returns the dialer of a connection of network with the dial
+// timeout of the [http] section and the next address of http.local_addrs.
+func NewDialer(conf *Config, network string) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   time.Duration(conf.HttpDialTimeout) * time.Second,
+		KeepAlive: 30 * time.Second,
+		LocalAddr: LocalAddr(conf, network),
+	}
+}
+
+// NewHttpTransport builds a http.Transport from the [http] section of conf,
+// connections go to unixSocket instead of the host of the url when set.
+func NewHttpTransport(conf *Config, unixSocket string) *http.Transport {
+	maxIdle := conf.HttpMaxIdleConnsPerHost
+	if maxIdle == 0 {
+		// keep at least one idle connection per worker, otherwise
+		// the default of 2 closes most connections after each request
+		maxIdle = conf.Threads
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			if unixSocket != "" {
+				// the host of the url is only used in the Host header
+				return NewDialer(conf, "unix").DialContext(ctx, "unix", unixSocket)
+			}
+			return NewDialer(conf, network).DialContext(ctx, network, addr)
+		},
+		MaxConnsPerHost:     conf.HttpMaxConnsPerHost,
+		MaxIdleConnsPerHost: maxIdle,
+		IdleConnTimeout:     time.Duration(conf.HttpIdleTimeout) * time.Second,
+		DisableKeepAlives:   !conf.HttpKeepAlive,
+		TLSClientConfig:     NewTlsConfig(conf),
+		TLSHandshakeTimeout: time.Duration(conf.HttpDialTimeout) * time.Second,
+	}
+	if unixSocket != "" {
+		transport.Proxy = nil
+	}
+	switch conf.HttpProtocol {
+	case "h2":
+		transport.ForceAttemptHTTP2 = true
+	case "h2c":
+		enableH2c(transport)
+	}
+	return transport
+}
+
+// DialSink opens a tcp connection of a non http sink with the dial timeout
+// of the [http] section, tls is started on top when useTls is set.
+func DialSink(conf *Config, addr string, useTls bool) (net.Conn, error) {
+	conn, err := NewDialer(conf, "tcp").Dial("tcp", addr)
+	if err != nil || !useTls {
+		return conn, err
+	}
+	return StartTls(conf, conn, addr)
+}
+
+// StartTls runs the client handshake on conn, the host of addr is verified
+// unless tls.servername is set.
+func StartTls(conf *Config, conn net.Conn, addr string) (net.Conn, error) {
+	tlsConf := NewTlsConfig(conf)
+	if tlsConf.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		tlsConf.ServerName = host
+	}
+	tlsConn := tls.Client(conn, tlsConf)
+	conn.SetDeadline(time.Now().Add(time.Duration(conf.HttpDialTimeout) * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// streamGroup spreads http/2 requests over a fixed number of connections,
+// each transport keeps a single connection carrying at most streams requests.
+type streamGroup struct {
+	transports []*http.Transport
+	streams    []chan struct{}
+	next       uint64
+}
+
+func newStreamGroup(conf *Config, unixSocket string) *streamGroup {
+	group := &streamGroup{}
+	for i := 0; i < conf.HttpConnections; i++ {
+		transport := NewHttpTransport(conf, unixSocket)
+		transport.MaxConnsPerHost = 1
+		transport.MaxIdleConnsPerHost = 1
+		group.transports = append(group.transports, transport)
+		group.streams = append(group.streams, make(chan struct{}, conf.HttpStreamsPerConn))
+	}
+	return group
+}
+
+func (g *streamGroup) RoundTrip(request *http.Request) (*http.Response, error) {
+	i := int(atomic.AddUint64(&g.next, 1) % uint64(len(g.transports)))
+	select {
+	case g.streams[i] <- struct{}{}:
+	case <-request.Context().Done():
+		return nil, request.Context().Err()
+	}
+	response, err := g.transports[i].RoundTrip(request)
+	if err != nil {
+		<-g.streams[i]
+		return nil, err
+	}
+	// the stream is busy until its response body is closed
+	response.Body = &streamBody{ReadCloser: response.Body, release: func() { <-g.streams[i] }}
+	return response, nil
+}
+
+type streamBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *streamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// SharedTransport returns the transport of sink, all workers sending to
+// the same sink share its connection pool. The transport is built from
+// the config of the sink, every sink of test.usemethods has its own. Only
+// the dataproxy sink uses http.unixsocket, the other sinks have urls of
+// their own.
+func SharedTransport(sink string, conf *Config) http.RoundTripper {
+	transportLock.Lock()
+	defer transportLock.Unlock()
+	transport, ok := transports[sink]
+	if !ok {
+		unixSocket := ""
+		if sink == "dataproxy" {
+			unixSocket = conf.HttpUnixSocket
+		}
+		if conf.HttpProtocol == "http1" {
+			transport = NewHttpTransport(conf, unixSocket)
+		} else {
+			transport = newStreamGroup(conf, unixSocket)
+		}
+		transports[sink] = transport
+	}
+	return transport
+}
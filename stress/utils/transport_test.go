@@ -0,0 +1,246 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	stdlog "log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeCert signs a certificate named name with parent, a self-signed CA
+// when parent is nil, and writes it with its key as pem files into dir.
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	writePem(t, filepath.Join(dir, name+".pem"), "CERTIFICATE", der)
+	writePem(t, filepath.Join(dir, name+".key"), "EC PRIVATE KEY", keyDer)
+	return cert, key
+}
+
+func writePem(t *testing.T, path, kind string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTlsClientCert presents the certificate of tls.certfile to a server
+// requiring client certificates signed by the test CA.
+func TestTlsClientCert(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "client", ca, caKey)
+	clients := x509.NewCertPool()
+	clients.AddCert(ca)
+
+	var commonName string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		commonName = r.TLS.PeerCertificates[0].Subject.CommonName
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clients}
+	// the rejected handshake is expected
+	server.Config.ErrorLog = stdlog.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+	writePem(t, filepath.Join(dir, "server.pem"), "CERTIFICATE", server.Certificate().Raw)
+
+	tests := []struct {
+		name string
+		tls  string
+		ok   bool
+	}{
+		{"client cert", `certfile="%[1]s/client.pem"` + "\n" + `keyfile="%[1]s/client.key"`, true},
+		{"no client cert", "", false},
+	}
+	for _, test := range tests {
+		conf := testConf(t, fmt.Sprintf("[tls]\ncafile=\"%[1]s/server.pem\"\n"+test.tls+"\n", dir))
+		commonName = ""
+		cli := &http.Client{Transport: NewHttpTransport(conf, "")}
+		response, err := cli.Get(server.URL)
+		if err == nil {
+			response.Body.Close()
+		}
+		if (err == nil) != test.ok || test.ok && commonName != "client" {
+			t.Errorf("%s: request error %v, server saw client %q", test.name, err, commonName)
+		}
+	}
+}
+
+func TestValidateTls(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "client", ca, caKey)
+	os.WriteFile(filepath.Join(dir, "empty.pem"), []byte("no pem"), 0600)
+
+	tests := []struct {
+		tls   string
+		fatal string
+	}{
+		{`cafile="%[1]s/ca.pem"` + "\n" + `certfile="%[1]s/client.pem"` + "\n" + `keyfile="%[1]s/client.key"`, ""},
+		{`cafile="%[1]s/missing.pem"`, "read CA file"},
+		{`cafile="%[1]s/empty.pem"`, "no certificate found in CA file"},
+		{`certfile="%[1]s/client.pem"` + "\n" + `keyfile="%[1]s/ca.key"`, "load client certificate"},
+		{`certfile="%[1]s/client.pem"` + "\n" + `keyfile="%[1]s/missing.key"`, "load client certificate"},
+	}
+	for _, test := range tests {
+		tlsToml := fmt.Sprintf(test.tls, dir)
+		message := validateFatal(t, testConf(t, sinksToml+"[tls]\n"+tlsToml+"\n"))
+		if test.fatal == "" && message != "" || !strings.Contains(message, test.fatal) {
+			t.Errorf("%s exits with %q, expect %q", tlsToml, message, test.fatal)
+		}
+		if test.fatal != "" && !strings.Contains(message, "tls证书错误") {
+			t.Errorf("%s exits with %q", tlsToml, message)
+		}
+	}
+}
+
+// countConns counts the connections accepted by server.
+func countConns(server *httptest.Server) *int64 {
+	conns := new(int64)
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(conns, 1)
+		}
+	}
+	return conns
+}
+
+// sharedTransport returns the transport of sink and drops it at the end of t.
+func sharedTransport(t *testing.T, sink string, conf *Config) http.RoundTripper {
+	t.Cleanup(func() {
+		transportLock.Lock()
+		delete(transports, sink)
+		transportLock.Unlock()
+	})
+	return SharedTransport(sink, conf)
+}
+
+// TestSharedTransport keeps the connections of all workers of a sink in
+// one transport, the workers reuse them instead of dialing per request.
+func TestSharedTransport(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	conns := countConns(server)
+	server.Start()
+	defer server.Close()
+
+	conf := testConf(t, "[required]\nthreadsnum=4\n")
+	transport := sharedTransport(t, "test-shared", conf)
+	if SharedTransport("test-shared", conf) != transport {
+		t.Error("the workers of a sink got different transports")
+	}
+	if sharedTransport(t, "test-other", conf) == transport {
+		t.Error("two sinks share a transport")
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < conf.Threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cli := &http.Client{Transport: SharedTransport("test-shared", conf)}
+			for j := 0; j < 20; j++ {
+				response, err := cli.Get(server.URL)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				io.Copy(io.Discard, response.Body)
+				response.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt64(conns); n < 1 || n > int64(conf.Threads) {
+		t.Errorf("%d workers opened %d connections for 80 requests", conf.Threads, n)
+	}
+}
+
+// TestStreamGroupH2c spreads concurrent requests over http.connections h2c
+// connections carrying at most http.streamsperconn requests each.
+func TestStreamGroupH2c(t *testing.T) {
+	var inflight, maxInflight, http1 int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			atomic.AddInt64(&http1, 1)
+		}
+		n := atomic.AddInt64(&inflight, 1)
+		for {
+			max := atomic.LoadInt64(&maxInflight)
+			if n <= max || atomic.CompareAndSwapInt64(&maxInflight, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt64(&inflight, -1)
+	}))
+	enableServerH2c(server.Config)
+	conns := countConns(server)
+	server.Start()
+	defer server.Close()
+
+	conf := testConf(t, "[http]\nprotocol=\"h2c\"\nconnections=2\nstreamsperconn=3\n")
+	cli := &http.Client{Transport: sharedTransport(t, "test-h2c", conf)}
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := cli.Get(server.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if http1 > 0 {
+		t.Errorf("%d requests were not sent over http/2", http1)
+	}
+	if n := atomic.LoadInt64(conns); n < 1 || n > int64(conf.HttpConnections) {
+		t.Errorf("%d connections opened, http.connections=%d", n, conf.HttpConnections)
+	}
+	if maxInflight > int64(conf.HttpConnections*conf.HttpStreamsPerConn) {
+		t.Errorf("%d requests in flight, at most %d streams", maxInflight, conf.HttpConnections*conf.HttpStreamsPerConn)
+	}
+}
@@ -0,0 +1,452 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// websocket opcodes of RFC 6455
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+const wsGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	wsLock  sync.Mutex
+	wsConns = make(map[string][]*WebSocketConn)
+	wsNext  uint64
+)
+
+// wsAck is the frame acknowledging a message, err is set if the connection
+// broke before the ack.
+type wsAck struct {
+	payload []byte
+	err     error
+}
+
+// WebSocketConn is a websocket connection shared by the workers of the
+// websocket sink, with websocket.ackmode=echo each data frame received
+// acks the oldest message waiting.
+type WebSocketConn struct {
+	sync.Mutex
+	conf     *Config
+	url      string
+	conn     net.Conn
+	writer   *bufio.Writer
+	pendLock sync.Mutex
+	pending  []chan *wsAck
+	inflight chan struct{}
+	nack     *regexp.Regexp // acks matching websocket.nackpattern fail the message
+}
+
+// wsAcceptKey returns the Sec-WebSocket-Accept expected for key.
+func wsAcceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + wsGuid))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// writeFrame writes a masked client frame, n is the size of the frame
+// with its header.
+func writeFrame(w *bufio.Writer, fin bool, opcode byte, payload []byte) (n int, err error) {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	w.WriteByte(first)
+	switch size := len(payload); {
+	case size < 126:
+		w.WriteByte(0x80 | byte(size))
+		n = 2
+	case size <= 0xFFFF:
+		w.WriteByte(0x80 | 126)
+		binary.Write(w, binary.BigEndian, uint16(size))
+		n = 4
+	default:
+		w.WriteByte(0x80 | 127)
+		binary.Write(w, binary.BigEndian, uint64(size))
+		n = 10
+	}
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return 0, err
+	}
+	w.Write(mask[:])
+	masked := make([]byte, len(payload))
+	for i, b := range payload {
+		masked[i] = b ^ mask[i%4]
+	}
+	if _, err := w.Write(masked); err != nil {
+		return 0, err
+	}
+	return n + 4 + len(payload), nil
+}
+
+// readFrame reads a frame of the server, frames of a server are not masked
+// but a masked one is accepted. A frame larger than maxSize is an error,
+// the length is not trusted for the allocation.
+func readFrame(reader *bufio.Reader, maxSize int) (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(reader, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0F
+	size := uint64(head[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext uint16
+		err = binary.Read(reader, binary.BigEndian, &ext)
+		size = uint64(ext)
+	case 127:
+		err = binary.Read(reader, binary.BigEndian, &size)
+	}
+	if err != nil {
+		return
+	}
+	if size > uint64(maxSize) {
+		err = &SinkError{Reason: "websocket_too_large", Message: fmt.Sprintf("websocket frame of %d bytes exceeds websocket.maxreadsize %d", size, maxSize)}
+		return
+	}
+	var mask [4]byte
+	if head[1]&0x80 != 0 {
+		if _, err = io.ReadFull(reader, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, size)
+	if _, err = io.ReadFull(reader, payload); err != nil {
+		return
+	}
+	if head[1]&0x80 != 0 {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// connect dials the server and upgrades the connection, the caller holds the lock.
+func (c *WebSocketConn) connect() error {
+	// the url is checked by Validate
+	u, _ := url.Parse(c.url)
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	conn, err := DialSink(c.conf, host, u.Scheme == "wss")
+	if err != nil {
+		return err
+	}
+	httpUrl := *u
+	httpUrl.Scheme = strings.Replace(u.Scheme, "ws", "http", 1)
+	request, err := http.NewRequest("GET", httpUrl.String(), nil)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	for name, value := range c.conf.WebSocketHeaders {
+		request.Header.Set(name, value)
+	}
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Sec-WebSocket-Key", key)
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	if c.conf.WebSocketSubprotocol != "" {
+		request.Header.Set("Sec-WebSocket-Protocol", c.conf.WebSocketSubprotocol)
+	}
+	auth := SharedAuthenticator("websocket", "none", c.conf)
+	if err := auth.Apply(request, nil, auth.Next()); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(time.Duration(c.conf.HttpDialTimeout) * time.Second))
+	if err := request.Write(conn); err != nil {
+		conn.Close()
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return &SinkError{Reason: StatusReason(response.StatusCode), Message: "websocket upgrade answered " + response.Status}
+	}
+	if response.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		conn.Close()
+		return fmt.Errorf("invalid Sec-WebSocket-Accept %q", response.Header.Get("Sec-WebSocket-Accept"))
+	}
+	conn.SetDeadline(time.Time{})
+	c.conn = conn
+	c.writer = bufio.NewWriterSize(conn, 64*1024)
+	go c.readLoop(conn, reader)
+	log.Debugf("Connected to websocket %s", c.url)
+	return nil
+}
+
+// readLoop answers pings and hands data frames to the waiting messages.
+func (c *WebSocketConn) readLoop(conn net.Conn, reader *bufio.Reader) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := readFrame(reader, c.conf.WebSocketMaxReadSize)
+		if err == nil && len(message)+len(payload) > c.conf.WebSocketMaxReadSize {
+			err = &SinkError{Reason: "websocket_too_large", Message: fmt.Sprintf("websocket message exceeds websocket.maxreadsize %d", c.conf.WebSocketMaxReadSize)}
+		}
+		if err != nil {
+			c.fail(conn, err)
+			return
+		}
+		switch opcode {
+		case wsPing:
+			c.Lock()
+			if c.conn == conn {
+				writeFrame(c.writer, true, wsPong, payload)
+				c.writer.Flush()
+			}
+			c.Unlock()
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			code := 1005 // no status received
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+				payload = payload[2:]
+			}
+			c.fail(conn, &SinkError{
+				Reason:  fmt.Sprintf("websocket_close_%d", code),
+				Message: fmt.Sprintf("websocket closed by server with %d %s", code, payload),
+			})
+			return
+		}
+		message = append(message, payload...)
+		if !fin {
+			continue
+		}
+		if c.conf.WebSocketAckMode == "echo" {
+			c.pendLock.Lock()
+			if len(c.pending) > 0 {
+				c.pending[0] <- &wsAck{payload: message}
+				c.pending = c.pending[1:]
+			}
+			c.pendLock.Unlock()
+		}
+		message = nil
+	}
+}
+
+// fail closes conn if it is still in use and fails the messages waiting
+// for an ack, the next message dials again.
+func (c *WebSocketConn) fail(conn net.Conn, err error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.conn != conn {
+		return
+	}
+	log.Errorf("Websocket connection closed with error, %v", err)
+	c.conn = nil
+	c.writer = nil
+	conn.Close()
+	c.pendLock.Lock()
+	for _, waiter := range c.pending {
+		waiter <- &wsAck{err: err}
+	}
+	c.pending = nil
+	c.pendLock.Unlock()
+}
+
+// Send writes data as a message of opcode, split into frames of
+// websocket.maxframesize, and waits for its ack with websocket.ackmode=echo.
+func (c *WebSocketConn) Send(opcode byte, data []byte, statis *Statistician) error {
+	echo := c.conf.WebSocketAckMode == "echo"
+	if echo {
+		c.inflight <- struct{}{}
+		defer func() { <-c.inflight }()
+	}
+	c.Lock()
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			c.Unlock()
+			return err
+		}
+		statis.ConnOpened = true
+	} else {
+		statis.ConnReused = true
+	}
+	var reply chan *wsAck
+	if echo {
+		// the lock keeps the waiters in the order of the messages
+		reply = make(chan *wsAck, 1)
+		c.pendLock.Lock()
+		c.pending = append(c.pending, reply)
+		c.pendLock.Unlock()
+	}
+	size := c.conf.WebSocketMaxFrameSize
+	if size == 0 || size > len(data) {
+		size = len(data)
+	}
+	var err error
+	for offset := 0; err == nil; offset += size {
+		end := offset + size
+		if end >= len(data) {
+			end = len(data)
+		}
+		var n int
+		n, err = writeFrame(c.writer, end == len(data), opcode, data[offset:end])
+		statis.Frames += 1
+		// frames larger than the buffer are partly flushed already
+		statis.WireBytes += int64(n)
+		// the frames after the first continue the message
+		opcode = wsContinuation
+		if end == len(data) {
+			break
+		}
+	}
+	if err == nil {
+		err = c.writer.Flush()
+	}
+	conn := c.conn
+	c.Unlock()
+	if err != nil {
+		c.fail(conn, err)
+		return err
+	}
+	if reply == nil {
+		return nil
+	}
+
+	ackStart := time.Now()
+	timer := time.NewTimer(time.Duration(c.conf.WebSocketAckTimeout) * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case ack := <-reply:
+		if ack.err != nil {
+			return ack.err
+		}
+		statis.AckTime = time.Since(ackStart).Microseconds()
+		if c.nack != nil && c.nack.Match(ack.payload) {
+			return &SinkError{Reason: "websocket_nack", Message: string(ack.payload)}
+		}
+		return nil
+	case <-timer.C:
+		// the late ack is still taken by this message to keep the order
+		return fmt.Errorf("wait for websocket ack: %w", context.DeadlineExceeded)
+	}
+}
+
+// parseWebSocketUrl parses the url template of the [websocket] section.
+func parseWebSocketUrl(conf *Config) (*template.Template, error) {
+	return template.New("url").Option("missingkey=error").Parse(conf.WebSocketUrl)
+}
+
+// WebSocketUrl returns the url the messages of topic are sent to.
+func WebSocketUrl(topic string, conf *Config) (string, error) {
+	tmpl, err := parseWebSocketUrl(conf)
+	if err != nil {
+		return "", err
+	}
+	vars := &TemplateVars{Topic: topic, RunId: conf.RunId}
+	return vars.Render(tmpl)
+}
+
+// SharedWebSocketConn returns the next connection to wsUrl, messages are
+// spread round robin over websocket.connections connections per url.
+// They are built from the config of the websocket sink, the only one
+// using them.
+func SharedWebSocketConn(conf *Config, wsUrl string) *WebSocketConn {
+	wsLock.Lock()
+	conns, ok := wsConns[wsUrl]
+	if !ok {
+		var nack *regexp.Regexp
+		if conf.WebSocketNackPattern != "" {
+			// the pattern is checked by Validate
+			nack, _ = regexp.Compile(conf.WebSocketNackPattern)
+		}
+		for i := 0; i < conf.WebSocketConnections; i++ {
+			conns = append(conns, &WebSocketConn{
+				conf:     conf,
+				url:      wsUrl,
+				inflight: make(chan struct{}, conf.WebSocketMaxInflight),
+				nack:     nack,
+			})
+		}
+		wsConns[wsUrl] = conns
+	}
+	wsLock.Unlock()
+	i := atomic.AddUint64(&wsNext, 1) - 1
+	return conns[i%uint64(len(conns))]
+}
+
+type WebSocketHandler struct {
+	Topic  string
+	Opcode byte
+	Conf   *Config
+	Conn   *WebSocketConn
+}
+
+func NewWebSocketHandler(topic string, conf *Config) *WebSocketHandler {
+	// the template is checked by Validate
+	wsUrl, _ := WebSocketUrl(topic, conf)
+	var opcode byte = wsBinary
+	if conf.WebSocketFrameType == "text" {
+		opcode = wsText
+	}
+	return &WebSocketHandler{
+		Topic:  topic,
+		Opcode: opcode,
+		Conf:   conf,
+		Conn:   SharedWebSocketConn(conf, wsUrl),
+	}
+}
+
+func (w *WebSocketHandler) Do(conf *Config, data *bytes.Buffer, chanOut *chan *Statistician) {
+	statis := NewStatistician(w.Topic)
+	startTime := time.Now()
+	err := w.Conn.Send(w.Opcode, data.Bytes(), statis)
+	statis.SentTime = time.Since(startTime).Milliseconds()
+	if err != nil {
+		log.Errorf("Send message to websocket with error, %v", err)
+		statis.State = false
+		statis.Reason = ClassifyError(err)
+		statis.Error = err.Error()
+	} else {
+		statis.State = true
+		statis.Reason = "ok"
+		statis.SentBytes = int64(data.Len())
+	}
+	*chanOut <- statis
+}
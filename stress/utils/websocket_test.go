@@ -0,0 +1,199 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestWsAcceptKey(t *testing.T) {
+	// the handshake example of RFC 6455 section 1.3
+	if key := wsAcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); key != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("wsAcceptKey = %s", key)
+	}
+}
+
+// TestReadFrame reads the frames of the examples of RFC 6455 section 5.7.
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   []byte
+		fin     bool
+		opcode  byte
+		payload []byte
+	}{
+		{"unmasked text", []byte("\x81\x05Hello"), true, wsText, []byte("Hello")},
+		{"masked text", []byte("\x81\x85\x37\xfa\x21\x3d\x7f\x9f\x4d\x51\x58"), true, wsText, []byte("Hello")},
+		{"first fragment", []byte("\x01\x03Hel"), false, wsText, []byte("Hel")},
+		{"last fragment", []byte("\x80\x02lo"), true, wsContinuation, []byte("lo")},
+		{"ping", []byte("\x89\x05Hello"), true, wsPing, []byte("Hello")},
+		{"256 bytes", append([]byte("\x82\x7e\x01\x00"), make([]byte, 256)...), true, wsBinary, make([]byte, 256)},
+		{"64KiB", append([]byte("\x82\x7f\x00\x00\x00\x00\x00\x01\x00\x00"), make([]byte, 65536)...), true, wsBinary, make([]byte, 65536)},
+	}
+	for _, test := range tests {
+		fin, opcode, payload, err := readFrame(bufio.NewReader(bytes.NewReader(test.frame)), 65536)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if fin != test.fin || opcode != test.opcode || !bytes.Equal(payload, test.payload) {
+			t.Errorf("%s: read %v %x %q", test.name, fin, opcode, payload)
+		}
+	}
+	for _, frame := range []string{"\x81", "\x81\x05Hel", "\x82\x7e\x01", "\x81\x85\x37\xfa"} {
+		if _, _, _, err := readFrame(bufio.NewReader(bytes.NewReader([]byte(frame))), 65536); err == nil {
+			t.Errorf("truncated frame %q is read", frame)
+		}
+	}
+	// the length of an oversized frame is rejected before the payload is read
+	for _, frame := range []string{"\x82\x7f\x00\x00\x00\x00\x00\x01\x00\x01", "\x82\x7f\xff\xff\xff\xff\xff\xff\xff\xff"} {
+		_, _, _, err := readFrame(bufio.NewReader(bytes.NewReader([]byte(frame))), 65536)
+		if reason := ClassifyError(err); reason != "websocket_too_large" {
+			t.Errorf("oversized frame %q is %s, %v", frame, reason, err)
+		}
+	}
+}
+
+// TestWriteFrame checks the header and the masking of client frames and
+// reads them back.
+func TestWriteFrame(t *testing.T) {
+	tests := []struct {
+		size   int
+		header []byte // without the mask bit
+	}{
+		{0, []byte{0x82, 0}},
+		{125, []byte{0x82, 125}},
+		{126, []byte{0x82, 126, 0, 126}},
+		{65535, []byte{0x82, 126, 0xff, 0xff}},
+		{65536, []byte{0x82, 127, 0, 0, 0, 0, 0, 1, 0, 0}},
+	}
+	for _, test := range tests {
+		payload := bytes.Repeat([]byte("a"), test.size)
+		buffer := &bytes.Buffer{}
+		w := bufio.NewWriter(buffer)
+		n, err := writeFrame(w, true, wsBinary, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Flush()
+		frame := buffer.Bytes()
+		if n != len(frame) {
+			t.Errorf("frame of %d bytes is counted as %d, written %d", test.size, n, len(frame))
+		}
+		if len(frame) != len(test.header)+4+test.size {
+			t.Errorf("frame of %d bytes has %d bytes", test.size, len(frame))
+			continue
+		}
+		if frame[1]&0x80 == 0 {
+			t.Errorf("frame of %d bytes is not masked", test.size)
+		}
+		frame[1] &^= 0x80
+		if !bytes.Equal(frame[:len(test.header)], test.header) {
+			t.Errorf("frame of %d bytes has header %x, expect %x", test.size, frame[:len(test.header)], test.header)
+		}
+		mask := frame[len(test.header) : len(test.header)+4]
+		for i, b := range frame[len(test.header)+4:] {
+			if b^mask[i%4] != 'a' {
+				t.Errorf("frame of %d bytes has byte %d masked wrong", test.size, i)
+				break
+			}
+		}
+		frame[1] |= 0x80
+		fin, opcode, read, err := readFrame(bufio.NewReader(bytes.NewReader(frame)), 65536)
+		if err != nil || !fin || opcode != wsBinary || !bytes.Equal(read, payload) {
+			t.Errorf("frame of %d bytes is read back as %v %x %d bytes, %v", test.size, fin, opcode, len(read), err)
+		}
+	}
+
+	buffer := &bytes.Buffer{}
+	w := bufio.NewWriter(buffer)
+	writeFrame(w, false, wsText, []byte("Hel"))
+	w.Flush()
+	if first := buffer.Bytes()[0]; first != wsText {
+		t.Errorf("first fragment starts with %x", first)
+	}
+	if size := buffer.Bytes()[1] &^ 0x80; size != 3 {
+		t.Errorf("first fragment has length %d", size)
+	}
+}
+
+func TestWebSocketUrl(t *testing.T) {
+	conf := &Config{WebSocketUrl: "ws://127.0.0.1:8080/ws/{{.Topic}}?run={{.RunId}}", RunId: "r1"}
+	if wsUrl, err := WebSocketUrl("t1", conf); err != nil || wsUrl != "ws://127.0.0.1:8080/ws/t1?run=r1" {
+		t.Errorf("WebSocketUrl = %s, %v", wsUrl, err)
+	}
+	conf.WebSocketUrl = "ws://127.0.0.1:8080/{{.Unknown}}"
+	if _, err := WebSocketUrl("t1", conf); err == nil {
+		t.Error("unknown variable is rendered")
+	}
+}
+
+// TestWebSocketConnSend sends messages larger than the write buffer to a
+// fake server acking the first one and answering the second one with an
+// oversized frame.
+func TestWebSocketConnSend(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan int, 2)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+			wsAcceptKey(request.Header.Get("Sec-WebSocket-Key")))
+		for _, answer := range []string{"\x81\x02ok", "\x82\x7f\x00\x00\x00\x00\x00\x10\x00\x00"} {
+			_, _, payload, err := readFrame(reader, 1<<20)
+			if err != nil {
+				return
+			}
+			received <- len(payload)
+			conn.Write([]byte(answer))
+		}
+		io.Copy(io.Discard, conn)
+	}()
+
+	conf := testConf(t, fmt.Sprintf(`
+[required]
+topics=["t1"]
+[test]
+usemethod=15
+[websocket]
+url="ws://%s/ws"
+ackmode="echo"
+maxreadsize=1024
+`, listener.Addr()))
+	conn := SharedWebSocketConn(conf, conf.WebSocketUrl)
+	data := bytes.Repeat([]byte("a"), 100*1024)
+
+	statis := NewStatistician("t1")
+	if err := conn.Send(wsBinary, data, statis); err != nil {
+		t.Fatal(err)
+	}
+	// a frame with 8 bytes of length, the mask and the payload
+	if statis.WireBytes != int64(10+4+len(data)) || statis.Frames != 1 || !statis.ConnOpened {
+		t.Errorf("first message: %+v", statis)
+	}
+	if size := <-received; size != len(data) {
+		t.Errorf("server received %d bytes", size)
+	}
+
+	statis = NewStatistician("t1")
+	err = conn.Send(wsBinary, data, statis)
+	if reason := ClassifyError(err); reason != "websocket_too_large" {
+		t.Errorf("oversized ack is %s, %v", reason, err)
+	}
+}